@@ -0,0 +1,103 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package audit keeps a central record of the Control actions performed by Integrations so that
+// questions like "why did the heating turn on?" can be answered.
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SMerrony/aghast/mqtt"
+)
+
+// Subtopic is where audit records are published
+const Subtopic = "/audit"
+
+// RecordT is a single audit record, it is published as JSON
+type RecordT struct {
+	Time    string
+	Source  string // eg. "client" or "automation"
+	Target  string // the device (or other thing) acted upon
+	Action  string
+	Outcome string // "OK" or the error that occurred
+}
+
+var (
+	auditMu sync.Mutex
+	mq      *mqtt.MQTT
+	logFile *os.File
+)
+
+// Start enables auditing, records are published via mqttConn and, if filename is not empty,
+// appended to that file one JSON object per line.
+func Start(mqttConn *mqtt.MQTT, filename string) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	mq = mqttConn
+	if filename != "" {
+		f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Printf("ERROR: Audit could not open log file %s - %s\n", filename, err.Error())
+			return err
+		}
+		logFile = f
+	}
+	return nil
+}
+
+// Record should be called by Integrations after performing a Control action,
+// err is the result of the action (nil if it succeeded).
+func Record(source, target, action string, err error) {
+	rec := RecordT{
+		Time:    time.Now().Format(time.RFC3339),
+		Source:  source,
+		Target:  target,
+		Action:  action,
+		Outcome: "OK",
+	}
+	if err != nil {
+		rec.Outcome = err.Error()
+	}
+	recBytes, jErr := json.Marshal(rec)
+	if jErr != nil {
+		log.Printf("WARNING: Audit could not marshal record - %s\n", jErr.Error())
+		return
+	}
+	auditMu.Lock()
+	if logFile != nil {
+		if _, wErr := logFile.Write(append(recBytes, '\n')); wErr != nil {
+			log.Printf("WARNING: Audit could not write to log file - %s\n", wErr.Error())
+		}
+	}
+	m := mq
+	auditMu.Unlock()
+	if m != nil {
+		m.PublishChan <- mqtt.AghastMsgT{
+			Subtopic: Subtopic,
+			Qos:      0,
+			Retained: false,
+			Payload:  string(recBytes),
+		}
+	}
+}
@@ -20,13 +20,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
 
+	"github.com/SMerrony/aghast/audit"
 	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/events"
 	"github.com/SMerrony/aghast/mqtt"
 	"github.com/SMerrony/aghast/server"
 )
@@ -34,6 +37,7 @@ import (
 const SemVer = "v0.5.2" // TODO Update SemVer on each release
 
 var (
+	checkFlag   = flag.Bool("check", false, "check the configuration and exit without starting")
 	configFlag  = flag.String("configdir", "", "directory containing configuration files")
 	versionFlag = flag.Bool("version", false, "display version number and exit")
 )
@@ -61,9 +65,30 @@ func main() {
 		log.Fatalf("ERROR: Failed to load main config file with: %s", err.Error())
 	}
 
-	mq := mqtt.MQTT{}
+	if *checkFlag {
+		if err := server.CheckIntegrations(conf); err != nil {
+			log.Fatalln("ERROR: Configuration check failed - " + err.Error())
+		}
+		log.Println("INFO: Configuration check passed")
+		return
+	}
+
+	mq := mqtt.MQTT{
+		TimestampPayloads: conf.MqttTimestamps,
+		ProtocolVersion:   conf.MqttVersion,
+		OutboundQueueLen:  conf.MqttOutboundQueue,
+		InboundQueueLen:   conf.MqttInboundQueue,
+	}
 	mqttChan := mq.Start(conf.MqttBroker, conf.MqttPort, conf.MqttUsername, conf.MqttPassword, conf.MqttClientID, conf.MqttBaseTopic)
 
+	if err := audit.Start(&mq, conf.AuditLogFile); err != nil {
+		log.Println("WARNING: Control actions will not be written to the audit log file")
+	}
+
+	// some Integrations (eg. Tuya and VirtualSwitch) accept Actions and Queries via the event bus
+	ctx, cancel := context.WithCancel(context.Background())
+	events.StartEventManager(ctx, conf.LogEvents, conf.EventHistory)
+
 	server.StartIntegrations(conf, &mq)
 
 	mqttChan <- mqtt.AghastMsgT{
@@ -76,5 +101,5 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt)
 	<-sigChan
-
+	cancel()
 }
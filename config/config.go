@@ -29,6 +29,7 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/pelletier/go-toml"
 )
@@ -39,6 +40,9 @@ const (
 	constantsFilename  = "/constants.toml"
 	secretLabel        = "!!SECRET("
 	constantLabel      = "!!CONSTANT("
+	includeLabel       = "!!INCLUDE("
+	// InstanceSeparator separates an Integration from its instance name in the Integrations list, eg. "scraper:printers"
+	InstanceSeparator = ":"
 )
 
 // A MainConfigT holds the top-level configuration details
@@ -49,13 +53,49 @@ type MainConfigT struct {
 	MqttPort            int
 	MqttUsername        string
 	MqttPassword        string
+	MqttPasswordFile    string // OPTIONAL file holding the MQTT password, overrides MqttPassword
 	MqttClientID        string
 	MqttBaseTopic       string
+	MqttTimestamps      bool   // wrap AGHAST payloads in a JSON envelope with a timestamp
+	MqttVersion         int    // OPTIONAL 5 to use MQTT v5, default is v3.1.1
+	MqttReload          bool   // OPTIONAL allow Integrations to be reloaded via MQTT
+	MaintenanceMode     bool   // OPTIONAL start with Control actions suppressed
+	MqttOutboundQueue   int    // OPTIONAL size of the MQTT publishing queues
+	MqttInboundQueue    int    // OPTIONAL size of each MQTT subscription queue
+	HeartbeatSecs       int    // OPTIONAL period of the aghast/heartbeat message, none if zero
+	AuditLogFile        string // OPTIONAL file to which Control actions are appended
+	LogEvents           bool   // OPTIONAL log every event passing through the event manager
+	EventHistory        int    // OPTIONAL number of recent events listed on the admin page, none if zero
 	Integrations        []string
+	StartDelaySecs      map[string]int // OPTIONAL delay before starting each named Integration at startup
+	LogTimezone         string         // OPTIONAL IANA zone for logged timestamps, eg. "UTC", default is local time
+	LogTimeFormat       string         // OPTIONAL "RFC3339" (the default), "RFC3339Nano", or a Go time layout
 	ControlPort         int
 	ConfigDir           string
 }
 
+// the zone and format of timestamps written by the logging Integrations, set by LoadMainConfig
+var (
+	logLocation   = time.Local
+	logTimeFormat = time.RFC3339
+)
+
+// named LogTimeFormats
+var timeFormats = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+}
+
+// LogTime returns the current time in the configured LogTimezone, for timestamping logged values
+func LogTime() time.Time {
+	return time.Now().In(logLocation)
+}
+
+// LogTimestamp formats a LogTime using the configured LogTimeFormat
+func LogTimestamp(t time.Time) string {
+	return t.Format(logTimeFormat)
+}
+
 // CheckMainConfig performs a simple sanity check on the main config.toml and its directory
 func CheckMainConfig(configDir string) error {
 	mainConfig, err := toml.LoadFile(configDir + mainConfigFilename)
@@ -83,9 +123,10 @@ func CheckMainConfig(configDir string) error {
 	// there should be a config file for each Integration and the time Integration must be specified
 	timeFound := false
 	for _, i := range integrations {
-		if _, err := os.Stat(configDir + "/" + i + ".toml"); err != nil {
+		name := ConfigName(i)
+		if _, err := os.Stat(configDir + "/" + name + ".toml"); err != nil {
 			// or a directory of configs...
-			if _, err := os.Stat(configDir + "/" + i); err != nil {
+			if _, err := os.Stat(configDir + "/" + name); err != nil {
 				return errors.New("No config file found for Integration: " + i)
 			}
 		}
@@ -99,15 +140,67 @@ func CheckMainConfig(configDir string) error {
 	return nil
 }
 
+// SplitInstance returns the Integration and (possibly empty) instance names of an Integrations list entry
+func SplitInstance(entry string) (integration, instance string) {
+	if ix := strings.Index(entry, InstanceSeparator); ix != -1 {
+		return entry[:ix], entry[ix+len(InstanceSeparator):]
+	}
+	return entry, ""
+}
+
+// ConfigName returns the name of the configuration file (without .toml) for an Integrations list entry,
+// eg. "scraper" for "scraper", and "scraper-printers" for "scraper:printers"
+func ConfigName(entry string) string {
+	integration, instance := SplitInstance(entry)
+	if instance == "" {
+		return integration
+	}
+	return integration + "-" + instance
+}
+
+// InstanceConfigFilename returns an Integration's configuration filename for the given instance,
+// eg. "/scraper.toml" becomes "/scraper-printers.toml"
+func InstanceConfigFilename(filename, instance string) string {
+	if instance == "" {
+		return filename
+	}
+	return strings.TrimSuffix(filename, ".toml") + "-" + instance + ".toml"
+}
+
 // LoadMainConfig does what it says on the tin
 func LoadMainConfig(configDir string) (MainConfigT, error) {
 	var conf MainConfigT
 	t, err := PreprocessTOML(configDir, mainConfigFilename)
+	if err != nil {
+		log.Printf("ERROR: Could not preprocess Main config due to %s\n", err.Error())
+		return conf, err
+	}
 	err = toml.Unmarshal(t, &conf)
 	if err != nil {
 		log.Fatalf("ERROR: Could not load Main config due to %s\n", err.Error())
 		return conf, err
 	}
+	if conf.MqttPasswordFile != "" {
+		pw, err := ioutil.ReadFile(conf.MqttPasswordFile)
+		if err != nil {
+			log.Printf("ERROR: Could not read MqttPasswordFile %s - %s\n", conf.MqttPasswordFile, err.Error())
+			return conf, err
+		}
+		conf.MqttPassword = strings.TrimSpace(string(pw))
+	}
+	if conf.LogTimezone != "" {
+		if logLocation, err = time.LoadLocation(conf.LogTimezone); err != nil {
+			log.Printf("ERROR: Unknown LogTimezone %s - %s\n", conf.LogTimezone, err.Error())
+			logLocation = time.Local
+			return conf, err
+		}
+	}
+	if conf.LogTimeFormat != "" {
+		logTimeFormat = conf.LogTimeFormat
+		if named, found := timeFormats[conf.LogTimeFormat]; found {
+			logTimeFormat = named
+		}
+	}
 	log.Printf("INFO: Main config for %s loaded, MQTT Broker is %s, base topic is %s\n", conf.SystemName, conf.MqttBroker, conf.MqttBaseTopic)
 	conf.ConfigDir = configDir
 	return conf, nil
@@ -115,13 +208,9 @@ func LoadMainConfig(configDir string) (MainConfigT, error) {
 
 // PreprocessTOML reads a TOML config file and substitutes !!SECRET() and !!CONSTANT()
 // strings for their corresponding values.
+// A line containing only !!INCLUDE(<filename>) is replaced by the preprocessed contents of that file,
+// which is relative to the config directory.
 func PreprocessTOML(configDir string, fileName string) (preprocessed []byte, e error) {
-	rawFile, err := os.Open(configDir + fileName)
-	if err != nil {
-		return nil, err
-	}
-	rawReader := bufio.NewReader(rawFile)
-
 	// preload the secrets and constants configs
 	secretsConf, err := toml.LoadFile(configDir + secretsFilename)
 	if err != nil {
@@ -133,6 +222,23 @@ func PreprocessTOML(configDir string, fileName string) (preprocessed []byte, e e
 		log.Println("ERROR: Could not load constants configuration ", err.Error())
 		return nil, err
 	}
+	return preprocess(configDir, fileName, secretsConf, constantsConf, make(map[string]bool))
+}
+
+// preprocess does the work for PreprocessTOML, including holds the files currently being
+// included so that circular includes can be detected.
+func preprocess(configDir string, fileName string, secretsConf, constantsConf *toml.Tree, including map[string]bool) (preprocessed []byte, e error) {
+	if including[fileName] {
+		return nil, errors.New("Circular include of " + fileName)
+	}
+	including[fileName] = true
+	defer delete(including, fileName)
+	rawFile, err := os.Open(configDir + fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer rawFile.Close()
+	rawReader := bufio.NewReader(rawFile)
 
 	for {
 		rawLine, err := rawReader.ReadString('\n')
@@ -143,6 +249,20 @@ func PreprocessTOML(configDir string, fileName string) (preprocessed []byte, e e
 			// log.Printf("DEBUG: ... new TOML file is:\n%s\n", preprocessed)
 			return preprocessed, nil
 		}
+		if trimmed := strings.TrimSpace(rawLine); strings.HasPrefix(trimmed, includeLabel) && strings.HasSuffix(trimmed, ")") {
+			// we have a line like this: !!INCLUDE(scrapers/printers.toml)
+			incName := "/" + trimmed[len(includeLabel):len(trimmed)-1]
+			included, err := preprocess(configDir, incName, secretsConf, constantsConf, including)
+			if err != nil {
+				log.Printf("ERROR: Could not include %s in %s\n", incName, fileName)
+				return nil, err
+			}
+			if len(included) > 0 && included[len(included)-1] != '\n' {
+				included = append(included, '\n')
+			}
+			preprocessed = append(preprocessed, included...)
+			continue
+		}
 		if sIx := strings.Index(rawLine, secretLabel); sIx != -1 {
 			// we have a line like this: port = "!!SECRET(portnum)"
 			// log.Printf("DEBUG: Found config line with secret: %s", rawLine)
@@ -162,6 +282,8 @@ func PreprocessTOML(configDir string, fileName string) (preprocessed []byte, e e
 				procdLine += fmt.Sprintf("%d\n", newVal.(int64))
 			case reflect.Float64:
 				procdLine += fmt.Sprintf("%f\n", newVal.(float64))
+			case reflect.Bool:
+				procdLine += fmt.Sprintf("%t\n", newVal.(bool))
 			}
 			// log.Printf("DEBUG: ... replacement line is: %s", procdLine)
 			preprocessed = append(preprocessed, []byte(procdLine)...)
@@ -186,6 +308,8 @@ func PreprocessTOML(configDir string, fileName string) (preprocessed []byte, e e
 				procdLine += fmt.Sprintf("%d\n", newVal.(int64))
 			case reflect.Float64:
 				procdLine += fmt.Sprintf("%f\n", newVal.(float64))
+			case reflect.Bool:
+				procdLine += fmt.Sprintf("%t\n", newVal.(bool))
 			}
 			// log.Printf("DEBUG: ... replacement line is: %s\n", procdLine)
 			preprocessed = append(preprocessed, []byte(procdLine)...)
@@ -0,0 +1,77 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isoDuration matches the ISO 8601 durations we accept, eg. "PT30S", "P1DT12H", or "-PT15M"
+var isoDuration = regexp.MustCompile(`^(-)?P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// ParseDuration accepts either a Go-style duration, eg. "30s", "5m", or "1h30m",
+// or an ISO 8601 duration of days, hours, minutes, and seconds, eg. "PT5M" or "P1D"
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	u := strings.ToUpper(s)
+	parts := isoDuration.FindStringSubmatch(u)
+	if parts == nil || strings.HasSuffix(u, "T") || strings.TrimPrefix(u, "-") == "P" {
+		return 0, fmt.Errorf("invalid duration '%s', use eg. \"30s\", \"5m\", \"2h\", or \"PT5M\"", s)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute} {
+		if parts[i+2] != "" {
+			n, _ := strconv.Atoi(parts[i+2])
+			d += time.Duration(n) * unit
+		}
+	}
+	if parts[5] != "" {
+		secs, _ := strconv.ParseFloat(parts[5], 64)
+		d += time.Duration(secs * float64(time.Second))
+	}
+	if parts[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// DurationSecs returns the number of whole seconds in the duration, which must be at least one second,
+// if one is given, otherwise secs unchanged.
+// It lets a readable interval be configured in place of an older integer number of seconds.
+func DurationSecs(duration string, secs int) (int, error) {
+	if duration == "" {
+		return secs, nil
+	}
+	d, err := ParseDuration(duration)
+	if err != nil {
+		return 0, err
+	}
+	if d < time.Second {
+		return 0, fmt.Errorf("duration '%s' is less than one second", duration)
+	}
+	return int(d / time.Second), nil
+}
@@ -0,0 +1,75 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		s     string
+		want  time.Duration
+		valid bool
+	}{
+		{"30s", 30 * time.Second, true},
+		{"5m", 5 * time.Minute, true},
+		{"1h30m", 90 * time.Minute, true},
+		{" 2h ", 2 * time.Hour, true},
+		{"-30m", -30 * time.Minute, true},
+		{"PT30S", 30 * time.Second, true},
+		{"PT5M", 5 * time.Minute, true},
+		{"P1DT12H", 36 * time.Hour, true},
+		{"pt1.5s", 1500 * time.Millisecond, true},
+		{"-PT15M", -15 * time.Minute, true},
+		{"P", 0, false},
+		{"PT", 0, false},
+		{"P1DT", 0, false},
+		{"30", 0, false},
+		{"five minutes", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.s)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParseDuration(%q) error %v, expected valid %v", tt.s, err, tt.valid)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseDuration(%q) got %v, expected %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestDurationSecs(t *testing.T) {
+	if secs, err := DurationSecs("", 90); secs != 90 || err != nil {
+		t.Errorf("DurationSecs with no duration got %d, %v, expected 90", secs, err)
+	}
+	if secs, err := DurationSecs("5m", 90); secs != 300 || err != nil {
+		t.Errorf("DurationSecs(5m) got %d, %v, expected 300", secs, err)
+	}
+	if _, err := DurationSecs("soon", 90); err == nil {
+		t.Error("DurationSecs(soon) should fail")
+	}
+	if _, err := DurationSecs("500ms", 90); err == nil {
+		t.Error("DurationSecs(500ms) should fail")
+	}
+}
@@ -20,10 +20,13 @@
 package events
 
 import (
+	"context"
 	"errors"
 	"log"
 	"strings"
 	"sync"
+
+	"github.com/SMerrony/aghast/metrics"
 )
 
 const (
@@ -75,11 +78,16 @@ type subscriptionT struct {
 
 var (
 	eventMgrChan  chan EventT
+	managerCtx    context.Context
 	idMu          sync.Mutex
 	subIDs        []string
 	subsMu        sync.RWMutex
 	subscriptions map[string][]subscriptionT
 	logEvents     bool
+	historyMu     sync.RWMutex
+	history       []EventT // ring buffer of recent events, nil if not enabled
+	historyNext   int      // where the next event will be stored in history
+	historyFull   bool     // history has wrapped around
 )
 
 // DumpSubs is a debugging function...
@@ -116,16 +124,42 @@ func GetSubscriberID(name string) int {
 	return -1
 }
 
-// StartEventManager performs any setup required, then launches the eventManager Goroutine.
+// StartEventManager performs any setup required, then launches the eventManager Goroutine
+// which runs until ctx is cancelled.
+// If historyLen is greater than zero the most recent historyLen events are retained for RecentEvents.
 // It returns the main Event channel to which Integrations should send their Events.
-func StartEventManager(logevents bool) chan EventT {
+func StartEventManager(ctx context.Context, logevents bool, historyLen int) chan EventT {
 	logEvents = logevents
+	historyMu.Lock()
+	history = nil
+	historyNext, historyFull = 0, false
+	if historyLen > 0 {
+		history = make([]EventT, historyLen)
+	}
+	historyMu.Unlock()
 	eventMgrChan = make(chan EventT, managerEventsBuffer)
 	subscriptions = make(map[string][]subscriptionT)
-	go eventManager()
+	managerCtx = ctx
+	go eventManager(ctx)
 	return eventMgrChan
 }
 
+// Publish sends an event to the event manager for delivery to any subscribers
+func Publish(ev EventT) {
+	if eventMgrChan == nil {
+		log.Printf("WARNING: EventManager not started, discarding %s event\n", ev.Name)
+		return
+	}
+	if managerCtx.Err() == nil {
+		select {
+		case eventMgrChan <- ev:
+			return
+		case <-managerCtx.Done():
+		}
+	}
+	log.Printf("WARNING: EventManager has stopped, discarding %s event\n", ev.Name)
+}
+
 func sendOrCrash(ev EventT, dest subscriptionT) {
 	if logEvents {
 		log.Printf("DEBUG: ... forwarding event to subscriber %d (%s)\n", dest.subscriber, subIDs[dest.subscriber])
@@ -147,18 +181,93 @@ func (e *EventT) StartsWith(start string) bool {
 	return strings.HasPrefix(e.Name, start+"/")
 }
 
-func nameDepth(name string) int {
-	return strings.Count(name, "/") + 1
+// Field returns the element of the event name at index (see EvIntegration etc.),
+// or an empty string if the name does not have that many elements.
+func (e *EventT) Field(index int) string {
+	fields := strings.Split(e.Name, "/")
+	if index < 0 || index >= len(fields) {
+		return ""
+	}
+	return fields[index]
+}
+
+// Matches returns true if the event name matches the pattern, which may contain
+// MQTT-style wildcards: "+" matches any single element, a final "#" matches any remaining elements.
+func (e *EventT) Matches(pattern string) bool {
+	return matches(e.Name, pattern)
+}
+
+func matches(name, pattern string) bool {
+	nameFields := strings.Split(name, "/")
+	patFields := strings.Split(pattern, "/")
+	for i, p := range patFields {
+		if p == "#" && i == len(patFields)-1 {
+			return true
+		}
+		if i >= len(nameFields) || (p != "+" && p != nameFields[i]) {
+			return false
+		}
+	}
+	return len(nameFields) == len(patFields)
+}
+
+// recordEvent stores the event in the history ring buffer, if it is enabled
+func recordEvent(ev EventT) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if history == nil {
+		return
+	}
+	history[historyNext] = ev
+	historyNext++
+	if historyNext == len(history) {
+		historyNext = 0
+		historyFull = true
+	}
+}
+
+// RecentEvents returns up to n of the most recently handled events, oldest first.
+// Nothing is returned unless history was enabled when the event manager was started.
+func RecentEvents(n int) []EventT {
+	historyMu.RLock()
+	defer historyMu.RUnlock()
+	stored := historyNext
+	if historyFull {
+		stored = len(history)
+	}
+	if n > stored {
+		n = stored
+	}
+	if n <= 0 {
+		return nil
+	}
+	recent := make([]EventT, n)
+	start := historyNext - n
+	if start < 0 {
+		start += len(history)
+	}
+	for i := 0; i < n; i++ {
+		recent[i] = history[(start+i)%len(history)]
+	}
+	return recent
 }
 
-func eventManager() {
+func eventManager(ctx context.Context) {
 	for {
-		ev := <-eventMgrChan
+		var ev EventT
+		select {
+		case <-ctx.Done():
+			log.Println("INFO: EventManager stopping")
+			return
+		case ev = <-eventMgrChan:
+		}
+		metrics.EventsProcessed.Inc()
 		// if ev.EventName != "Second" && logEvents {
 		if !ev.EndsWith("Second") && logEvents {
 			log.Printf("DEBUG: EventManager got %s event with %v\n", ev.Name, ev.Value)
 		}
 		// TODO Handle system-level events such as 'shutdown'
+		recordEvent(ev)
 		subsMu.RLock()
 
 		// explicit subscriptions
@@ -172,25 +281,13 @@ func eventManager() {
 			}
 		}
 
-		// match with pluses...
+		// match with wildcards...
 		for key, sub := range subscriptions {
-			if strings.Count(key, "+") > 0 && nameDepth(key) == nameDepth(ev.Name) {
-				// there are the same number of fields, and some pluses in the subscription
-				splitEvent := strings.Split(ev.Name, "/")
-				splitSub := strings.Split(key, "/")
-				matched := true
-				for i := 0; i < len(splitEvent); i++ {
-					if splitEvent[i] != splitSub[i] && splitSub[i] != "+" {
-						matched = false
-						break
-					}
-				}
-				if matched {
-					for _, dest := range sub {
-						sendOrCrash(ev, dest)
-						if logEvents {
-							log.Printf("DEBUG: ... forwarding to subscriber No. %d\n", dest.subscriber)
-						}
+			if strings.ContainsAny(key, "+#") && ev.Matches(key) {
+				for _, dest := range sub {
+					sendOrCrash(ev, dest)
+					if logEvents {
+						log.Printf("DEBUG: ... forwarding to subscriber No. %d\n", dest.subscriber)
 					}
 				}
 			}
@@ -200,8 +297,9 @@ func eventManager() {
 	}
 }
 
-// Subscribe registers a subscription to an event returning a channel for the events
-func Subscribe(subscriberID int, evName string) (chan EventT, error) {
+// Subscribe registers a subscription to an event returning a channel for the events.
+// When ctx is cancelled the subscription is removed and the channel is closed.
+func Subscribe(ctx context.Context, subscriberID int, evName string) (chan EventT, error) {
 	if isSubscribed(subscriberID, evName) {
 		return nil, errors.New("Already subscribed to event: " + evName)
 	}
@@ -222,9 +320,29 @@ func Subscribe(subscriberID int, evName string) (chan EventT, error) {
 	if logEvents {
 		log.Printf("DEBUG: Event Manager - subscriber No. %d has subscribed to %s\n", subscriberID, evName)
 	}
+	if ctx.Done() != nil {
+		go func() {
+			<-ctx.Done()
+			removeChan(evName, newChan)
+			close(newChan) // safe, as events are only sent to subscribed channels, with subsMu held
+		}()
+	}
 	return newChan, nil
 }
 
+// removeChan removes the subscription for evName using ch, if it is still present
+func removeChan(evName string, ch chan EventT) {
+	subsMu.Lock()
+	defer subsMu.Unlock()
+	var newSubs []subscriptionT
+	for _, s := range subscriptions[evName] {
+		if s.channel != ch {
+			newSubs = append(newSubs, s)
+		}
+	}
+	setSubs(evName, newSubs)
+}
+
 // Unsubscribe cancels an exisiting event subscription
 func Unsubscribe(subscriberID int, evName string) error {
 	if !isSubscribed(subscriberID, evName) {
@@ -239,10 +357,20 @@ func Unsubscribe(subscriberID int, evName string) error {
 			newSubs = append(newSubs, s)
 		}
 	}
-	subscriptions[evName] = newSubs
+	setSubs(evName, newSubs)
 	return nil
 }
 
+// setSubs replaces the subscriptions for evName, forgetting the event entirely if there are none left,
+// subsMu must be held
+func setSubs(evName string, subs []subscriptionT) {
+	if len(subs) == 0 {
+		delete(subscriptions, evName)
+		return
+	}
+	subscriptions[evName] = subs
+}
+
 func isSubscribed(subscriberID int, evName string) bool {
 	subsMu.RLock()
 	defer subsMu.RUnlock()
@@ -20,7 +20,9 @@
 package events
 
 import (
+	"context"
 	"testing"
+	"time"
 )
 
 func TestGetSubscriberID(t *testing.T) {
@@ -42,7 +44,7 @@ func TestSubscription(t *testing.T) {
 	if isSubscribed(sid, "eventName") {
 		t.Error("isSubscribed gave false positive")
 	}
-	ch, err := Subscribe(sid, "eventName")
+	ch, err := Subscribe(context.Background(), sid, "eventName")
 	if err != nil {
 		t.Errorf(err.Error())
 	}
@@ -52,7 +54,7 @@ func TestSubscription(t *testing.T) {
 	if !isSubscribed(sid, "eventName") {
 		t.Error("isSubscribed negative for newly-subscribed event")
 	}
-	ch, err = Subscribe(sid, "eventName")
+	ch, err = Subscribe(context.Background(), sid, "eventName")
 	if err == nil {
 		t.Error("re-subscription to already-subscribed event did not return an error")
 	}
@@ -62,7 +64,7 @@ func TestSubscription(t *testing.T) {
 	if isSubscribed(sid2, "eventName") {
 		t.Error("2nd isSubscribed gave false positive")
 	}
-	ch, err = Subscribe(sid2, "eventName")
+	ch, err = Subscribe(context.Background(), sid2, "eventName")
 	if err != nil {
 		t.Errorf(err.Error())
 	}
@@ -72,13 +74,13 @@ func TestSubscription(t *testing.T) {
 	if !isSubscribed(sid2, "eventName") {
 		t.Error("isSubscribed negative for 2nd newly-subscribed event")
 	}
-	ch, err = Subscribe(sid2, "eventName")
+	ch, err = Subscribe(context.Background(), sid2, "eventName")
 	if err == nil {
 		t.Error("2nd re-subscription to already-subscribed event did not return an error")
 	}
 
 	// AND unsubscription...
-	ch, err = Subscribe(sid, "anotherEventName")
+	ch, err = Subscribe(context.Background(), sid, "anotherEventName")
 	if err != nil {
 		t.Errorf(err.Error())
 	}
@@ -91,4 +93,130 @@ func TestSubscription(t *testing.T) {
 	if !isSubscribed(sid, "anotherEventName") {
 		t.Error("isSubscribed negative for previously subscribed event")
 	}
+
+	// unsubscribing the sole subscriber should forget the event
+	if err = Unsubscribe(sid, "anotherEventName"); err != nil {
+		t.Error("failed to unsubscribe from event")
+	}
+	if _, found := subscriptions["anotherEventName"]; found {
+		t.Error("subscriptions still holds event with no subscribers")
+	}
+	if _, found := subscriptions["eventName"]; !found {
+		t.Error("subscriptions lost event which still has a subscriber")
+	}
+}
+
+func TestRecentEvents(t *testing.T) {
+	history = nil
+	historyNext, historyFull = 0, false
+	recordEvent(EventT{Name: "ignored"})
+	if len(RecentEvents(5)) != 0 {
+		t.Error("RecentEvents returned events when history was not enabled")
+	}
+
+	history = make([]EventT, 3)
+	recordEvent(EventT{Name: "one"})
+	recordEvent(EventT{Name: "two"})
+	recent := RecentEvents(5)
+	if len(recent) != 2 || recent[0].Name != "one" || recent[1].Name != "two" {
+		t.Errorf("got %v, expected events one and two", recent)
+	}
+
+	// wrap around
+	recordEvent(EventT{Name: "three"})
+	recordEvent(EventT{Name: "four"})
+	recent = RecentEvents(3)
+	if len(recent) != 3 || recent[0].Name != "two" || recent[2].Name != "four" {
+		t.Errorf("got %v, expected events two to four", recent)
+	}
+	recent = RecentEvents(1)
+	if len(recent) != 1 || recent[0].Name != "four" {
+		t.Errorf("got %v, expected event four", recent)
+	}
+}
+
+func TestField(t *testing.T) {
+	ev := EventT{Name: "Tuya/Control/Hall_Lamp/power"}
+	if ev.Field(EvIntegration) != "Tuya" {
+		t.Errorf("got %s, expected Tuya", ev.Field(EvIntegration))
+	}
+	if ev.Field(EvControl) != "power" {
+		t.Errorf("got %s, expected power", ev.Field(EvControl))
+	}
+	if ev.Field(EvIndex) != "" || ev.Field(-1) != "" {
+		t.Error("out-of-range Field did not return empty string")
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name, pattern string
+		want          bool
+	}{
+		{"Tuya/Control/Hall_Lamp/power", "Tuya/Control/Hall_Lamp/power", true},
+		{"Tuya/Control/Hall_Lamp/power", "Tuya/Control/+/+", true},
+		{"Tuya/Control/Hall_Lamp/power", "Tuya/Query/+/+", false},
+		{"Tuya/Control/Hall_Lamp/power", "Tuya/Control/+", false},
+		{"Tuya/Control/Hall_Lamp", "Tuya/Control/+/+", false},
+		{"Tuya/Control/Hall_Lamp/power", "Tuya/#", true},
+		{"Tuya/Control/Hall_Lamp/power", "#", true},
+		{"Tuya", "Tuya/#", true},
+		{"Time/Second", "Tuya/#", false},
+	}
+	for _, tt := range tests {
+		ev := EventT{Name: tt.name}
+		if got := ev.Matches(tt.pattern); got != tt.want {
+			t.Errorf("%s Matches(%s) got %v, expected %v", tt.name, tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	subIDs = make([]string, 20)
+	subscriptions = make(map[string][]subscriptionT)
+	sid := GetSubscriberID("test")
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := Subscribe(ctx, sid, "eventName")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cancel()
+	select {
+	case _, open := <-ch:
+		if open {
+			t.Error("got an event after cancellation")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel was not closed after cancellation")
+	}
+	if isSubscribed(sid, "eventName") {
+		t.Error("isSubscribed positive after cancellation")
+	}
+	if _, found := subscriptions["eventName"]; found {
+		t.Error("subscriptions still holds event after its only subscription was cancelled")
+	}
+}
+
+func TestEventManagerCancel(t *testing.T) {
+	subIDs = make([]string, 20)
+	ctx, cancel := context.WithCancel(context.Background())
+	StartEventManager(ctx, false, 0)
+	ch, err := Subscribe(context.Background(), GetSubscriberID("test"), "Test/Event")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	Publish(EventT{Name: "Test/Event"})
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("event was not delivered")
+	}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	Publish(EventT{Name: "Test/Event"})
+	select {
+	case <-ch:
+		t.Error("event delivered after the manager was cancelled")
+	case <-time.After(50 * time.Millisecond):
+	}
 }
@@ -3,6 +3,8 @@ module github.com/SMerrony/aghast
 go 1.15
 
 require (
+	github.com/Knetic/govaluate v3.0.0+incompatible
+	github.com/eclipse/paho.golang v0.10.0
 	github.com/eclipse/paho.mqtt.golang v1.3.2
 	github.com/gocolly/colly/v2 v2.1.0
 	github.com/influxdata/influxdb-client-go/v2 v2.2.2
@@ -0,0 +1,208 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aggregate
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
+)
+
+const (
+	configFilename      = "/aggregate.toml"
+	mqttPrefix          = "/aggregate/"
+	defaultIntervalSecs = 60
+)
+
+// defaultStats are calculated for Aggregates which do not specify their own
+var defaultStats = []string{"min", "max", "avg"}
+
+// Aggregate encapsulates the type of this Integration
+type Aggregate struct {
+	Aggregate []aggregateT
+	mutex     sync.RWMutex
+	stopper   safego.Stopper
+	mq        *mqtt.MQTT
+}
+
+type aggregateT struct {
+	Name         string
+	Topic        string
+	Key          string   // optional, JSON key of the value in the payload
+	WindowSecs   int      // statistics are calculated over values received this recently
+	Window       string   // optional readable alternative to WindowSecs, eg. "1h"
+	IntervalSecs int      // optional, how often the statistics are published
+	Every        string   // optional readable alternative to IntervalSecs, eg. "5m"
+	Stats        []string // optional, any of "min", "max", "avg", "count"
+}
+
+// sampleT is a value received at a given time
+type sampleT struct {
+	t     time.Time
+	value float64
+}
+
+// LoadConfig func should simply load any config (TOML) files for this Integration
+func (a *Aggregate) LoadConfig(confdir string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	if err != nil {
+		log.Println("ERROR: Could not preprocess Aggregate configuration ", err.Error())
+		return err
+	}
+	err = toml.Unmarshal(confBytes, a)
+	if err != nil {
+		log.Println("ERROR: Could not load Aggregate configuration ", err.Error())
+		return err
+	}
+	for ix, ag := range a.Aggregate {
+		if ag.WindowSecs, err = config.DurationSecs(ag.Window, ag.WindowSecs); err != nil {
+			log.Printf("ERROR: Aggregate - %s for %s\n", err.Error(), ag.Name)
+			return errors.New("Aggregate configuration error")
+		}
+		if ag.IntervalSecs, err = config.DurationSecs(ag.Every, ag.IntervalSecs); err != nil {
+			log.Printf("ERROR: Aggregate - %s for %s\n", err.Error(), ag.Name)
+			return errors.New("Aggregate configuration error")
+		}
+		a.Aggregate[ix].WindowSecs, a.Aggregate[ix].IntervalSecs = ag.WindowSecs, ag.IntervalSecs
+		if ag.Name == "" || ag.Topic == "" || ag.WindowSecs <= 0 {
+			log.Println("ERROR: Aggregate - every Aggregate must have a Name, Topic and WindowSecs (or Window)")
+			return errors.New("Aggregate configuration error")
+		}
+		if ag.IntervalSecs <= 0 {
+			a.Aggregate[ix].IntervalSecs = defaultIntervalSecs
+		}
+		if len(ag.Stats) == 0 {
+			a.Aggregate[ix].Stats = defaultStats
+		}
+		for _, s := range a.Aggregate[ix].Stats {
+			if _, ok := statistic(s, []sampleT{{value: 0}}); !ok {
+				log.Printf("ERROR: Aggregate - unknown Stat '%s' for %s\n", s, ag.Name)
+				return errors.New("Aggregate configuration error")
+			}
+		}
+	}
+	log.Printf("INFO: Aggregate Integration has %d Aggregates configured\n", len(a.Aggregate))
+	return nil
+}
+
+// Start func begins running the Integration GoRoutines and should return quickly
+func (a *Aggregate) Start(mq *mqtt.MQTT) error {
+	a.mq = mq
+	for _, ag := range a.Aggregate {
+		ag := ag
+		a.stopper.Go("Aggregate "+ag.Name, true, func(stopChan chan bool) { a.runAggregate(ag, stopChan) })
+	}
+	return nil
+}
+
+// Stop terminates the Integration and all Goroutines it contains
+func (a *Aggregate) Stop() {
+	a.stopper.Stop()
+}
+
+func (a *Aggregate) runAggregate(ag aggregateT, stopChan chan bool) {
+	ch := a.mq.SubscribeToTopic(ag.Topic)
+	defer a.mq.UnsubscribeFromTopic(ag.Topic, ch)
+	ticker := time.NewTicker(time.Duration(ag.IntervalSecs) * time.Second)
+	defer ticker.Stop()
+	window := time.Duration(ag.WindowSecs) * time.Second
+	var samples []sampleT
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg := <-ch:
+			value, err := mqtt.PayloadNumber(msg.Payload, ag.Key)
+			if err != nil {
+				log.Printf("WARNING: Aggregate %s - %s\n", ag.Name, err.Error())
+				continue
+			}
+			samples = append(prune(samples, time.Now().Add(-window)), sampleT{t: time.Now(), value: value})
+		case <-ticker.C:
+			samples = prune(samples, time.Now().Add(-window))
+			for _, s := range ag.Stats {
+				v, ok := statistic(s, samples)
+				if !ok {
+					continue // no values in the window
+				}
+				a.mq.PublishChan <- mqtt.AghastMsgT{
+					Subtopic: mqttPrefix + ag.Name + "/" + s,
+					Qos:      0,
+					Retained: false,
+					Payload:  strconv.FormatFloat(v, 'f', -1, 64),
+				}
+			}
+		}
+	}
+}
+
+// prune discards samples received before the start of the window, samples are in time order
+func prune(samples []sampleT, start time.Time) []sampleT {
+	for ix, s := range samples {
+		if !s.t.Before(start) {
+			return samples[ix:]
+		}
+	}
+	return samples[:0]
+}
+
+// statistic calculates the named statistic over the samples, ok is false if the name is unknown
+// or there are no samples
+func statistic(name string, samples []sampleT) (v float64, ok bool) {
+	if len(samples) == 0 {
+		return 0, false
+	}
+	switch name {
+	case "count":
+		return float64(len(samples)), true
+	case "min":
+		v = samples[0].value
+		for _, s := range samples[1:] {
+			if s.value < v {
+				v = s.value
+			}
+		}
+	case "max":
+		v = samples[0].value
+		for _, s := range samples[1:] {
+			if s.value > v {
+				v = s.value
+			}
+		}
+	case "avg":
+		for _, s := range samples {
+			v += s.value
+		}
+		v /= float64(len(samples))
+	default:
+		return 0, false
+	}
+	return v, true
+}
@@ -0,0 +1,64 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package aggregate
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatistic(t *testing.T) {
+	samples := []sampleT{{value: 3}, {value: -1.5}, {value: 7}, {value: 2.5}}
+	tests := []struct {
+		name string
+		want float64
+	}{
+		{"min", -1.5},
+		{"max", 7},
+		{"avg", 2.75},
+		{"count", 4},
+	}
+	for _, tt := range tests {
+		if got, ok := statistic(tt.name, samples); !ok || got != tt.want {
+			t.Errorf("statistic(%s) = %v, %v, expected %v", tt.name, got, ok, tt.want)
+		}
+	}
+	if _, ok := statistic("median", samples); ok {
+		t.Error("unknown statistic was accepted")
+	}
+	if _, ok := statistic("avg", nil); ok {
+		t.Error("statistic of no samples was accepted")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now()
+	samples := []sampleT{
+		{t: now.Add(-3 * time.Minute), value: 1},
+		{t: now.Add(-2 * time.Minute), value: 2},
+		{t: now.Add(-time.Minute), value: 3},
+	}
+	if got := prune(samples, now.Add(-150*time.Second)); len(got) != 2 || got[0].value != 2 {
+		t.Errorf("prune kept %v", got)
+	}
+	if got := prune(samples, now); len(got) != 0 {
+		t.Errorf("prune kept %v", got)
+	}
+}
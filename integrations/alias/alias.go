@@ -0,0 +1,136 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package alias
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/maintenance"
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
+)
+
+const (
+	configFilename     = "/alias.toml"
+	mqttPrefix         = "/alias/"
+	commandTopicPrefix = "aghast/alias/"
+	commandSuffix      = "/set"
+)
+
+// Alias encapsulates the type of this Integration
+type Alias struct {
+	Alias   []aliasT
+	mutex   sync.RWMutex
+	stopper safego.Stopper
+	mq      *mqtt.MQTT
+}
+
+type aliasT struct {
+	Name         string // the friendly name, messages are republished to aghast/alias/<Name>
+	Topic        string // the device's topic
+	CommandTopic string // optional, commands sent to aghast/alias/<Name>/set are forwarded here
+	Retained     bool   // optional, republished messages are retained by the Broker
+}
+
+// LoadConfig func should simply load any config (TOML) files for this Integration
+func (a *Alias) LoadConfig(confdir string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	if err != nil {
+		log.Println("ERROR: Could not preprocess Alias configuration ", err.Error())
+		return err
+	}
+	err = toml.Unmarshal(confBytes, a)
+	if err != nil {
+		log.Println("ERROR: Could not load Alias configuration ", err.Error())
+		return err
+	}
+	names := make(map[string]bool, len(a.Alias))
+	for _, al := range a.Alias {
+		if al.Name == "" || al.Topic == "" {
+			log.Println("ERROR: Alias - every Alias must have a Name and Topic")
+			return errors.New("Alias configuration error")
+		}
+		if names[al.Name] {
+			log.Printf("ERROR: Alias - duplicate Name %s\n", al.Name)
+			return errors.New("Alias configuration error")
+		}
+		names[al.Name] = true
+	}
+	log.Printf("INFO: Alias Integration has %d Aliases configured\n", len(a.Alias))
+	return nil
+}
+
+// Start func begins running the Integration GoRoutines and should return quickly
+func (a *Alias) Start(mq *mqtt.MQTT) error {
+	a.mq = mq
+	for _, al := range a.Alias {
+		al := al
+		a.stopper.Go("Alias "+al.Name, true, func(stopChan chan bool) { a.runAlias(al, stopChan) })
+	}
+	return nil
+}
+
+// Stop terminates the Integration and all Goroutines it contains
+func (a *Alias) Stop() {
+	a.stopper.Stop()
+}
+
+// runAlias republishes the device's messages under the alias, and forwards any commands to the device
+func (a *Alias) runAlias(al aliasT, stopChan chan bool) {
+	ch := a.mq.SubscribeToTopic(al.Topic)
+	defer a.mq.UnsubscribeFromTopic(al.Topic, ch)
+	var cmdChan chan mqtt.GeneralMsgT
+	if al.CommandTopic != "" {
+		cmdTopic := commandTopicPrefix + al.Name + commandSuffix
+		cmdChan = a.mq.SubscribeToTopic(cmdTopic)
+		defer a.mq.UnsubscribeFromTopic(cmdTopic, cmdChan)
+	}
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg := <-ch:
+			a.mq.PublishChan <- mqtt.AghastMsgT{
+				Subtopic: mqttPrefix + al.Name,
+				Qos:      msg.Qos,
+				Retained: al.Retained,
+				Payload:  msg.Payload,
+			}
+		case msg := <-cmdChan:
+			payload, _ := mqtt.PayloadBytes(msg.Payload)
+			if maintenance.Suppressed("mqtt", al.CommandTopic, string(payload)) {
+				continue
+			}
+			a.mq.ThirdPartyChan <- mqtt.GeneralMsgT{
+				Topic:    al.CommandTopic,
+				Qos:      msg.Qos,
+				Retained: false,
+				Payload:  msg.Payload,
+			}
+		}
+	}
+}
@@ -21,31 +21,56 @@ package automation
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Knetic/govaluate"
 	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/events"
+	"github.com/SMerrony/aghast/maintenance"
 	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/registry"
+	"github.com/SMerrony/aghast/safego"
 	"github.com/pelletier/go-toml"
 )
 
 const (
-	automationsSubDir         = "/automation"
-	subscribeName             = "AutomationManager"
-	mqttPrefix                = "aghast/automation/"
-	conditionQueryTimeoutSecs = 5
+	automationsSubDir = "/automation"
+	subscribeName     = "AutomationManager"
+	mqttPrefix        = "aghast/automation/"
 )
 
+// conditionQueryTimeout is a variable so that tests may shorten it
+var conditionQueryTimeout = 5 * time.Second
+
+// defaultVerifySecs is used for Actions with a VerifyTopic but no VerifyTimeout
+const defaultVerifySecs = 10
+
 // The Automation type encapsulates Automation
 type Automation struct {
 	confDir           string
 	automations       []automationT
 	automationsByName map[string]int
-	mq                *mqtt.MQTT
-	stopChans         map[string]chan bool
+	mq                subscriber
+	publishChan       chan mqtt.AghastMsgT
+	thirdPartyChan    chan mqtt.GeneralMsgT
+	stopper           safego.Stopper
+	mutex             sync.Mutex // guards Enabled changes
+}
+
+// subscriber is the part of *mqtt.MQTT used by Automations, so that they may be tested without a Broker
+type subscriber interface {
+	SubscribeToTopic(topic string) chan mqtt.GeneralMsgT
+	UnsubscribeFromTopic(topic string, ch chan mqtt.GeneralMsgT)
 }
 
 // type eventTypeT int
@@ -55,6 +80,13 @@ type automationT struct {
 	Description      string
 	Enabled          bool
 	EventTopic       string
+	JitterMs         int64  // default random delay for Actions that do not specify their own
+	ActiveFrom       string // optional start of daily active window, "HH:MM"
+	ActiveTo         string // optional end of daily active window, "HH:MM"
+	DryRun           bool   // log the Actions that would be sent, without sending them
+	hasWindow        bool
+	activeFrom       int // minutes after midnight
+	activeTo         int
 	hasCondition     bool
 	condition        conditionT
 	actions          map[string]actionT
@@ -68,30 +100,74 @@ type conditionT struct {
 	Payload    string // MQTT payload for query
 	Key        string // JSON key of condition value
 	Index      int
+	ForSecs    int64  // optional, the Condition must be continuously met for this long
 	is         string // comparison operator, one of: "=", "!=", "<", ">", "<=", ">="
 	value      interface{}
+	Expr       string // optional boolean expression over the payload, instead of Key, Is and Value
+	expr       *govaluate.EvaluableExpression
+
+	// for event bus queries, instead of QueryTopic
+	Integration string // eg. "VirtualSwitch"
+	Device      string
+	QueryType   string // eg. "IsOn" or "FetchLast"
+}
+
+// completedT is the payload published when an Automation has finished running
+type completedT struct {
+	ConditionMet bool
+	Actions      int
+}
+
+// verifyFailedT is the payload published when a device did not confirm an Action in time
+type verifyFailedT struct {
+	Action      string
+	Topic       string
+	VerifyTopic string
+	Expected    interface{}
 }
 
 type actionT struct {
-	Topic   string
-	Payload string
+	Topic    string
+	Payload  string
+	JitterMs int64 // optional, the Action is delayed by a random time up to this
+
+	// optional, the Payload is selected by the triggering event's value (or the value of its MapKey)
+	PayloadMap map[string]string
+	MapKey     string
+	hasPayload bool
+
+	// instead of Topic and Payload, an Action may enable or disable another Automation
+	Automation string
+	Enabled    bool
+
+	// optional, the device must report VerifyValue (or the value of VerifyKey) on VerifyTopic within VerifyTimeout secs
+	VerifyTopic   string
+	VerifyKey     string
+	VerifyTimeout int64
+	verifyValue   interface{}
 }
 
 // LoadConfig loads and stores the configuration for this Integration.
 // All Automations are loaded, whether they are enabled or not.
 func (a *Automation) LoadConfig(confDir string) error {
 	a.confDir = confDir
-	confs, err := ioutil.ReadDir(confDir + automationsSubDir)
+	confs, err := automationFiles(confDir + automationsSubDir)
 	if err != nil {
 		log.Printf("ERROR: Could not read 'automations' config directory, %v\n", err)
 		return err
 	}
 	a.automationsByName = make(map[string]int)
-	for _, config := range confs {
-		log.Printf("INFO: Automation manager loading config: %s\n", config.Name())
+	for _, confFile := range confs {
+		log.Printf("INFO: Automation manager loading config: %s\n", confFile)
 		var newAuto automationT
 		newAuto.actions = make(map[string]actionT)
-		conf, err := toml.LoadFile(confDir + automationsSubDir + "/" + config.Name())
+		// preprocessed so that !!SECRET() and !!CONSTANT() may be used, eg. for Condition Values
+		confBytes, err := config.PreprocessTOML(confDir, automationsSubDir+"/"+confFile)
+		if err != nil {
+			log.Println("ERROR: Could not preprocess Automation configuration ", err.Error())
+			return err
+		}
+		conf, err := toml.LoadBytes(confBytes)
 		if err != nil {
 			log.Println("ERROR: Could not load Automation configuration ", err.Error())
 			return err
@@ -103,7 +179,34 @@ func (a *Automation) LoadConfig(confDir string) error {
 			log.Printf("INFO: ... Disabled in configuration")
 			continue // ignore disabled automations
 		}
-		newAuto.confFilename = config.Name()
+		newAuto.confFilename = confFile
+		if jitter := conf.Get("JitterMs"); jitter != nil {
+			var ok bool
+			if newAuto.JitterMs, ok = jitter.(int64); !ok || newAuto.JitterMs < 0 {
+				log.Printf("ERROR: Automations - JitterMs must be a whole number of milliseconds in %s, ignoring it\n", newAuto.Name)
+				continue
+			}
+		}
+		if dryRun, ok := conf.Get("DryRun").(bool); ok && dryRun {
+			newAuto.DryRun = true
+			log.Printf("INFO: ... Automation %s is a dry run, its Actions will only be logged\n", newAuto.Name)
+		}
+		if conf.Get("ActiveFrom") != nil || conf.Get("ActiveTo") != nil {
+			from, fromOK := conf.Get("ActiveFrom").(string)
+			to, toOK := conf.Get("ActiveTo").(string)
+			if !fromOK || !toOK {
+				log.Printf("ERROR: Automations - both ActiveFrom and ActiveTo must be given for %s, ignoring it\n", newAuto.Name)
+				continue
+			}
+			if newAuto.activeFrom, err = minutesAfterMidnight(from); err == nil {
+				newAuto.activeTo, err = minutesAfterMidnight(to)
+			}
+			if err != nil || newAuto.activeFrom == newAuto.activeTo {
+				log.Printf("ERROR: Automations - invalid active window for %s (use distinct \"HH:MM\" times), ignoring it\n", newAuto.Name)
+				continue
+			}
+			newAuto.ActiveFrom, newAuto.ActiveTo, newAuto.hasWindow = from, to, true
+		}
 		// log.Printf("DEBUG: ... %s, %s\n", newAuto.Name, newAuto.Description)
 		if conf.Get("EventTopic") != nil {
 			newAuto.EventTopic = conf.Get("EventTopic").(string)
@@ -121,6 +224,18 @@ func (a *Automation) LoadConfig(confDir string) error {
 			if conf.Get("Condition.ReplyTopic") != nil {
 				newAuto.condition.ReplyTopic = conf.Get("Condition.ReplyTopic").(string)
 			}
+			if conf.Get("Condition.Integration") != nil {
+				newAuto.condition.Integration, _ = conf.Get("Condition.Integration").(string)
+				newAuto.condition.Device, _ = conf.Get("Condition.Device").(string)
+				newAuto.condition.QueryType, _ = conf.Get("Condition.QueryType").(string)
+				if newAuto.condition.Device == "" || newAuto.condition.QueryType == "" || newAuto.condition.QueryTopic != "" {
+					log.Printf("ERROR: Event bus Condition in %s needs Device and QueryType, and no QueryTopic\n", newAuto.Name)
+					continue
+				}
+				if idx, ok := conf.Get("Condition.Index").(int64); ok {
+					newAuto.condition.Index = int(idx)
+				}
+			}
 			newAuto.condition.Key = ""
 			if conf.Get("Condition.Key") != nil {
 				newAuto.condition.Key = conf.Get("Condition.Key").(string)
@@ -130,23 +245,94 @@ func (a *Automation) LoadConfig(confDir string) error {
 				newAuto.condition.Payload = conf.Get("Condition.Payload").(string)
 			}
 
-			if conf.Get("Condition.Is") == nil {
-				log.Printf("ERROR: No Is clause found for Condition in %s\n", newAuto.Name)
+			if exprStr, ok := conf.Get("Condition.Expr").(string); ok {
+				newAuto.condition.Expr = exprStr
+				if newAuto.condition.expr, err = govaluate.NewEvaluableExpression(exprStr); err != nil {
+					log.Printf("ERROR: Could not parse Condition Expr in %s - %s\n", newAuto.Name, err.Error())
+					continue
+				}
+			} else {
+				if conf.Get("Condition.Is") == nil {
+					log.Printf("ERROR: No Is clause (or Expr) found for Condition in %s\n", newAuto.Name)
+					continue
+				}
+				newAuto.condition.is = conf.Get("Condition.Is").(string)
+				newAuto.condition.value = conf.Get("Condition.Value")
+			}
+			if newAuto.condition.ForSecs, err = forSecs(conf.Get("Condition.ForSecs"), conf.Get("Condition.For")); err != nil {
+				log.Printf("ERROR: Automations - %s in Condition of %s, ignoring it\n", err.Error(), newAuto.Name)
 				continue
 			}
-			newAuto.condition.is = conf.Get("Condition.Is").(string)
-			newAuto.condition.value = conf.Get("Condition.Value")
 
 		} else {
 			newAuto.hasCondition = false
 		}
 		confMap := conf.ToMap()
-		actsConf := confMap["Action"].(map[string]interface{})
+		actsConf, isMap := confMap["Action"].(map[string]interface{})
+		if _, found := confMap["Action"]; !found {
+			log.Printf("INFO: Automation %s has no Actions, its Condition will just be evaluated and logged\n", newAuto.Name)
+		} else if !isMap {
+			log.Printf("ERROR: Automations - Action in %s is not a set of [Action.<label>] sections, ignoring it\n", newAuto.Name)
+			continue
+		}
 		for order, a := range actsConf {
 			var act actionT
-			details := a.(map[string]interface{})
-			act.Topic = details["Topic"].(string)
-			act.Payload = details["Payload"].(string)
+			details, ok := a.(map[string]interface{})
+			if !ok {
+				log.Printf("ERROR: Automation Action %s in %s is not a [Action.<label>] section, ignoring it\n", order, newAuto.Name)
+				continue
+			}
+			if target, ok := details["Automation"].(string); ok {
+				act.Automation = target
+				if act.Enabled, ok = details["Enabled"].(bool); !ok {
+					log.Printf("ERROR: Automation Action %s in %s needs Enabled = true or false, ignoring it\n", order, newAuto.Name)
+					continue
+				}
+			} else {
+				if act.Topic, ok = details["Topic"].(string); !ok {
+					log.Printf("ERROR: Automation Action %s in %s needs a Topic string, ignoring it\n", order, newAuto.Name)
+					continue
+				}
+				if act.Topic == "" {
+					log.Printf("WARNING: Automation Action %s in %s has an empty Topic\n", order, newAuto.Name)
+				}
+				if p, found := details["Payload"]; found {
+					if act.Payload, act.hasPayload = p.(string); !act.hasPayload {
+						log.Printf("ERROR: Automation Action %s in %s has a non-string Payload, quote it, ignoring the Action\n", order, newAuto.Name)
+						continue
+					}
+				}
+				if pm, ok := details["PayloadMap"].(map[string]interface{}); ok {
+					if act.PayloadMap, ok = payloadMap(pm); !ok {
+						log.Printf("ERROR: Automation Action %s in %s has a non-string PayloadMap entry, quote it, ignoring the Action\n", order, newAuto.Name)
+						continue
+					}
+					act.MapKey, _ = details["MapKey"].(string)
+				} else if !act.hasPayload {
+					log.Printf("ERROR: Automation Action %s in %s needs a Payload or PayloadMap, ignoring it\n", order, newAuto.Name)
+					continue
+				}
+			}
+			if verifyTopic, ok := details["VerifyTopic"].(string); ok && act.Automation == "" {
+				act.VerifyTopic = verifyTopic
+				act.VerifyKey, _ = details["VerifyKey"].(string)
+				act.verifyValue = details["VerifyValue"]
+				if act.verifyValue == nil {
+					log.Printf("ERROR: Automation Action %s in %s has a VerifyTopic but no VerifyValue, ignoring it\n", order, newAuto.Name)
+					continue
+				}
+				act.VerifyTimeout = defaultVerifySecs
+				if secs, ok := details["VerifyTimeout"].(int64); ok && secs > 0 {
+					act.VerifyTimeout = secs
+				}
+			}
+			act.JitterMs = newAuto.JitterMs
+			if jitter, found := details["JitterMs"]; found {
+				if act.JitterMs, ok = jitter.(int64); !ok || act.JitterMs < 0 {
+					log.Printf("ERROR: Automation Action %s in %s needs JitterMs to be a whole number of milliseconds, ignoring it\n", order, newAuto.Name)
+					continue
+				}
+			}
 			newAuto.actions[order] = act
 		}
 		newAuto.sortedActionKeys = make([]string, 0, len(newAuto.actions))
@@ -163,48 +349,152 @@ func (a *Automation) LoadConfig(confDir string) error {
 	return nil
 }
 
+// forSecs returns the length of time for which a Condition must be met, from its ForSecs or For settings
+func forSecs(secs, readable interface{}) (int64, error) {
+	var given int64
+	if secs != nil {
+		var ok bool
+		if given, ok = secs.(int64); !ok || given < 0 {
+			return 0, errors.New("ForSecs must be a whole number of seconds")
+		}
+	}
+	if readable == nil {
+		return given, nil
+	}
+	duration, ok := readable.(string)
+	if !ok {
+		return 0, errors.New("For must be a duration string, eg. \"5m\"")
+	}
+	n, err := config.DurationSecs(duration, int(given))
+	return int64(n), err
+}
+
+// payloadMap converts a PayloadMap table, returning false if any of its payloads is not a string
+func payloadMap(table map[string]interface{}) (pm map[string]string, ok bool) {
+	pm = make(map[string]string, len(table))
+	for k, v := range table {
+		if pm[k], ok = v.(string); !ok {
+			return nil, false
+		}
+	}
+	return pm, true
+}
+
+// automationFiles returns the paths, relative to dir, of every .toml file in dir and its subdirectories,
+// hidden files and directories and anything else (eg. editor swap or backup files) are skipped
+func automationFiles(dir string) (files []string, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		hidden := path != dir && strings.HasPrefix(info.Name(), ".")
+		if info.IsDir() {
+			if hidden {
+				log.Printf("INFO: Automation manager skipping hidden directory: %s\n", path)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if hidden || filepath.Ext(path) != ".toml" {
+			log.Printf("INFO: Automation manager skipping non-Automation file: %s\n", path)
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, err
+}
+
+// minutesAfterMidnight converts an "HH:MM" time of day
+func minutesAfterMidnight(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// activeAt returns true if t is within the Automation's daily active window (or it has none),
+// the window may cross midnight.
+func (auto automationT) activeAt(t time.Time) bool {
+	if !auto.hasWindow {
+		return true
+	}
+	now := t.Hour()*60 + t.Minute()
+	if auto.activeFrom < auto.activeTo {
+		return now >= auto.activeFrom && now < auto.activeTo
+	}
+	return now >= auto.activeFrom || now < auto.activeTo
+}
+
 // Start launches a Goroutine for each Automation, LoadConfig() should have been called beforehand.
-func (a *Automation) Start(mq *mqtt.MQTT) {
+func (a *Automation) Start(mq *mqtt.MQTT) error {
 	a.mq = mq
-	a.stopChans = make(map[string]chan bool)
+	a.publishChan = mq.PublishChan
+	a.thirdPartyChan = mq.ThirdPartyChan
 	// for each automation, subscribe to its Event
 	for _, auto := range a.automations {
 		if auto.Enabled {
-			sc := make(chan bool)
-
-			go a.waitForMqttEvent(sc, auto)
-
-			a.stopChans[auto.Name] = sc
+			if auto.hasCondition && auto.condition.Integration != "" {
+				// the Integration should have started first, so we can catch typos in the target now
+				if err := registry.Check(auto.condition.Integration, events.QueryDeviceType, auto.condition.Device); err != nil {
+					log.Printf("WARNING: Automation %s Condition - %s\n", auto.Name, err.Error())
+				}
+			}
+			a.startAutomation(auto)
 		} else {
 			log.Printf("INFO: Automation %s is not Enabled, will not run\n", auto.Name)
 		}
 	}
-	a.stopChans["mqttMonitor"] = make(chan bool)
-	go a.monitorMqtt(a.stopChans["mqttMonitor"])
+	a.stopper.Go("Automation Manager MQTT monitor", false, a.monitorMqtt)
+	return nil
 }
 
 // Stop terminates the Integration and all Goroutines it contains
 func (a *Automation) Stop() {
-	for _, ch := range a.stopChans {
-		ch <- true
-		// log.Printf("DEBUG: Asking Automation %s to stop\n", Name)
+	if a.stopper.Stop() {
+		log.Println("DEBUG: All Automations have stopped")
 	}
-	log.Println("DEBUG: All Automations should have stopped")
+}
+
+// startAutomation runs the Automation until it is stopped, if it panics the panic is logged with its name and
+// it is restarted (with the same stop channel) so that disabling and enabling it remain consistent
+func (a *Automation) startAutomation(auto automationT) {
+	a.stopper.Go("Automation "+auto.Name, true, func(stopChan chan bool) { a.waitForMqttEvent(stopChan, auto) })
 }
 
 func (a *Automation) testCondition(cond conditionT, eventPayload interface{}) bool {
 	var (
-		respChan   chan mqtt.GeneralMsgT
-		resp       mqtt.GeneralMsgT
-		respAsBool bool
-		respAsF64  float64
-		respAsI64  int64
-		respAsStr  string
+		respChan chan mqtt.GeneralMsgT
+		resp     mqtt.GeneralMsgT
 	)
-	if cond.QueryTopic == "" {
+	switch {
+	case cond.Integration != "":
+		// query the Integration directly via the event bus
+		evName := cond.Integration + "/" + events.QueryDeviceType + "/" + cond.Device + "/" + cond.QueryType
+		if cond.QueryType == events.FetchLastIndexed {
+			evName += "/" + strconv.Itoa(cond.Index)
+		}
+		replyChan := make(chan interface{}, 1) // buffered so that a late reply cannot block the Integration
+		events.Publish(events.EventT{Name: evName, Value: replyChan})
+		select {
+		case resp.Payload = <-replyChan:
+		case <-time.After(conditionQueryTimeout):
+			log.Printf("WARNING: Automation (Condition) - event bus query timed out for %s\n", evName)
+			return false
+		}
+		if resp.Payload == nil {
+			log.Printf("WARNING: Automation (Condition) - event bus query %s got no value\n", evName)
+			return false
+		}
+	case cond.QueryTopic == "":
 		// there's no new query for this condition, we use the payload from the originating event
 		resp.Payload = eventPayload
-	} else {
+	default:
 		if cond.ReplyTopic == "" {
 			respChan = a.mq.SubscribeToTopic(cond.QueryTopic)
 			defer a.mq.UnsubscribeFromTopic(cond.QueryTopic, respChan)
@@ -212,7 +502,7 @@ func (a *Automation) testCondition(cond conditionT, eventPayload interface{}) bo
 			respChan = a.mq.SubscribeToTopic(cond.ReplyTopic)
 			defer a.mq.UnsubscribeFromTopic(cond.ReplyTopic, respChan)
 		}
-		a.mq.ThirdPartyChan <- mqtt.GeneralMsgT{
+		a.thirdPartyChan <- mqtt.GeneralMsgT{
 			Topic:    cond.QueryTopic,
 			Qos:      0,
 			Retained: false,
@@ -221,29 +511,20 @@ func (a *Automation) testCondition(cond conditionT, eventPayload interface{}) bo
 
 		select {
 		case resp = <-respChan:
-		case <-time.After(conditionQueryTimeoutSecs * time.Second):
+		case <-time.After(conditionQueryTimeout):
 			log.Printf("WARNING: Automation (Condition) - MQTT query timed out on topic %s\n", cond.QueryTopic)
 			return false
 		}
 	}
 
+	if cond.expr != nil {
+		return evaluateExpr(cond, resp.Payload)
+	}
 	// we expect either a simple value, or a JSON response in which case a "Key" should have been specified
-	if cond.Key == "" {
-		switch cond.value.(type) {
-		case bool:
-			respAsBool = resp.Payload.(bool)
-		case float64:
-			respAsF64 = resp.Payload.(float64)
-		case int64:
-			respAsI64 = resp.Payload.(int64)
-		case string:
-			respAsStr = resp.Payload.(string)
-		}
-	} else {
-		jsonMap := make(map[string]interface{})
-		err := json.Unmarshal([]byte(resp.Payload.([]uint8)), &jsonMap)
-		if err != nil {
-			log.Printf("ERROR: Automation (Condition) - Could not understand JSON %s\n", resp.Payload.(string))
+	got := resp.Payload
+	if cond.Key != "" {
+		jsonMap, ok := payloadAsJSONMap(resp.Payload)
+		if !ok {
 			return false
 		}
 		v, found := jsonMap[cond.Key]
@@ -251,64 +532,181 @@ func (a *Automation) testCondition(cond conditionT, eventPayload interface{}) bo
 			// not an event we are interested in
 			return false
 		}
+		got = v
+	}
+	//log.Printf("DEBUG: Automation manager testCondition got %v\n", resp)
+	return compareValues(cond.is, got, cond.value)
+}
 
-		switch v := v.(type) {
-		case bool:
-			respAsBool = v
-		case float64:
-			respAsF64 = v
-		case int64:
-			respAsI64 = v
-		case string:
-			respAsStr = v
-		}
+// evaluateExpr evaluates the Condition's Expr, the variables are the top-level fields of a JSON object payload,
+// any other payload is the variable value (as a number if possible)
+func evaluateExpr(cond conditionT, payload interface{}) bool {
+	params, ok := exprParameters(payload)
+	if !ok {
+		log.Printf("WARNING: Automation (Condition) - unexpected %T payload for Expr\n", payload)
+		return false
+	}
+	result, err := cond.expr.Evaluate(params)
+	if err != nil {
+		log.Printf("WARNING: Automation (Condition) - could not evaluate Expr %s - %s\n", cond.Expr, err.Error())
+		return false
 	}
+	met, isBool := result.(bool)
+	if !isBool {
+		log.Printf("WARNING: Automation (Condition) - Expr %s did not give true or false\n", cond.Expr)
+	}
+	return met
+}
 
-	//log.Printf("DEBUG: Automation manager testCondition got %v\n", resp)
-	switch cond.value.(type) {
+// exprParameters returns the variables available to an Expr for the given payload
+func exprParameters(payload interface{}) (params map[string]interface{}, ok bool) {
+	if f, isNum := asFloat64(payload); isNum {
+		return map[string]interface{}{"value": f}, true
+	}
+	if b, isBool := asBool(payload); isBool {
+		return map[string]interface{}{"value": b}, true
+	}
+	raw, ok := mqtt.PayloadBytes(payload)
+	if !ok {
+		return nil, false
+	}
+	if err := json.Unmarshal(raw, &params); err == nil {
+		return params, true
+	}
+	return map[string]interface{}{"value": strings.TrimSpace(string(raw))}, true
+}
+
+// compareValues applies the operator is to the received value (on the left) and the Condition's Value,
+// the received value is converted to the type of the Condition's Value, numbers are compared as float64.
+func compareValues(is string, got, want interface{}) bool {
+	switch want := want.(type) {
 	case bool:
-		return respAsBool == cond.value.(bool)
-	case float64:
-		switch cond.is {
-		case "<":
-			return respAsF64 < cond.value.(float64)
-		case ">":
-			return respAsF64 > cond.value.(float64)
+		b, ok := asBool(got)
+		if !ok {
+			break
+		}
+		switch is {
 		case "=":
-			return respAsF64 == cond.value.(float64)
+			return b == want
 		case "!=":
-			return respAsF64 != cond.value.(float64)
+			return b != want
 		}
-	case int:
-		switch cond.is {
+	case float64, int64:
+		f, ok := asFloat64(got)
+		if !ok {
+			break
+		}
+		w, _ := asFloat64(want)
+		switch is {
 		case "<":
-			return int(respAsI64) < int(cond.value.(int64))
+			return f < w
 		case ">":
-			return int(respAsI64) > int(cond.value.(int64))
+			return f > w
+		case "<=":
+			return f <= w
+		case ">=":
+			return f >= w
 		case "=":
-			return int(respAsI64) == int(cond.value.(int64))
+			return f == w
 		case "!=":
-			return int(respAsI64) != int(cond.value.(int64))
+			return f != w
 		}
 	case string:
-		switch cond.is {
+		s, ok := asString(got)
+		if !ok {
+			break
+		}
+		switch is {
 		case "<":
-			return respAsStr < cond.value.(string)
+			return s < want
 		case ">":
-			return respAsStr > cond.value.(string)
+			return s > want
+		case "<=":
+			return s <= want
+		case ">=":
+			return s >= want
 		case "=":
-			return respAsStr == cond.value.(string)
+			return s == want
 		case "!=":
-			return respAsStr != cond.value.(string)
+			return s != want
 		}
 	default:
-		log.Printf("WARNING: Automation Manager testCondition got unexpected data type for: %v\n", resp)
+		log.Printf("WARNING: Automation Manager testCondition has unexpected Value type %T\n", want)
+		return false
 	}
+	log.Printf("WARNING: Automation Manager testCondition cannot compare %v (%T) %s %v\n", got, got, is, want)
 	return false
 }
 
+// asBool, asFloat64 and asString convert a received value, which may be raw MQTT bytes
+func asBool(v interface{}) (bool, bool) {
+	if b, ok := v.(bool); ok {
+		return b, true
+	}
+	if s, ok := asString(v); ok {
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		return b, err == nil
+	}
+	return false, false
+}
+
+func asFloat64(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	if s, ok := asString(v); ok {
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func asString(v interface{}) (string, bool) {
+	raw, ok := mqtt.PayloadBytes(v)
+	return string(raw), ok
+}
+
+// payloadAsJSONMap returns the payload as a decoded JSON object, it may have arrived as raw bytes,
+// a string, or have been decoded already.
+func payloadAsJSONMap(payload interface{}) (jsonMap map[string]interface{}, ok bool) {
+	if m, isMap := payload.(map[string]interface{}); isMap {
+		return m, true
+	}
+	raw, isBytes := mqtt.PayloadBytes(payload)
+	if !isBytes {
+		log.Printf("WARNING: Automation (Condition) - Expected JSON but got %T payload: %v\n", payload, payload)
+		return nil, false
+	}
+	if err := json.Unmarshal(raw, &jsonMap); err != nil {
+		log.Printf("ERROR: Automation (Condition) - Could not understand JSON %s\n", raw)
+		return nil, false
+	}
+	return jsonMap, true
+}
+
 func (a *Automation) waitForMqttEvent(stopChan chan bool, auto automationT) {
 	mqChan := a.mq.SubscribeToTopic(auto.EventTopic)
+	defer a.mq.UnsubscribeFromTopic(auto.EventTopic, mqChan)
+	// for sustained Conditions we wait for heldTimer to expire before running the Actions
+	var (
+		holding     bool
+		heldTimer   *time.Timer
+		heldPayload interface{} // the event which most recently met the Condition
+		heldChan    <-chan time.Time
+	)
+	bg := newBackground()
+	// cleanup is deferred so that nothing is left behind if we panic and are restarted
+	defer bg.stop()
+	defer func() {
+		if heldTimer != nil {
+			heldTimer.Stop()
+		}
+	}()
 	for {
 		select {
 		case <-stopChan:
@@ -316,79 +714,371 @@ func (a *Automation) waitForMqttEvent(stopChan chan bool, auto automationT) {
 			return
 		case eventMsg := <-mqChan:
 			// log.Printf("DEBUG: Automation Manager received Event %s\n", auto.Event.Name)
+			if !auto.activeAt(time.Now()) {
+				continue
+			}
 			doit := true
 			if auto.hasCondition {
 				doit = a.testCondition(auto.condition, eventMsg.Payload)
 			}
-			if doit {
-				log.Printf("DEBUG: Automation Manager will forward to %d actions\n", len(auto.sortedActionKeys))
-				for _, k := range auto.sortedActionKeys {
-					ac := auto.actions[k]
-					a.mq.ThirdPartyChan <- mqtt.GeneralMsgT{
-						Topic:    ac.Topic,
-						Qos:      0,
-						Retained: false,
-						Payload:  ac.Payload,
+			if auto.condition.ForSecs > 0 {
+				if doit {
+					heldPayload = eventMsg.Payload
+				}
+				switch {
+				case doit && !holding:
+					holding = true
+					heldTimer = time.NewTimer(time.Duration(auto.condition.ForSecs) * time.Second)
+					heldChan = heldTimer.C
+					log.Printf("DEBUG: Automation %s Condition met, waiting %ds\n", auto.Name, auto.condition.ForSecs)
+				case !doit && holding:
+					holding = false
+					if heldTimer.Stop() {
+						log.Printf("DEBUG: Automation %s Condition no longer met\n", auto.Name)
 					}
-					log.Printf("DEBUG: Automation Manager sent Event to %s with payload %s\n", ac.Topic, ac.Payload)
+					heldChan = nil
+				}
+				continue
+			}
+			a.runActions(bg, auto, doit, eventMsg.Payload)
+		case <-heldChan:
+			// the Condition has held for long enough, holding stays true so we only fire once per episode
+			heldChan = nil
+			if !auto.activeAt(time.Now()) {
+				log.Printf("DEBUG: Automation %s Condition held outside active window, not running\n", auto.Name)
+				continue
+			}
+			a.runActions(bg, auto, true, heldPayload)
+		}
+	}
+}
+
+// background runs an Automation's jittered Actions and verifications off its event loop, so that waiting for them
+// does not hold up its inbound MQTT queue.  They are abandoned when the Automation stops.
+type background struct {
+	cancel  chan struct{}
+	wg      sync.WaitGroup
+	rand    *rand.Rand    // for jitter, only used by one batch at a time
+	pending chan struct{} // closed once the latest batch of Actions has been sent, nil if there has been none
+}
+
+func newBackground() *background {
+	return &background{
+		cancel: make(chan struct{}),
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())), // so that jitter differs between runs
+	}
+}
+
+// run launches fn, which should return promptly once cancel is closed
+func (b *background) run(name string, fn func(cancel <-chan struct{})) {
+	b.wg.Add(1)
+	safego.Go(name, false, func() {
+		defer b.wg.Done()
+		fn(b.cancel)
+	})
+}
+
+// busy reports whether a batch of Actions is still waiting to be sent, it must only be called by the event loop
+func (b *background) busy() bool {
+	if b.pending == nil {
+		return false
+	}
+	select {
+	case <-b.pending:
+		return false
+	default:
+		return true
+	}
+}
+
+// queue runs a batch of Actions once any earlier batch has been sent, so that the batches for successive
+// events cannot overtake each other, it must only be called by the event loop
+func (b *background) queue(name string, batch func(cancel <-chan struct{})) {
+	previous, done := b.pending, make(chan struct{})
+	b.pending = done
+	b.run(name, func(cancel <-chan struct{}) {
+		defer close(done)
+		if previous != nil {
+			select {
+			case <-previous:
+			case <-cancel:
+				return
+			}
+		}
+		batch(cancel)
+	})
+}
+
+// stop cancels everything launched by run and waits for it to finish
+func (b *background) stop() {
+	close(b.cancel)
+	b.wg.Wait()
+}
+
+// runActions sends each of the Automation's Actions if doit is set, then announces completion.
+// eventPayload is the triggering event, used to select from any PayloadMaps.
+// From the first jittered Action onwards the Actions are sent in the background, in order, after those of
+// any earlier event.
+func (a *Automation) runActions(bg *background, auto automationT, doit bool, eventPayload interface{}) {
+	if len(auto.sortedActionKeys) == 0 {
+		log.Printf("INFO: Automation %s triggered, Condition met: %v\n", auto.Name, doit)
+	}
+	if !doit {
+		a.completed(auto, false, 0)
+		return
+	}
+	log.Printf("DEBUG: Automation Manager will forward to %d actions\n", len(auto.sortedActionKeys))
+	keys := auto.sortedActionKeys
+	first := len(keys)
+	for ix, k := range keys {
+		if auto.actions[k].JitterMs > 0 {
+			first = ix
+			break
+		}
+	}
+	if bg.busy() {
+		first = 0 // an earlier event's Actions are still waiting, ours must follow them
+	}
+	actionsRun, _ := a.sendActions(bg, auto, keys[:first], eventPayload)
+	if first == len(keys) {
+		a.completed(auto, true, actionsRun)
+		return
+	}
+	bg.queue("Automation "+auto.Name+" jittered Actions", func(cancel <-chan struct{}) {
+		n, sent := a.sendActions(bg, auto, keys[first:], eventPayload)
+		if sent {
+			a.completed(auto, true, actionsRun+n)
+		}
+	})
+}
+
+// sendActions sends the Actions with the given keys in order, waiting for any jitter first.
+// It returns how many were sent, and false if the Automation stopped while waiting.
+func (a *Automation) sendActions(bg *background, auto automationT, keys []string, eventPayload interface{}) (actionsRun int, sent bool) {
+	for _, k := range keys {
+		ac := auto.actions[k]
+		if ac.JitterMs > 0 {
+			select {
+			case <-bg.cancel:
+				log.Printf("INFO: Automation %s stopped, abandoning jittered Action %s\n", auto.Name, k)
+				return actionsRun, false
+			case <-time.After(time.Duration(bg.rand.Int63n(ac.JitterMs+1)) * time.Millisecond):
+			}
+		}
+		if a.sendAction(bg, auto, k, ac, eventPayload) {
+			actionsRun++
+		}
+	}
+	return actionsRun, true
+}
+
+// sendAction performs one Action, returning false if it was not sent
+func (a *Automation) sendAction(bg *background, auto automationT, k string, ac actionT, eventPayload interface{}) bool {
+	if ac.Automation != "" {
+		if auto.DryRun {
+			log.Printf("INFO: Automation %s (dry run) would set Enabled to %v for Automation %s\n", auto.Name, ac.Enabled, ac.Automation)
+			return false
+		}
+		// stopping an Automation waits for its Goroutine to finish, so this must not be done on our event loop
+		// in case the target is ourself, or is itself waiting to stop us
+		go a.setEnabled(ac.Automation, ac.Enabled)
+		return true
+	}
+	payload, ok := ac.payloadFor(eventPayload)
+	if !ok {
+		log.Printf("WARNING: Automation %s has no Payload for event %v, skipping Action %s\n", auto.Name, eventPayload, k)
+		return false
+	}
+	if auto.DryRun {
+		log.Printf("INFO: Automation %s (dry run) would send to %s with payload %s\n", auto.Name, ac.Topic, payload)
+		return false
+	}
+	if maintenance.Suppressed("automation", ac.Topic, payload) {
+		return false
+	}
+	if ac.VerifyTopic != "" {
+		// subscribe before sending, so that a prompt confirmation cannot be missed
+		verifyChan := a.mq.SubscribeToTopic(ac.VerifyTopic)
+		bg.run("Automation "+auto.Name+" verify", func(cancel <-chan struct{}) {
+			a.verifyAction(cancel, auto.Name, k, ac, verifyChan)
+		})
+	}
+	a.thirdPartyChan <- mqtt.GeneralMsgT{
+		Topic:    ac.Topic,
+		Qos:      0,
+		Retained: false,
+		Payload:  payload,
+	}
+	log.Printf("DEBUG: Automation Manager sent Event to %s with payload %s\n", ac.Topic, payload)
+	return true
+}
+
+// completed announces completion, unless this is a dry run so that no chained Automations are triggered
+func (a *Automation) completed(auto automationT, conditionMet bool, actionsRun int) {
+	if !auto.DryRun {
+		a.publishCompleted(auto.Name, conditionMet, actionsRun)
+	}
+}
+
+// verifyAction waits for the device to report the expected value on the Action's VerifyTopic,
+// if it does not do so within the VerifyTimeout a warning is logged and published.
+// Nothing is published if cancel is closed first, ie. the Automation was stopped.
+func (a *Automation) verifyAction(cancel <-chan struct{}, name, key string, ac actionT, verifyChan chan mqtt.GeneralMsgT) {
+	defer a.mq.UnsubscribeFromTopic(ac.VerifyTopic, verifyChan)
+	timeout := time.NewTimer(time.Duration(ac.VerifyTimeout) * time.Second)
+	defer timeout.Stop()
+	for {
+		select {
+		case <-cancel:
+			return
+		case msg := <-verifyChan:
+			if msg.Retained {
+				continue // a stale state from before the Action
+			}
+			got := msg.Payload
+			if ac.VerifyKey != "" {
+				jsonMap, ok := payloadAsJSONMap(msg.Payload)
+				if !ok {
+					continue
+				}
+				if got, ok = jsonMap[ac.VerifyKey]; !ok {
+					continue
+				}
+			}
+			if compareValues("=", got, ac.verifyValue) {
+				log.Printf("DEBUG: Automation %s Action %s verified on %s\n", name, key, ac.VerifyTopic)
+				return
+			}
+		case <-timeout.C:
+			log.Printf("WARNING: Automation %s Action %s was not verified on %s within %ds\n", name, key, ac.VerifyTopic, ac.VerifyTimeout)
+			resp, err := json.Marshal(verifyFailedT{Action: key, Topic: ac.Topic, VerifyTopic: ac.VerifyTopic, Expected: ac.verifyValue})
+			if err != nil {
+				log.Fatalln("ERROR: Automation manager fatal error marshalling data to JSON")
+			}
+			a.publishChan <- mqtt.AghastMsgT{
+				Subtopic: "/automation/" + name + "/verifyFailed",
+				Qos:      0,
+				Retained: false,
+				Payload:  resp,
+			}
+			return
+		}
+	}
+}
+
+// payloadFor returns the Action's PayloadMap entry for the event's value, or the static Payload if none matches.
+// ok is false if there is no match and no static Payload.
+func (ac actionT) payloadFor(eventPayload interface{}) (payload string, ok bool) {
+	if len(ac.PayloadMap) > 0 {
+		var value string
+		if ac.MapKey != "" {
+			if jsonMap, isMap := payloadAsJSONMap(eventPayload); isMap {
+				if v, found := jsonMap[ac.MapKey]; found {
+					value = fmt.Sprintf("%v", v)
 				}
 			}
+		} else if raw, isBytes := mqtt.PayloadBytes(eventPayload); isBytes {
+			value = strings.TrimSpace(string(raw))
+		}
+		if payload, found := ac.PayloadMap[value]; found {
+			return payload, true
 		}
 	}
+	return ac.Payload, ac.hasPayload
+}
+
+// publishCompleted announces that an Automation has finished handling an event, so that
+// other Automations may be chained from it.
+func (a *Automation) publishCompleted(name string, conditionMet bool, actionsRun int) {
+	resp, err := json.Marshal(completedT{ConditionMet: conditionMet, Actions: actionsRun})
+	if err != nil {
+		log.Fatalln("ERROR: Automation manager fatal error marshalling data to JSON")
+	}
+	a.publishChan <- mqtt.AghastMsgT{
+		Subtopic: "/automation/" + name + "/completed",
+		Qos:      0,
+		Retained: false,
+		Payload:  resp,
+	}
+}
+
+// setEnabled enables or disables the named Automation, starting or stopping it and rewriting
+// the Enabled line of its configuration file
+func (a *Automation) setEnabled(aname string, enabled bool) {
+	a.mutex.Lock()
+	ix, found := a.automationsByName[aname]
+	if !found {
+		a.mutex.Unlock()
+		log.Printf("WARNING: Automation Manager cannot change unknown Automation %s\n", aname)
+		return
+	}
+	if a.automations[ix].Enabled == enabled {
+		a.mutex.Unlock()
+		return
+	}
+	a.automations[ix].Enabled = enabled
+	auto := a.automations[ix]
+	a.mutex.Unlock()
+	err := config.ChangeEnabled(a.confDir+automationsSubDir+"/"+auto.confFilename, enabled)
+	if err != nil {
+		log.Printf("WARNING: Automation Manager could not rewrite Enabled line in config for: %s\n", auto.confFilename)
+	}
+	if enabled {
+		a.startAutomation(auto)
+	} else {
+		log.Printf("INFO: Automation Manager Stopping newly disabled Automation %s\n", aname)
+		a.stopper.StopOne("Automation " + aname)
+		log.Printf("INFO: Automation Manager Stopped newly disabled Automation %s\n", aname)
+	}
 }
 
 func (a *Automation) monitorMqtt(stopChan chan bool) {
 	reqChan := a.mq.SubscribeToTopic(mqttPrefix + "client/#")
+	defer a.mq.UnsubscribeFromTopic(mqttPrefix+"client/#", reqChan)
 	// topic format is aghast/automation/client/<action>
 	for {
 		select {
 		case <-stopChan:
 			return
 		case msg := <-reqChan:
-			payload := string(msg.Payload.([]uint8))
+			raw, ok := mqtt.PayloadBytes(msg.Payload)
+			if !ok {
+				log.Printf("WARNING: Automation Manager got unexpected %T payload on topic: %s\n", msg.Payload, msg.Topic)
+				continue
+			}
+			payload := string(raw)
 			topicSlice := strings.Split(msg.Topic, "/")
 			if len(topicSlice) < 4 {
-				log.Printf("WARNING: Automation Manager got invalid MQTT request on topic: %s\n", payload)
+				log.Printf("WARNING: Automation Manager got invalid MQTT request on topic: %s\n", msg.Topic)
 				continue
 			}
 			action := topicSlice[3]
 			switch action {
 			case "changeEnabled":
-				aname := string(msg.Payload.([]uint8))
+				aname := payload
 				// log.Printf("DEBUG: Automation manager got changeEnabled msg %v %s\n", msg, aname)
-				newEnabled := !a.automations[a.automationsByName[aname]].Enabled
-				a.automations[a.automationsByName[aname]].Enabled = newEnabled
-				err := config.ChangeEnabled(a.confDir+automationsSubDir+"/"+a.automations[a.automationsByName[aname]].confFilename, newEnabled)
-				if err != nil {
-					log.Printf("WARNING: Automation Manager could not rewrite Enabled line in config for: %s\n", a.automations[a.automationsByName[aname]].confFilename)
-				}
-				if newEnabled {
-					sc := make(chan bool)
-
-					go a.waitForMqttEvent(sc, a.automations[a.automationsByName[aname]])
-
-					a.stopChans[a.automations[a.automationsByName[aname]].Name] = sc
-				} else {
-					log.Printf("INFO: Automation Manager Stopping newly disabled Automation %s\n", aname)
-					a.stopChans[aname] <- true
-					delete(a.stopChans, aname)
-					log.Printf("INFO: Automation Manager Stopped newly disabled Automation %s\n", aname)
-				}
+				a.mutex.Lock()
+				ix, found := a.automationsByName[aname]
+				newEnabled := found && !a.automations[ix].Enabled
+				a.mutex.Unlock()
+				a.setEnabled(aname, newEnabled)
 			case "list":
 				type AutoListElementT struct {
 					Name, Description string
 					Enabled           bool
 				}
 				var autoList []AutoListElementT
+				a.mutex.Lock()
 				for _, au := range a.automations {
 					le := AutoListElementT{Name: au.Name, Description: au.Description, Enabled: au.Enabled}
 					autoList = append(autoList, le)
 				}
+				a.mutex.Unlock()
 				resp, err := json.Marshal(autoList)
 				if err != nil {
 					log.Fatalln("ERROR: Automation manager fatal error marshalling data to JSON")
 				}
-				a.mq.PublishChan <- mqtt.AghastMsgT{
+				a.publishChan <- mqtt.AghastMsgT{
 					Subtopic: "/automation/list",
 					Qos:      0,
 					Retained: false,
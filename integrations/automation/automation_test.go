@@ -0,0 +1,671 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package automation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/mqtt/mqtttest"
+)
+
+// mockMQTT stands in for the Broker, messages are injected with deliver
+type mockMQTT struct {
+	mutex sync.Mutex
+	subs  map[string]chan mqtt.GeneralMsgT
+}
+
+func newMockMQTT() *mockMQTT {
+	return &mockMQTT{subs: make(map[string]chan mqtt.GeneralMsgT)}
+}
+
+func (m *mockMQTT) SubscribeToTopic(topic string) chan mqtt.GeneralMsgT {
+	ch := make(chan mqtt.GeneralMsgT, 1)
+	m.mutex.Lock()
+	m.subs[topic] = ch
+	m.mutex.Unlock()
+	return ch
+}
+
+func (m *mockMQTT) UnsubscribeFromTopic(topic string, ch chan mqtt.GeneralMsgT) {
+	m.mutex.Lock()
+	delete(m.subs, topic)
+	m.mutex.Unlock()
+}
+
+func (m *mockMQTT) deliver(topic string, payload interface{}) {
+	m.mutex.Lock()
+	ch, found := m.subs[topic]
+	m.mutex.Unlock()
+	if found {
+		ch <- mqtt.GeneralMsgT{Topic: topic, Payload: payload}
+	}
+}
+
+func TestTestConditionEventPayload(t *testing.T) {
+	a := &Automation{}
+	tests := []struct {
+		name    string
+		key     string
+		is      string
+		value   interface{}
+		payload interface{}
+		want    bool
+	}{
+		{"bool =", "", "=", true, true, true},
+		{"bool !=", "", "!=", true, false, true},
+		{"bool from bytes", "", "=", false, []byte("false"), true},
+		{"bool unsupported operator", "", "<", true, true, false},
+		{"float <", "", "<", 20.0, 19.5, true},
+		{"float >", "", ">", 20.0, 19.5, false},
+		{"float <=", "", "<=", 20.0, 20.0, true},
+		{"float >=", "", ">=", 20.0, 19.9, false},
+		{"float =", "", "=", 20.5, 20.5, true},
+		{"float !=", "", "!=", 20.5, 20.5, false},
+		{"float from bytes", "", ">", 20.0, []byte("21.5"), true},
+		{"float from non-numeric bytes", "", ">", 20.0, []byte("warm"), false},
+		{"int64 =", "", "=", int64(3), int64(3), true},
+		{"int64 against float", "", "<", int64(3), 2.5, true},
+		{"int64 from bytes", "", "!=", int64(3), []byte("4"), true},
+		{"string =", "", "=", "ON", "ON", true},
+		{"string != from bytes", "", "!=", "ON", []byte("OFF"), true},
+		{"string <", "", "<", "b", "a", true},
+		{"string against number", "", "=", "ON", 1.0, false},
+		{"unknown operator", "", "~", 20.0, 20.0, false},
+		{"unsupported Value type", "", "=", []int{1}, 1.0, false},
+		{"JSON key bool", "occupancy", "=", true, []byte(`{"occupancy": true}`), true},
+		{"JSON key float", "temperature", "<", 18.0, []byte(`{"temperature": 17.2}`), true},
+		{"JSON key int64 Value", "linkquality", ">", int64(100), []byte(`{"linkquality": 120}`), true},
+		{"JSON key string", "state", "=", "ON", `{"state": "ON"}`, true},
+		{"JSON decoded map", "state", "=", "ON", map[string]interface{}{"state": "ON"}, true},
+		{"JSON missing key", "humidity", ">", 50.0, []byte(`{"temperature": 17.2}`), false},
+		{"JSON expected but not", "temperature", ">", 10.0, []byte("17.2"), false},
+		{"JSON key wrong type", "temperature", ">", 10.0, []byte(`{"temperature": "hot"}`), false},
+	}
+	for _, tt := range tests {
+		cond := conditionT{Key: tt.key, is: tt.is, value: tt.value}
+		if got := a.testCondition(cond, tt.payload); got != tt.want {
+			t.Errorf("%s: got %v, expected %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTestConditionMqttQuery(t *testing.T) {
+	mq := newMockMQTT()
+	a := &Automation{mq: mq, thirdPartyChan: make(chan mqtt.GeneralMsgT, 1)}
+	cond := conditionT{
+		QueryTopic: "aghast/mqttcache/get/sensor",
+		ReplyTopic: "aghast/mqttcache/sensor",
+		Key:        "temperature",
+		is:         ">",
+		value:      20.0,
+	}
+	go func() {
+		query := <-a.thirdPartyChan
+		if query.Topic != cond.QueryTopic {
+			t.Errorf("query sent to %s, expected %s", query.Topic, cond.QueryTopic)
+		}
+		mq.deliver(cond.ReplyTopic, []byte(`{"temperature": 21.5}`))
+	}()
+	if !a.testCondition(cond, nil) {
+		t.Error("condition not met by MQTT reply")
+	}
+	mq.mutex.Lock()
+	if len(mq.subs) != 0 {
+		t.Error("reply topic was not unsubscribed")
+	}
+	mq.mutex.Unlock()
+}
+
+func TestTestConditionTimeouts(t *testing.T) {
+	saved := conditionQueryTimeout
+	conditionQueryTimeout = 50 * time.Millisecond
+	defer func() { conditionQueryTimeout = saved }()
+
+	a := &Automation{mq: newMockMQTT(), thirdPartyChan: make(chan mqtt.GeneralMsgT, 1)}
+	// nobody replies to the MQTT query
+	if a.testCondition(conditionT{QueryTopic: "no/reply", is: "=", value: true}, nil) {
+		t.Error("MQTT query timeout did not return false")
+	}
+	// nobody answers the event bus query
+	if a.testCondition(conditionT{Integration: "Nobody", Device: "nothing", QueryType: "IsOn", is: "=", value: true}, nil) {
+		t.Error("event bus query timeout did not return false")
+	}
+}
+
+// writeConfig creates a configuration directory holding the given Automation files, the caller should remove it
+func writeConfig(t *testing.T, files map[string]string) (confDir string) {
+	confDir, err := ioutil.TempDir("", "automation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"secrets.toml", "constants.toml"} {
+		if err := ioutil.WriteFile(filepath.Join(confDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	autoDir := filepath.Join(confDir, automationsSubDir)
+	if err := os.Mkdir(autoDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(autoDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return confDir
+}
+
+func TestEnabledAction(t *testing.T) {
+	confDir := writeConfig(t, map[string]string{
+		"master.toml": `Name = "MasterOff"
+Description = "Disable the porch light"
+Enabled = true
+EventTopic = "test/master"
+[Action.1]
+  Automation = "Porch"
+  Enabled = false
+`,
+		"porch.toml": `Name = "Porch"
+Description = "Porch light on"
+Enabled = true
+EventTopic = "test/porch"
+[Action.1]
+  Topic = "porch/set"
+  Payload = "ON"
+`,
+	})
+	defer os.RemoveAll(confDir)
+	autoDir := filepath.Join(confDir, automationsSubDir)
+	a := &Automation{mq: newMockMQTT(), publishChan: make(chan mqtt.AghastMsgT, 1)}
+	if err := a.LoadConfig(confDir); err != nil {
+		t.Fatal(err)
+	}
+	master := a.automations[a.automationsByName["MasterOff"]]
+	if act := master.actions["1"]; act.Automation != "Porch" || act.Enabled {
+		t.Fatalf("Action loaded as %+v", act)
+	}
+	a.startAutomation(a.automations[a.automationsByName["Porch"]])
+	a.runActions(newBackground(), master, true, nil)
+	if !waitForEnabled(a, "Porch", false) {
+		t.Error("Porch Automation is still Enabled")
+	}
+	conf, _ := ioutil.ReadFile(filepath.Join(autoDir, "porch.toml"))
+	if !strings.Contains(string(conf), "Enabled = false") {
+		t.Error("Enabled line was not rewritten in the configuration file")
+	}
+	if !a.stopper.Stop() {
+		t.Error("Automations did not stop")
+	}
+}
+
+func TestPayloadFor(t *testing.T) {
+	modes := map[string]string{"movie": `{"brightness": 10}`, "read": `{"brightness": 80}`}
+	tests := []struct {
+		name   string
+		action actionT
+		event  interface{}
+		want   string
+		wantOK bool
+	}{
+		{"static", actionT{Payload: "ON", hasPayload: true}, []byte("anything"), "ON", true},
+		{"mapped", actionT{PayloadMap: modes}, []byte("movie"), `{"brightness": 10}`, true},
+		{"mapped string", actionT{PayloadMap: modes}, " read\n", `{"brightness": 80}`, true},
+		{"mapped key", actionT{PayloadMap: modes, MapKey: "mode"}, []byte(`{"mode": "read"}`), `{"brightness": 80}`, true},
+		{"fallback", actionT{PayloadMap: modes, Payload: "{}", hasPayload: true}, []byte("party"), "{}", true},
+		{"no match", actionT{PayloadMap: modes}, []byte("party"), "", false},
+		{"missing key", actionT{PayloadMap: modes, MapKey: "mode"}, []byte(`{"state": "ON"}`), "", false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.action.payloadFor(tt.event)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: got %q, %v, expected %q, %v", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestAutomationFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "automation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"heating", ".git"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"porch.toml", "porch.toml.bak", ".porch.toml.swp", ".hidden.toml",
+		"heating/morning.toml", "heating/morning.toml~", ".git/config.toml"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := automationFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, ",") != "heating/morning.toml,porch.toml" {
+		t.Errorf("Got %v", files)
+	}
+}
+
+func TestVerifyAction(t *testing.T) {
+	m := newMockMQTT()
+	a := &Automation{mq: m, publishChan: make(chan mqtt.AghastMsgT, 1)}
+	ac := actionT{Topic: "lamp/set", VerifyTopic: "lamp/state", VerifyKey: "state", VerifyTimeout: 1, verifyValue: "ON"}
+
+	// confirmed
+	done := make(chan bool)
+	verifyChan := m.SubscribeToTopic(ac.VerifyTopic)
+	go func() {
+		a.verifyAction(nil, "Lamp", "1", ac, verifyChan)
+		done <- true
+	}()
+	m.deliver(ac.VerifyTopic, []byte(`{"state": "OFF"}`))
+	m.deliver(ac.VerifyTopic, []byte(`{"state": "ON"}`))
+	<-done
+	select {
+	case msg := <-a.publishChan:
+		t.Errorf("Verified Action published %v", msg)
+	default:
+	}
+
+	// not confirmed
+	a.verifyAction(nil, "Lamp", "1", ac, m.SubscribeToTopic(ac.VerifyTopic))
+	select {
+	case msg := <-a.publishChan:
+		if msg.Subtopic != "/automation/Lamp/verifyFailed" {
+			t.Errorf("Unverified Action published to %s", msg.Subtopic)
+		}
+	default:
+		t.Error("Unverified Action did not publish a failure")
+	}
+
+	// stopped while waiting
+	bg := newBackground()
+	bg.run("verify", func(cancel <-chan struct{}) {
+		a.verifyAction(cancel, "Lamp", "1", ac, m.SubscribeToTopic(ac.VerifyTopic))
+	})
+	bg.stop() // waits for verifyAction to return
+	select {
+	case msg := <-a.publishChan:
+		t.Errorf("Action of a stopped Automation published %v", msg)
+	default:
+	}
+}
+
+func TestLoadInvalidActions(t *testing.T) {
+	confDir := writeConfig(t, map[string]string{
+		"lamp.toml": `Name = "Lamp"
+Description = "Some bad Actions"
+Enabled = true
+EventTopic = "test/lamp"
+[Action.1]
+  Payload = "ON"
+[Action.2]
+  Topic = 42
+  Payload = "ON"
+[Action.3]
+  Topic = "lamp/set"
+  Payload = 1
+[Action.4]
+  Topic = "lamp/set"
+  Payload = "ON"
+[Action.5]
+  Topic = "lamp/set"
+  Payload = "ON"
+  JitterMs = 1.5
+[Action.6]
+  Topic = "lamp/set"
+  [Action.6.PayloadMap]
+    movie = "DIM"
+    read = 100
+`,
+		"noactions.toml": `Name = "NoActions"
+Description = "Condition only"
+Enabled = true
+EventTopic = "test/nothing"
+[Condition]
+  Expr = "value > 20"
+`,
+		"badforsecs.toml": `Name = "BadForSecs"
+Description = "ForSecs is not a number"
+Enabled = true
+EventTopic = "test/bad"
+[Condition]
+  Expr = "value > 20"
+  ForSecs = "30"
+`,
+		"badactions.toml": `Name = "BadActions"
+Description = "Action is not a table"
+Enabled = true
+EventTopic = "test/bad"
+Action = "lamp/set"
+`,
+		"badjitter.toml": `Name = "BadJitter"
+Description = "JitterMs is not a number"
+Enabled = true
+EventTopic = "test/bad"
+JitterMs = "200"
+[Action.1]
+  Topic = "lamp/set"
+  Payload = "ON"
+`,
+	})
+	defer os.RemoveAll(confDir)
+	a := &Automation{}
+	if err := a.LoadConfig(confDir); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.automations) != 2 {
+		t.Fatalf("Loaded %d Automations, expected 2", len(a.automations))
+	}
+	if keys := a.automations[a.automationsByName["Lamp"]].sortedActionKeys; len(keys) != 1 || keys[0] != "4" {
+		t.Errorf("Loaded Actions %v, expected only 4", keys)
+	}
+	ix, found := a.automationsByName["NoActions"]
+	if !found || len(a.automations[ix].sortedActionKeys) != 0 || !a.automations[ix].hasCondition {
+		t.Error("Condition-only Automation not loaded correctly")
+	}
+}
+
+func TestEvaluateExpr(t *testing.T) {
+	tests := []struct {
+		expr    string
+		payload interface{}
+		want    bool
+	}{
+		{"temperature > 20 && humidity < 60", []byte(`{"temperature": 21.5, "humidity": 55}`), true},
+		{"temperature > 20 && humidity < 60", []byte(`{"temperature": 21.5, "humidity": 65}`), false},
+		{"state == 'ON' || brightness >= 50", []byte(`{"state": "OFF", "brightness": 80}`), true},
+		{"temperature > 20", []byte(`{"humidity": 55}`), false}, // missing field
+		{"value < 17.5", []byte(" 16\n"), true},
+		{"value == 'open'", "open", true},
+		{"value", true, true},
+		{"!value", []byte("false"), true},
+		{"temperature + 1", []byte(`{"temperature": 21.5}`), false}, // not boolean
+	}
+	for _, tt := range tests {
+		expr, err := govaluate.NewEvaluableExpression(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := evaluateExpr(conditionT{Expr: tt.expr, expr: expr}, tt.payload); got != tt.want {
+			t.Errorf("%s with %v got %v, expected %v", tt.expr, tt.payload, got, tt.want)
+		}
+	}
+}
+
+// waitForEnabled waits for the named Automation's Enabled setting to become enabled, returning false if it does not
+func waitForEnabled(a *Automation, name string, enabled bool) bool {
+	deadline := time.Now().Add(mqtttest.Timeout)
+	for time.Now().Before(deadline) {
+		a.mutex.Lock()
+		got := a.automations[a.automationsByName[name]].Enabled
+		a.mutex.Unlock()
+		if got == enabled {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestMutualDisable(t *testing.T) {
+	b := mqtttest.NewBroker(t)
+	mq := mqtttest.Connect(t, b)
+	confDir := mqtttest.ConfigDir(t, map[string]string{
+		"automation/day.toml": `Name = "Day"
+Description = "Daytime mode disables Night"
+Enabled = true
+EventTopic = "test/mode"
+[Action.1]
+  Automation = "Night"
+  Enabled = false
+`,
+		"automation/night.toml": `Name = "Night"
+Description = "Night mode disables Day"
+Enabled = true
+EventTopic = "test/mode"
+[Action.1]
+  Automation = "Day"
+  Enabled = false
+`,
+	})
+	a := &Automation{}
+	if err := a.LoadConfig(confDir); err != nil {
+		t.Fatal(err)
+	}
+	completed := map[string]<-chan mqtttest.Message{
+		"Day":   b.Watch("aghast/automation/Day/completed"),
+		"Night": b.Watch("aghast/automation/Night/completed"),
+	}
+	a.Start(mq)
+	b.WaitForSubscriber(t, "test/mode")
+
+	// each Automation stops the other, neither event loop may wait for the other to exit
+	b.Publish("test/mode", []byte("changed"), false)
+	for name, ch := range completed {
+		mqtttest.Receive(t, ch)
+		if !waitForEnabled(a, name, false) {
+			t.Errorf("%s is still Enabled", name)
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		a.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(mqtttest.Timeout):
+		t.Fatal("Automations did not stop")
+	}
+}
+
+func TestAutomationFires(t *testing.T) {
+	b := mqtttest.NewBroker(t)
+	mq := mqtttest.Connect(t, b)
+	confDir := mqtttest.ConfigDir(t, map[string]string{
+		"automation/porch.toml": `Name = "Porch"
+Description = "Porch light on when it is warm"
+Enabled = true
+EventTopic = "test/porch/sensor"
+[Condition]
+  Expr = "temperature > 20"
+[Action.1]
+  Topic = "porch/light/set"
+  Payload = "ON"
+`,
+	})
+	a := &Automation{}
+	if err := a.LoadConfig(confDir); err != nil {
+		t.Fatal(err)
+	}
+	actions := b.Watch("porch/light/set")
+	completed := b.Watch("aghast/automation/Porch/completed")
+	a.Start(mq)
+	defer a.Stop()
+	b.WaitForSubscriber(t, "test/porch/sensor")
+
+	b.Publish("test/porch/sensor", []byte(`{"temperature": 18}`), false)
+	if msg := mqtttest.Receive(t, completed); string(msg.Payload) != `{"ConditionMet":false,"Actions":0}` {
+		t.Errorf("completed %s after a cold event", msg.Payload)
+	}
+	b.Publish("test/porch/sensor", []byte(`{"temperature": 22}`), false)
+	if msg := mqtttest.Receive(t, actions); string(msg.Payload) != "ON" {
+		t.Errorf("Action sent %s, expected ON", msg.Payload)
+	}
+	if msg := mqtttest.Receive(t, completed); string(msg.Payload) != `{"ConditionMet":true,"Actions":1}` {
+		t.Errorf("completed %s after a warm event", msg.Payload)
+	}
+	select {
+	case msg := <-actions:
+		t.Errorf("unexpected Action %s", msg.Payload)
+	default:
+	}
+}
+
+func TestHeldConditionPayloadMap(t *testing.T) {
+	b := mqtttest.NewBroker(t)
+	mq := mqtttest.Connect(t, b)
+	confDir := mqtttest.ConfigDir(t, map[string]string{
+		"automation/lamp.toml": `Name = "Lamp"
+Description = "Lamp follows the mode once it has settled"
+Enabled = true
+EventTopic = "test/lounge/mode"
+[Condition]
+  Expr = "level > 5"
+  ForSecs = 1
+[Action.1]
+  Topic = "lounge/lamp/set"
+  MapKey = "mode"
+  [Action.1.PayloadMap]
+    movie = "DIM"
+    read = "BRIGHT"
+`,
+	})
+	a := &Automation{}
+	if err := a.LoadConfig(confDir); err != nil {
+		t.Fatal(err)
+	}
+	actions := b.Watch("lounge/lamp/set")
+	a.Start(mq)
+	defer a.Stop()
+	b.WaitForSubscriber(t, "test/lounge/mode")
+
+	// the Action must be selected by the latest event which met the Condition
+	b.Publish("test/lounge/mode", []byte(`{"level": 10, "mode": "movie"}`), false)
+	b.Publish("test/lounge/mode", []byte(`{"level": 10, "mode": "read"}`), false)
+	if msg := mqtttest.Receive(t, actions); string(msg.Payload) != "BRIGHT" {
+		t.Errorf("Action sent %s, expected BRIGHT", msg.Payload)
+	}
+}
+
+func TestJitterOffEventLoop(t *testing.T) {
+	b := mqtttest.NewBroker(t)
+	mq := mqtttest.Connect(t, b)
+	confDir := mqtttest.ConfigDir(t, map[string]string{
+		"automation/hall.toml": `Name = "Hall"
+Description = "Hall lamp on some time after dusk"
+Enabled = true
+EventTopic = "test/hall/dusk"
+[Condition]
+  Expr = "dark == 1"
+[Action.1]
+  Topic = "hall/lamp/set"
+  Payload = "ON"
+  JitterMs = 3600000
+`,
+	})
+	a := &Automation{}
+	if err := a.LoadConfig(confDir); err != nil {
+		t.Fatal(err)
+	}
+	completed := b.Watch("aghast/automation/Hall/completed")
+	a.Start(mq)
+	b.WaitForSubscriber(t, "test/hall/dusk")
+
+	// while the jittered Action waits, further events must still be handled
+	b.Publish("test/hall/dusk", []byte(`{"dark": 1}`), false)
+	b.Publish("test/hall/dusk", []byte(`{"dark": 0}`), false)
+	if msg := mqtttest.Receive(t, completed); string(msg.Payload) != `{"ConditionMet":false,"Actions":0}` {
+		t.Errorf("completed %s, expected the second event to be handled first", msg.Payload)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		a.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(mqtttest.Timeout):
+		t.Fatal("Stop waited for the jittered Action")
+	}
+}
+
+func TestJitteredBatchesInOrder(t *testing.T) {
+	b := mqtttest.NewBroker(t)
+	mq := mqtttest.Connect(t, b)
+	confDir := mqtttest.ConfigDir(t, map[string]string{
+		"automation/fan.toml": `Name = "Fan"
+Description = "Fan follows the switch, after a short random delay"
+Enabled = true
+EventTopic = "test/fan/switch"
+JitterMs = 100
+[Action.1]
+  Topic = "fan/set"
+  [Action.1.PayloadMap]
+    on = "ON"
+    off = "OFF"
+`,
+	})
+	a := &Automation{}
+	if err := a.LoadConfig(confDir); err != nil {
+		t.Fatal(err)
+	}
+	actions := b.Watch("fan/set")
+	a.Start(mq)
+	defer a.Stop()
+	b.WaitForSubscriber(t, "test/fan/switch")
+
+	// a later event's Actions may draw a shorter delay, but must not overtake the earlier ones
+	want := []string{"on", "off", "on", "off", "on", "off", "on", "off"}
+	for _, state := range want {
+		b.Publish("test/fan/switch", []byte(state), false)
+	}
+	for ix, state := range want {
+		if msg := mqtttest.Receive(t, actions); string(msg.Payload) != strings.ToUpper(state) {
+			t.Fatalf("Action %d sent %s, expected %s", ix, msg.Payload, strings.ToUpper(state))
+		}
+	}
+}
+
+func TestForSecs(t *testing.T) {
+	tests := []struct {
+		secs, readable interface{}
+		want           int64
+		valid          bool
+	}{
+		{nil, nil, 0, true},
+		{int64(30), nil, 30, true},
+		{nil, "5m", 300, true},
+		{int64(30), "PT1M", 60, true},
+		{"30", nil, 0, false},
+		{1.5, nil, 0, false},
+		{int64(-1), nil, 0, false},
+		{nil, int64(5), 0, false},
+		{nil, "soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := forSecs(tt.secs, tt.readable)
+		if (err == nil) != tt.valid || got != tt.want {
+			t.Errorf("forSecs(%v, %v) = %d, %v", tt.secs, tt.readable, got, err)
+		}
+	}
+}
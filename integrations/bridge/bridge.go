@@ -0,0 +1,272 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package bridge
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/logging"
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
+)
+
+const (
+	configFilename = "/bridge.toml"
+	// a mirrored message which has not come back within this time is no longer expected
+	echoWindow = 10 * time.Second
+)
+
+// Directions in which a Topic may be mirrored
+const (
+	outbound = "out"
+	inbound  = "in"
+	both     = "both"
+)
+
+// Bridge encapsulates the type of this Integration
+type Bridge struct {
+	Broker       string // the remote Broker
+	Port         int
+	Username     string
+	Password     string
+	ClientID     string
+	MqttVersion  int    // optional, 5 for MQTT v5
+	RemotePrefix string // optional, prepended to topics on the remote Broker
+	Topic        []topicT
+	mutex        sync.RWMutex
+	stopper      safego.Stopper
+	mq           *mqtt.MQTT
+	remote       *mqtt.MQTT
+	localEchoes  echoesT        // messages we sent to the local Broker
+	remoteEchoes echoesT        // messages we sent to the remote Broker
+	instance     string         // optional, see SetInstance
+	logger       logging.Logger // tags log lines with the instance, if any
+}
+
+type topicT struct {
+	Topic     string // local topic, which may include wildcards
+	Direction string // "out" to the remote Broker, "in" from it, or "both"
+}
+
+// echoesT remembers mirrored messages so that they are not mirrored back again when
+// the Topic is mirrored in both directions
+type echoesT struct {
+	mutex   sync.Mutex
+	pending map[string]echoT
+}
+
+type echoT struct {
+	count int
+	last  time.Time
+}
+
+// SetInstance allows Bridges to several remote Brokers, each instance loads its own configuration file,
+// eg. bridge-garage.toml
+func (b *Bridge) SetInstance(instance string) {
+	b.instance = instance
+	b.logger = logging.New(instance)
+}
+
+// LoadConfig func should simply load any config (TOML) files for this Integration
+func (b *Bridge) LoadConfig(confdir string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	confBytes, err := config.PreprocessTOML(confdir, config.InstanceConfigFilename(configFilename, b.instance))
+	if err != nil {
+		b.logger.Println("ERROR: Could not preprocess Bridge configuration ", err.Error())
+		return err
+	}
+	err = toml.Unmarshal(confBytes, b)
+	if err != nil {
+		b.logger.Println("ERROR: Could not load Bridge configuration ", err.Error())
+		return err
+	}
+	if b.Broker == "" || b.Port == 0 || b.ClientID == "" {
+		b.logger.Println("ERROR: Bridge - the remote Broker, Port, and ClientID must be configured")
+		return errors.New("Bridge configuration error")
+	}
+	for _, t := range b.Topic {
+		if t.Topic == "" || (t.Direction != outbound && t.Direction != inbound && t.Direction != both) {
+			b.logger.Printf("ERROR: Bridge - every Topic needs a Direction of \"out\", \"in\", or \"both\", check '%s'\n", t.Topic)
+			return errors.New("Bridge configuration error")
+		}
+	}
+	// only a Topic mirrored "both" ways has its echoes dropped, so no two Topics may together mirror a message
+	// back, nor may two "both" Topics mirror the same message twice
+	for ix, t := range b.Topic {
+		for _, other := range b.Topic[ix+1:] {
+			if (t.Direction == both || t.Direction != other.Direction) && filtersOverlap(t.Topic, other.Topic) {
+				b.logger.Printf("ERROR: Bridge - Topics '%s' and '%s' overlap, use a single Topic with Direction \"both\"\n", t.Topic, other.Topic)
+				return errors.New("Bridge configuration error")
+			}
+		}
+	}
+	b.logger.Printf("INFO: Bridge Integration has %d Topics configured for %s\n", len(b.Topic), b.Broker)
+	return nil
+}
+
+// Start func begins running the Integration GoRoutines and should return quickly
+func (b *Bridge) Start(mq *mqtt.MQTT) error {
+	remote, err := mqtt.Connect(b.Broker, b.Port, b.Username, b.Password, b.ClientID, b.MqttVersion)
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	b.mq = mq
+	b.remote = remote
+	b.mutex.Unlock()
+	for _, t := range b.Topic {
+		t := t
+		if t.Direction != inbound {
+			b.stopper.Go("Bridge out "+t.Topic, true, func(stopChan chan bool) { b.mirrorOut(t, stopChan) })
+		}
+		if t.Direction != outbound {
+			b.stopper.Go("Bridge in "+t.Topic, true, func(stopChan chan bool) { b.mirrorIn(t, stopChan) })
+		}
+	}
+	return nil
+}
+
+// Stop terminates the Integration and all Goroutines it contains
+func (b *Bridge) Stop() {
+	b.stopper.Stop()
+	b.mutex.Lock()
+	if b.remote != nil {
+		b.remote.Disconnect()
+		b.remote = nil
+	}
+	b.mutex.Unlock()
+}
+
+// mirrorOut sends messages from the local Broker to the remote one
+func (b *Bridge) mirrorOut(t topicT, stopChan chan bool) {
+	ch := b.mq.SubscribeToTopic(t.Topic)
+	defer b.mq.UnsubscribeFromTopic(t.Topic, ch)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg := <-ch:
+			payload, ok := mqtt.PayloadBytes(msg.Payload)
+			if !ok {
+				b.logger.Printf("WARNING: Bridge got unexpected %T payload on topic: %s\n", msg.Payload, msg.Topic)
+				continue
+			}
+			if b.localEchoes.isEcho(msg.Topic, payload) {
+				continue
+			}
+			remoteTopic := b.RemotePrefix + msg.Topic
+			if t.Direction == both {
+				b.remoteEchoes.expect(remoteTopic, payload)
+			}
+			b.remote.ThirdPartyChan <- mqtt.GeneralMsgT{Topic: remoteTopic, Qos: msg.Qos, Retained: msg.Retained, Payload: payload}
+		}
+	}
+}
+
+// mirrorIn sends messages from the remote Broker to the local one
+func (b *Bridge) mirrorIn(t topicT, stopChan chan bool) {
+	remoteFilter := b.RemotePrefix + t.Topic
+	ch := b.remote.SubscribeToTopic(remoteFilter)
+	defer b.remote.UnsubscribeFromTopic(remoteFilter, ch)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg := <-ch:
+			payload, ok := mqtt.PayloadBytes(msg.Payload)
+			if !ok {
+				b.logger.Printf("WARNING: Bridge got unexpected %T payload on remote topic: %s\n", msg.Payload, msg.Topic)
+				continue
+			}
+			if b.remoteEchoes.isEcho(msg.Topic, payload) {
+				continue
+			}
+			localTopic := strings.TrimPrefix(msg.Topic, b.RemotePrefix)
+			if t.Direction == both {
+				b.localEchoes.expect(localTopic, payload)
+			}
+			b.mq.ThirdPartyChan <- mqtt.GeneralMsgT{Topic: localTopic, Qos: msg.Qos, Retained: msg.Retained, Payload: payload}
+		}
+	}
+}
+
+// filtersOverlap reports whether some topic could match both of the MQTT topic filters
+func filtersOverlap(a, b string) bool {
+	aLevels, bLevels := strings.Split(a, "/"), strings.Split(b, "/")
+	for ix := 0; ix < len(aLevels) && ix < len(bLevels); ix++ {
+		if aLevels[ix] == "#" || bLevels[ix] == "#" {
+			return true
+		}
+		if aLevels[ix] != "+" && bLevels[ix] != "+" && aLevels[ix] != bLevels[ix] {
+			return false
+		}
+	}
+	if len(aLevels) == len(bLevels) {
+		return true
+	}
+	// "a/#" also matches "a"
+	longer := aLevels
+	if len(bLevels) > len(aLevels) {
+		longer = bLevels
+	}
+	shorter := len(aLevels) + len(bLevels) - len(longer)
+	return len(longer) == shorter+1 && longer[shorter] == "#"
+}
+
+// expect records that a message has been mirrored, so that it will come back
+func (e *echoesT) expect(topic string, payload []byte) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	now := time.Now()
+	if e.pending == nil {
+		e.pending = make(map[string]echoT)
+	}
+	for k, echo := range e.pending {
+		if now.Sub(echo.last) > echoWindow {
+			delete(e.pending, k)
+		}
+	}
+	key := topic + "\x00" + string(payload)
+	e.pending[key] = echoT{count: e.pending[key].count + 1, last: now}
+}
+
+// isEcho returns true, once for each time it was expected, if the message is one that we mirrored
+func (e *echoesT) isEcho(topic string, payload []byte) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	key := topic + "\x00" + string(payload)
+	echo, found := e.pending[key]
+	if !found || time.Since(echo.last) > echoWindow {
+		return false
+	}
+	if echo.count--; echo.count == 0 {
+		delete(e.pending, key)
+	} else {
+		e.pending[key] = echo
+	}
+	return true
+}
@@ -0,0 +1,139 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package bridge
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/SMerrony/aghast/mqtt/mqtttest"
+)
+
+func TestEchoes(t *testing.T) {
+	var e echoesT
+	if e.isEcho("aghast/lamp", []byte("ON")) {
+		t.Error("Unexpected message was an echo")
+	}
+	e.expect("aghast/lamp", []byte("ON"))
+	e.expect("aghast/lamp", []byte("ON"))
+	if e.isEcho("aghast/lamp", []byte("OFF")) || e.isEcho("aghast/other", []byte("ON")) {
+		t.Error("Different message was an echo")
+	}
+	for i := 0; i < 2; i++ {
+		if !e.isEcho("aghast/lamp", []byte("ON")) {
+			t.Errorf("Expected message %d was not an echo", i)
+		}
+	}
+	if e.isEcho("aghast/lamp", []byte("ON")) {
+		t.Error("Message was an echo more times than it was expected")
+	}
+}
+
+func TestFiltersOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"+/b", "a/+", true},
+		{"a/b", "a", false},
+		{"#", "x/y", true},
+	}
+	for _, tt := range tests {
+		if got := filtersOverlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("filtersOverlap(%s, %s) = %v, expected %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := filtersOverlap(tt.b, tt.a); got != tt.want {
+			t.Errorf("filtersOverlap(%s, %s) = %v, expected %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+// bridgeConfig returns a configuration directory for a Bridge to the remote Broker with the given Topics
+func bridgeConfig(t *testing.T, remote *mqtttest.Broker, topics string) string {
+	return mqtttest.ConfigDir(t, map[string]string{
+		"bridge.toml": fmt.Sprintf(`Broker = "127.0.0.1"
+Port = %d
+ClientID = "bridge"
+RemotePrefix = "remote/"
+%s`, remote.Port(), topics),
+	})
+}
+
+func TestLoadOverlappingTopics(t *testing.T) {
+	remote := mqtttest.NewBroker(t)
+	tests := []struct {
+		topics string
+		valid  bool
+	}{
+		{"[[Topic]]\nTopic = \"a/#\"\nDirection = \"out\"\n[[Topic]]\nTopic = \"a/b\"\nDirection = \"out\"\n", true},
+		{"[[Topic]]\nTopic = \"a/#\"\nDirection = \"out\"\n[[Topic]]\nTopic = \"b/#\"\nDirection = \"in\"\n", true},
+		{"[[Topic]]\nTopic = \"a/#\"\nDirection = \"out\"\n[[Topic]]\nTopic = \"a/#\"\nDirection = \"in\"\n", false},
+		{"[[Topic]]\nTopic = \"a/+\"\nDirection = \"both\"\n[[Topic]]\nTopic = \"a/b\"\nDirection = \"out\"\n", false},
+		{"[[Topic]]\nTopic = \"a/#\"\nDirection = \"both\"\n[[Topic]]\nTopic = \"a/b\"\nDirection = \"both\"\n", false},
+	}
+	for _, tt := range tests {
+		b := &Bridge{}
+		if err := b.LoadConfig(bridgeConfig(t, remote, tt.topics)); (err == nil) != tt.valid {
+			t.Errorf("LoadConfig returned %v for Topics:\n%s", err, tt.topics)
+		}
+	}
+}
+
+func TestMirrorBothWays(t *testing.T) {
+	local, remote := mqtttest.NewBroker(t), mqtttest.NewBroker(t)
+	mq := mqtttest.Connect(t, local)
+	b := &Bridge{}
+	if err := b.LoadConfig(bridgeConfig(t, remote, "[[Topic]]\nTopic = \"lamp/#\"\nDirection = \"both\"\n")); err != nil {
+		t.Fatal(err)
+	}
+	localMsgs, remoteMsgs := local.Watch("lamp/#"), remote.Watch("remote/lamp/#")
+	if err := b.Start(mq); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	local.WaitForSubscriber(t, "lamp/#")
+	remote.WaitForSubscriber(t, "remote/lamp/#")
+
+	local.Publish("lamp/hall", []byte("ON"), false)
+	mqtttest.Receive(t, localMsgs)
+	if msg := mqtttest.Receive(t, remoteMsgs); msg.Topic != "remote/lamp/hall" || string(msg.Payload) != "ON" {
+		t.Errorf("mirrored out %s %s", msg.Topic, msg.Payload)
+	}
+	remote.Publish("remote/lamp/porch", []byte("OFF"), false)
+	mqtttest.Receive(t, remoteMsgs)
+	if msg := mqtttest.Receive(t, localMsgs); msg.Topic != "lamp/porch" || string(msg.Payload) != "OFF" {
+		t.Errorf("mirrored in %s %s", msg.Topic, msg.Payload)
+	}
+	// neither message may be mirrored back again
+	select {
+	case msg := <-localMsgs:
+		t.Errorf("echo of %s %s on the local Broker", msg.Topic, msg.Payload)
+	case msg := <-remoteMsgs:
+		t.Errorf("echo of %s %s on the remote Broker", msg.Topic, msg.Payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -20,16 +20,18 @@
 package datalogger
 
 import (
+	"bufio"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"sync"
-	"time"
 
 	"github.com/SMerrony/aghast/config"
 	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
 	"github.com/pelletier/go-toml"
 )
 
@@ -40,18 +42,30 @@ const (
 
 // The DataLogger type encapsulates the Data Logging Integration
 type DataLogger struct {
-	mutex     sync.RWMutex
-	LogDir    string
-	Logger    []loggerT
-	stopChans []chan bool // used for stopping Goroutines
-	mq        *mqtt.MQTT
+	mutex   sync.RWMutex
+	LogDir  string
+	Logger  []loggerT
+	stopper safego.Stopper // used for stopping Goroutines
+	mq      *mqtt.MQTT
 }
 
 type loggerT struct {
 	LogFile    string
 	Topic      string
 	Key        string
+	Keys       []string // alternative to Key, all values are written to a single row
 	FlushEvery int
+	Format     string // "csv" (the default), or "jsonl" for one JSON object per line
+	Qos        *int   // optional, MQTT QoS of the subscription
+	qos        byte
+}
+
+// jsonLineT is the record written for each message by "jsonl" Loggers
+type jsonLineT struct {
+	Ts    string      `json:"ts"`
+	Topic string      `json:"topic"`
+	Key   string      `json:"key,omitempty"`
+	Value interface{} `json:"value"`
 }
 
 // LoadConfig loads and stores the configuration for this Integration
@@ -68,87 +82,156 @@ func (d *DataLogger) LoadConfig(confdir string) error {
 		d.mutex.Unlock()
 		return err
 	}
+	for ix, l := range d.Logger {
+		if l.Key != "" && len(l.Keys) > 0 {
+			log.Printf("ERROR: DataLogger - both Key and Keys specified for %s\n", l.LogFile)
+			d.mutex.Unlock()
+			return errors.New("DataLogger configuration error")
+		}
+		if l.Format != "" && l.Format != "csv" && l.Format != "jsonl" {
+			log.Printf("ERROR: DataLogger - unknown Format '%s' for %s\n", l.Format, l.LogFile)
+			d.mutex.Unlock()
+			return errors.New("DataLogger configuration error")
+		}
+		if d.Logger[ix].qos, err = mqtt.SubscribeQos(l.Qos); err != nil {
+			log.Printf("ERROR: DataLogger - %s for %s\n", err.Error(), l.LogFile)
+			d.mutex.Unlock()
+			return err
+		}
+	}
 	log.Printf("INFO: DataLogger has %d loggers %v\n", len(d.Logger), d.Logger)
 	d.mutex.Unlock()
 	return nil
 }
 
 // Start launches the Integration, LoadConfig() should have been called beforehand.
-func (d *DataLogger) Start(mq *mqtt.MQTT) {
+func (d *DataLogger) Start(mq *mqtt.MQTT) error {
 	d.mq = mq
 	for _, l := range d.Logger {
-		go d.logger(l)
+		l := l
+		d.stopper.Go("DataLogger "+l.LogFile, false, func(stopChan chan bool) { d.logger(l, stopChan) })
 	}
+	return nil
 }
 
 // Stop terminates the Integration and all Goroutines it contains
 func (d *DataLogger) Stop() {
-	for _, ch := range d.stopChans {
-		ch <- true
+	if d.stopper.Stop() {
+		log.Println("DEBUG: DataLogger - All Goroutines have stopped")
 	}
-	log.Println("DEBUG: DataLogger - All Goroutines should have stopped")
 }
 
-func (d *DataLogger) addStopChan() chan bool {
-	newChan := make(chan bool)
-	d.mutex.Lock()
-	d.stopChans = append(d.stopChans, newChan)
-	d.mutex.Unlock()
-	return newChan
-}
-
-func (d *DataLogger) logger(l loggerT) {
+func (d *DataLogger) logger(l loggerT, stopChan chan bool) {
 	d.mutex.RLock()
 	log.Printf("INFO: DataLogger starting to log to %s\n", l.LogFile)
 	file, err := os.OpenFile(d.LogDir+"/"+l.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		log.Printf("WARNING: DataLogger failed to open/create CSV log - %v\n", err)
+		log.Printf("WARNING: DataLogger failed to open/create log - %v\n", err)
 		d.mutex.RUnlock()
 		return
 	}
+	jsonl := l.Format == "jsonl"
 	csvWriter := csv.NewWriter(file)
+	jsonWriter := bufio.NewWriter(file)
+	flush := func() {
+		csvWriter.Flush()
+		jsonWriter.Flush()
+	}
 
-	ch := d.mq.SubscribeToTopic(l.Topic)
+	ch := d.mq.SubscribeToTopicQos(l.Topic, l.qos)
 	defer d.mq.UnsubscribeFromTopic(l.Topic, ch)
 
 	d.mutex.RUnlock()
 	unflushed := 0
-	stopChan := d.addStopChan()
 
 	for {
 		select {
 		case <-stopChan:
-			csvWriter.Flush()
+			flush()
 			return
 		case ev := <-ch:
-			ts := time.Now().Format(time.RFC3339)
-			record := make([]string, 5)
-			record[0] = ts
-			record[1] = ev.Topic
-			if l.Key == "" {
-				record[3] = fmt.Sprintf("%v", ev.Payload)
-			} else {
-				record[2] = l.Key
-				jsonMap := make(map[string]interface{})
-				err := json.Unmarshal([]byte(ev.Payload.([]uint8)), &jsonMap)
+			ts := config.LogTimestamp(config.LogTime())
+			var record []string
+			var value interface{} // for "jsonl"
+			switch {
+			case len(l.Keys) > 0:
+				// one row with a column per key
+				jsonMap, err := unmarshalPayload(ev)
 				if err != nil {
-					log.Printf("ERROR: DataLogger - Could not understand JSON %s\n", ev.Payload.(string))
-					return
+					continue
+				}
+				record = make([]string, 2, 2+len(l.Keys))
+				values := make(map[string]interface{}, len(l.Keys))
+				for _, k := range l.Keys {
+					v, found := jsonMap[k]
+					if !found {
+						log.Printf("WARNING: DataLogger - Could not find Key %s in JSON %s\n", k, ev.Payload)
+						record = append(record, "")
+						continue
+					}
+					record = append(record, fmt.Sprintf("%v", v))
+					values[k] = v
+				}
+				value = values
+			case l.Key != "":
+				jsonMap, err := unmarshalPayload(ev)
+				if err != nil {
+					continue
 				}
 				v, found := jsonMap[l.Key]
 				if !found {
-					log.Printf("ERROR: DataLogger - Could find Key in JSON %s\n", ev.Payload.(string))
-					return
+					log.Printf("ERROR: DataLogger - Could find Key in JSON %s\n", ev.Payload)
+					continue
 				}
+				record = make([]string, 5)
+				record[2] = l.Key
 				record[3] = fmt.Sprintf("%v", v)
+				value = v
+			default:
+				record = make([]string, 5)
+				if raw, ok := mqtt.PayloadBytes(ev.Payload); ok {
+					record[3] = string(raw)
+					value = record[3]
+					if json.Valid(raw) {
+						value = json.RawMessage(raw) // nested values are kept as they are
+					}
+				} else {
+					record[3] = fmt.Sprintf("%v", ev.Payload)
+					value = record[3]
+				}
+			}
+			if jsonl {
+				line, err := json.Marshal(jsonLineT{Ts: ts, Topic: ev.Topic, Key: l.Key, Value: value})
+				if err != nil {
+					log.Printf("WARNING: DataLogger - Could not encode JSON for %s - %v\n", ev.Topic, err)
+					continue
+				}
+				jsonWriter.Write(append(line, '\n'))
+			} else {
+				record[0] = ts
+				record[1] = ev.Topic
+				csvWriter.Write(record)
 			}
-			csvWriter.Write(record)
 			d.mutex.RLock()
 			if unflushed++; unflushed == l.FlushEvery {
-				csvWriter.Flush()
+				flush()
 				unflushed = 0
 			}
 			d.mutex.RUnlock()
 		}
 	}
 }
+
+func unmarshalPayload(ev mqtt.GeneralMsgT) (map[string]interface{}, error) {
+	jsonMap := make(map[string]interface{})
+	raw, ok := mqtt.PayloadBytes(ev.Payload)
+	if !ok {
+		log.Printf("WARNING: DataLogger - Ignoring unexpected %T payload on %s\n", ev.Payload, ev.Topic)
+		return jsonMap, fmt.Errorf("unexpected payload type %T", ev.Payload)
+	}
+	err := json.Unmarshal(raw, &jsonMap)
+	if err != nil {
+		log.Printf("ERROR: DataLogger - Could not understand JSON %s\n", raw)
+	}
+	return jsonMap, err
+}
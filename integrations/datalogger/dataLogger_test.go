@@ -0,0 +1,93 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package datalogger
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SMerrony/aghast/mqtt/mqtttest"
+)
+
+// waitForLines polls the log file until it holds n lines, failing the test if it does not in time
+func waitForLines(t *testing.T, path string, n int) string {
+	t.Helper()
+	deadline := time.Now().Add(mqtttest.Timeout)
+	for {
+		content, err := ioutil.ReadFile(path)
+		if err == nil && strings.Count(string(content), "\n") >= n {
+			return string(content)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %q, expected %d lines", path, content, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLoggers(t *testing.T) {
+	b := mqtttest.NewBroker(t)
+	mq := mqtttest.Connect(t, b)
+	logDir := t.TempDir()
+	confDir := mqtttest.ConfigDir(t, map[string]string{
+		"datalogger.toml": `LogDir = "` + logDir + `"
+[[Logger]]
+  LogFile = "climate.csv"
+  Topic = "test/climate"
+  Keys = ["temperature", "humidity"]
+  FlushEvery = 1
+[[Logger]]
+  LogFile = "lounge.jsonl"
+  Topic = "test/lounge"
+  Key = "humidity"
+  Format = "jsonl"
+  FlushEvery = 1
+`,
+	})
+	d := &DataLogger{}
+	if err := d.LoadConfig(confDir); err != nil {
+		t.Fatal(err)
+	}
+	d.Start(mq)
+	defer d.Stop()
+	b.WaitForSubscriber(t, "test/climate")
+	b.WaitForSubscriber(t, "test/lounge")
+
+	b.Publish("test/climate", []byte(`{"temperature": 21.5, "humidity": 55}`), false)
+	b.Publish("test/lounge", []byte(`{"temperature": 19, "humidity": 60}`), false)
+
+	rows, err := csv.NewReader(strings.NewReader(waitForLines(t, logDir+"/climate.csv", 1))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := time.Parse(time.RFC3339, rows[0][0]); err != nil {
+		t.Errorf("CSV timestamp %s - %v", rows[0][0], err)
+	}
+	if got := strings.Join(rows[0][1:], ","); got != "test/climate,21.5,55" {
+		t.Errorf("CSV row %s, expected test/climate,21.5,55", got)
+	}
+	line := waitForLines(t, logDir+"/lounge.jsonl", 1)
+	if !strings.HasSuffix(line, `"topic":"test/lounge","key":"humidity","value":60}`+"\n") {
+		t.Errorf("JSON line %s", line)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hadiscovery
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/mqtt"
+)
+
+const (
+	configFilename         = "/hadiscovery.toml"
+	defaultDiscoveryPrefix = "homeassistant"
+	nodeID                 = "aghast"
+)
+
+// HaDiscovery encapsulates the type of this Integration
+type HaDiscovery struct {
+	DiscoveryPrefix string
+	Entity          []entityT
+	mutex           sync.RWMutex
+	mq              *mqtt.MQTT
+}
+
+type entityT struct {
+	Component         string // One of "sensor", "binary_sensor", or "switch"
+	Name              string
+	UniqueID          string
+	StateTopic        string
+	CommandTopic      string
+	ValueTemplate     string
+	UnitOfMeasurement string
+	DeviceClass       string
+	PayloadOn         string
+	PayloadOff        string
+}
+
+// discoveryT is the Home Assistant MQTT discovery message, field names are set by HA
+type discoveryT struct {
+	Name              string  `json:"name"`
+	UniqueID          string  `json:"unique_id"`
+	StateTopic        string  `json:"state_topic,omitempty"`
+	CommandTopic      string  `json:"command_topic,omitempty"`
+	ValueTemplate     string  `json:"value_template,omitempty"`
+	UnitOfMeasurement string  `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string  `json:"device_class,omitempty"`
+	PayloadOn         string  `json:"payload_on,omitempty"`
+	PayloadOff        string  `json:"payload_off,omitempty"`
+	Device            deviceT `json:"device"`
+}
+
+type deviceT struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+// LoadConfig func should simply load any config (TOML) files for this Integration
+func (h *HaDiscovery) LoadConfig(confdir string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	if err != nil {
+		log.Printf("ERROR: Could not read HaDiscovery config due to %s\n", err.Error())
+		return err
+	}
+	err = toml.Unmarshal(confBytes, h)
+	if err != nil {
+		log.Printf("ERROR: Could not load HaDiscovery config due to %s\n", err.Error())
+		return err
+	}
+	if h.DiscoveryPrefix == "" {
+		h.DiscoveryPrefix = defaultDiscoveryPrefix
+	}
+	for _, e := range h.Entity {
+		switch e.Component {
+		case "sensor", "binary_sensor":
+			if e.StateTopic == "" {
+				log.Printf("ERROR: HaDiscovery - no StateTopic for %s\n", e.Name)
+				return errors.New("HaDiscovery configuration error")
+			}
+		case "switch":
+			if e.CommandTopic == "" {
+				log.Printf("ERROR: HaDiscovery - no CommandTopic for %s\n", e.Name)
+				return errors.New("HaDiscovery configuration error")
+			}
+		default:
+			log.Printf("ERROR: HaDiscovery - unknown Component '%s' for %s\n", e.Component, e.Name)
+			return errors.New("HaDiscovery configuration error")
+		}
+		if e.UniqueID == "" {
+			log.Printf("ERROR: HaDiscovery - no UniqueID for %s\n", e.Name)
+			return errors.New("HaDiscovery configuration error")
+		}
+	}
+	log.Printf("INFO: HaDiscovery Integration has %d Entities configured\n", len(h.Entity))
+	return nil
+}
+
+// Start func begins running the Integration GoRoutines and should return quickly
+func (h *HaDiscovery) Start(mq *mqtt.MQTT) error {
+	h.mq = mq
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for _, e := range h.Entity {
+		payload, err := json.Marshal(discoveryT{
+			Name:              e.Name,
+			UniqueID:          e.UniqueID,
+			StateTopic:        e.StateTopic,
+			CommandTopic:      e.CommandTopic,
+			ValueTemplate:     e.ValueTemplate,
+			UnitOfMeasurement: e.UnitOfMeasurement,
+			DeviceClass:       e.DeviceClass,
+			PayloadOn:         e.PayloadOn,
+			PayloadOff:        e.PayloadOff,
+			Device:            deviceT{Identifiers: []string{nodeID}, Name: "AGHAST", Manufacturer: "AGHAST"},
+		})
+		if err != nil {
+			log.Printf("ERROR: HaDiscovery could not marshal discovery info for %s - %s\n", e.Name, err.Error())
+			return err
+		}
+		// Home Assistant expects discovery messages to be retained
+		h.mq.ThirdPartyChan <- mqtt.GeneralMsgT{
+			Topic:    h.DiscoveryPrefix + "/" + e.Component + "/" + nodeID + "/" + e.UniqueID + "/config",
+			Qos:      0,
+			Retained: true,
+			Payload:  payload,
+		}
+	}
+	log.Printf("INFO: HaDiscovery has advertised %d Entities\n", len(h.Entity))
+	return nil
+}
+
+// Stop is required to satisfy the Integration interface, there are no Goroutines to stop.
+func (h *HaDiscovery) Stop() {
+}
@@ -0,0 +1,112 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package hadiscovery
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/SMerrony/aghast/mqtt/mqtttest"
+)
+
+func TestDiscovery(t *testing.T) {
+	b := mqtttest.NewBroker(t)
+	mq := mqtttest.Connect(t, b)
+	confDir := mqtttest.ConfigDir(t, map[string]string{
+		"hadiscovery.toml": `[[Entity]]
+  Component = "sensor"
+  Name = "Lounge Temperature"
+  UniqueID = "lounge_temp"
+  StateTopic = "aghast/localsensors/lounge/temp"
+  UnitOfMeasurement = "°C"
+  DeviceClass = "temperature"
+
+[[Entity]]
+  Component = "binary_sensor"
+  Name = "Back Door"
+  UniqueID = "back_door"
+  StateTopic = "zigbee2mqtt/Back_Door"
+  ValueTemplate = "{{ value_json.contact }}"
+
+[[Entity]]
+  Component = "switch"
+  Name = "Porch Light"
+  UniqueID = "porch_light"
+  CommandTopic = "aghast/virtualswitch/porch/set"
+  PayloadOn = "on"
+  PayloadOff = "off"
+`,
+	})
+	h := &HaDiscovery{}
+	if err := h.LoadConfig(confDir); err != nil {
+		t.Fatal(err)
+	}
+	msgs := b.Watch("homeassistant/#")
+	if err := h.Start(mq); err != nil {
+		t.Fatal(err)
+	}
+	device := map[string]interface{}{"identifiers": []interface{}{"aghast"}, "name": "AGHAST", "manufacturer": "AGHAST"}
+	want := []struct {
+		topic   string
+		payload map[string]interface{}
+	}{
+		{"homeassistant/sensor/aghast/lounge_temp/config", map[string]interface{}{
+			"name": "Lounge Temperature", "unique_id": "lounge_temp", "state_topic": "aghast/localsensors/lounge/temp",
+			"unit_of_measurement": "°C", "device_class": "temperature", "device": device}},
+		{"homeassistant/binary_sensor/aghast/back_door/config", map[string]interface{}{
+			"name": "Back Door", "unique_id": "back_door", "state_topic": "zigbee2mqtt/Back_Door",
+			"value_template": "{{ value_json.contact }}", "device": device}},
+		{"homeassistant/switch/aghast/porch_light/config", map[string]interface{}{
+			"name": "Porch Light", "unique_id": "porch_light", "command_topic": "aghast/virtualswitch/porch/set",
+			"payload_on": "on", "payload_off": "off", "device": device}},
+	}
+	for _, w := range want {
+		msg := mqtttest.Receive(t, msgs)
+		if msg.Topic != w.topic || !msg.Retained {
+			t.Errorf("discovery sent to %s (retained %v), expected retained on %s", msg.Topic, msg.Retained, w.topic)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal(msg.Payload, &got); err != nil {
+			t.Fatalf("discovery payload %s is not JSON - %v", msg.Payload, err)
+		}
+		if !reflect.DeepEqual(got, w.payload) {
+			t.Errorf("discovery payload for %s is %s", w.topic, msg.Payload)
+		}
+	}
+}
+
+func TestLoadInvalidEntities(t *testing.T) {
+	for _, entity := range []string{
+		`Component = "light"` + "\nName = \"Lamp\"\nUniqueID = \"lamp\"\nCommandTopic = \"lamp/set\"",
+		`Component = "sensor"` + "\nName = \"Temp\"\nUniqueID = \"temp\"",
+		`Component = "switch"` + "\nName = \"Fan\"\nUniqueID = \"fan\"",
+		`Component = "sensor"` + "\nName = \"Temp\"\nStateTopic = \"temp\"",
+	} {
+		h := &HaDiscovery{}
+		if err := h.LoadConfig(mqtttest.ConfigDir(t, map[string]string{"hadiscovery.toml": "[[Entity]]\n" + entity})); err == nil {
+			t.Errorf("invalid Entity was loaded:\n%s", entity)
+		}
+	}
+	h := &HaDiscovery{}
+	if err := h.LoadConfig(mqtttest.ConfigDir(t, nil)); err == nil {
+		t.Error("LoadConfig did not return an error for a missing configuration file")
+	}
+}
@@ -20,14 +20,19 @@
 package hostchecker
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"net"
+	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/logging"
 	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
 	"github.com/pelletier/go-toml"
 )
 
@@ -37,16 +42,23 @@ type HostChecker struct {
 	mutex          sync.RWMutex
 	Checker        []hostCheckerT
 	checkersByName map[string]int
-	stopChans      []chan bool // used for stopping Goroutines
+	stopper        safego.Stopper // used for stopping Goroutines
 	mq             *mqtt.MQTT
+	availability   *mqtt.Availability
+	instance       string         // optional, see SetInstance
+	logger         logging.Logger // tags log lines with the instance, if any
 }
 
 type hostCheckerT struct {
 	Name         string
 	Host         string
 	Label        string
-	Period       int
+	Period       int    // seconds between checks
+	Every        string // optional readable alternative to Period, eg. "5m"
 	Port         int
+	Method       string // One of "tcp" (the default), "http", or "https"
+	Path         string // for http(s) checks
+	ExpectStatus int    // for http(s) checks, defaults to 200
 	alive        bool
 	firstCheck   bool
 	responseTime time.Duration
@@ -60,69 +72,109 @@ const (
 )
 
 const (
-	netType = "tcp"
-	timeout = time.Second * 2
+	netType       = "tcp"
+	timeout       = time.Second * 2
+	defaultStatus = http.StatusOK
 )
 
+// SetInstance allows several HostCheckers, each instance loads its own configuration file, eg. hostchecker-garage.toml
+func (h *HostChecker) SetInstance(instance string) {
+	h.instance = instance
+	h.logger = logging.New(instance)
+}
+
 // LoadConfig func should simply load any config (TOML) files for this Integration
 func (h *HostChecker) LoadConfig(confdir string) error {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
-	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	confBytes, err := config.PreprocessTOML(confdir, config.InstanceConfigFilename(configFilename, h.instance))
 	if err != nil {
-		log.Fatalf("ERROR: Could not read HostChecker config due to %s\n", err.Error())
+		h.logger.Printf("ERROR: Could not read HostChecker config due to %s\n", err.Error())
+		return err
 	}
 	err = toml.Unmarshal(confBytes, h)
 	if err != nil {
-		log.Fatalf("ERROR: Could not load HostChecker config due to %s\n", err.Error())
+		h.logger.Printf("ERROR: Could not load HostChecker config due to %s\n", err.Error())
+		return err
 	}
 	h.checkersByName = make(map[string]int)
 	for i, c := range h.Checker {
+		switch c.Method {
+		case "":
+			h.Checker[i].Method = netType
+		case netType, "http", "https":
+		default:
+			h.logger.Printf("ERROR: HostChecker - unknown Method '%s' for %s\n", c.Method, c.Name)
+			return errors.New("HostChecker configuration error")
+		}
+		if h.Checker[i].Period, err = config.DurationSecs(c.Every, c.Period); err != nil {
+			h.logger.Printf("ERROR: HostChecker - %s for %s\n", err.Error(), c.Name)
+			return errors.New("HostChecker configuration error")
+		}
+		if h.Checker[i].ExpectStatus == 0 {
+			h.Checker[i].ExpectStatus = defaultStatus
+		}
 		h.checkersByName[c.Name] = i
 	}
 	if len(h.Checker) > 0 {
-		log.Printf("INFO: HostChecker Integration has %d checkers configured\n", len(h.Checker))
+		h.logger.Printf("INFO: HostChecker Integration has %d checkers configured\n", len(h.Checker))
 	}
 	return nil
 }
 
 // Start launches the Integration, LoadConfig() should have been called beforehand.
-func (h *HostChecker) Start(mq *mqtt.MQTT) {
+func (h *HostChecker) Start(mq *mqtt.MQTT) error {
 	h.mutex.Lock()
 	h.mqttChan = mq.PublishChan
 	h.mq = mq
+	h.availability = mqtt.NewAvailability(mqttPrefix)
 	h.mutex.Unlock()
 	for _, dev := range h.Checker {
-		go h.runChecker(dev)
+		dev := dev
+		h.stopper.Go("HostChecker "+dev.Name, true, func(stopChan chan bool) { h.runChecker(dev, stopChan) })
 	}
-	go h.monitorQueries()
-}
-
-func (h *HostChecker) addStopChan() chan bool {
-	newChan := make(chan bool)
-	h.mutex.Lock()
-	h.stopChans = append(h.stopChans, newChan)
-	h.mutex.Unlock()
-	return newChan
+	h.stopper.Go("HostChecker query monitor", true, h.monitorQueries)
+	return nil
 }
 
 // Stop terminates the Integration and all Goroutines it contains
 func (h *HostChecker) Stop() {
-	for _, ch := range h.stopChans {
-		ch <- true
+	h.stopper.Stop()
+}
+
+// check tests the host, returning an error if it is unavailable, and the time taken
+func check(hc hostCheckerT) (latency time.Duration, err error) {
+	dest := net.JoinHostPort(hc.Host, strconv.Itoa(hc.Port))
+	before := time.Now()
+	switch hc.Method {
+	case "http", "https":
+		client := http.Client{Timeout: timeout}
+		resp, err := client.Get(hc.Method + "://" + dest + "/" + strings.TrimPrefix(hc.Path, "/"))
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != hc.ExpectStatus {
+			return 0, fmt.Errorf("unexpected HTTP status %d", resp.StatusCode)
+		}
+	default:
+		conn, err := net.DialTimeout(netType, dest, timeout)
+		if err != nil {
+			return 0, err
+		}
+		conn.Close()
 	}
+	return time.Since(before), nil
 }
 
-func (h *HostChecker) runChecker(hc hostCheckerT) {
-	dest := fmt.Sprintf("%s:%d", hc.Host, hc.Port)
-	log.Printf("INFO: HostChecker will monitor host %s - %s\n", dest, hc.Name)
+func (h *HostChecker) runChecker(hc hostCheckerT, stopChan chan bool) {
+	h.logger.Printf("INFO: HostChecker will monitor host %s:%d (%s) - %s\n", hc.Host, hc.Port, hc.Method, hc.Name)
 	hc.firstCheck = true
-	stopChan := h.addStopChan()
 	ticker := time.NewTicker(time.Duration(hc.Period) * time.Second)
+	defer ticker.Stop()
 	for {
-		before := time.Now()
-		_, err := net.DialTimeout(netType, dest, timeout)
-		after := time.Now()
+		latency, err := check(hc)
+		h.availability.Set(h.mq, hc.Name, err == nil)
 		h.mutex.Lock()
 		if err != nil {
 			if hc.alive || hc.firstCheck { // has state changed?
@@ -146,7 +198,7 @@ func (h *HostChecker) runChecker(hc hostCheckerT) {
 				h.mqttChan <- mqMsg
 			}
 			hc.alive = true
-			hc.responseTime = after.Sub(before)
+			hc.responseTime = latency
 			h.mqttChan <- mqtt.AghastMsgT{
 				Subtopic: mqttPrefix + hc.Name + "/latency",
 				Qos:      0,
@@ -166,27 +218,28 @@ func (h *HostChecker) runChecker(hc hostCheckerT) {
 	}
 }
 
-func (h *HostChecker) monitorQueries() {
-	stopChan := h.addStopChan()
+func (h *HostChecker) monitorQueries(stopChan chan bool) {
 	ch := h.mq.SubscribeToTopic(getTopicPrefix + "+")
+	defer h.mq.UnsubscribeFromTopic(getTopicPrefix+"+", ch)
 	for {
 		select {
 		case <-stopChan:
 			return
 		case msg := <-ch:
 			name := msg.Topic[getTopicPrefixLen:]
-			log.Printf("DEBUG: HostChecker got query for %s\n", name)
+			h.logger.Printf("DEBUG: HostChecker got query for %s\n", name)
 			h.mutex.RLock()
 			hcIx, found := h.checkersByName[name]
 			if !found {
 				h.mutex.RUnlock()
-				log.Printf("WARNING: HostChecker received /get for unknown host: %s\n", name)
+				if h.instance == "" { // the host may belong to another instance
+					h.logger.Printf("WARNING: HostChecker received /get for unknown host: %s\n", name)
+				}
 				continue
 			}
 			hc := h.Checker[hcIx]
 			h.mutex.RUnlock()
-			dest := fmt.Sprintf("%s:%d", hc.Host, hc.Port)
-			_, err := net.DialTimeout(netType, dest, timeout)
+			_, err := check(hc)
 			var payload string
 			if err == nil {
 				payload = "true"
@@ -21,17 +21,18 @@ package influx
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
 	"strconv"
 	"sync"
-	"time"
 
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	influxAPI "github.com/influxdata/influxdb-client-go/v2/api"
 	"github.com/pelletier/go-toml"
 
 	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/logging"
 	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
 )
 
 const (
@@ -45,8 +46,16 @@ type Influx struct {
 	writeAPI                influxAPI.WriteAPI
 	Logger                  []loggerT
 	mutex                   sync.RWMutex
-	stopChans               []chan bool // used for stopping Goroutines
+	stopper                 safego.Stopper // used for stopping Goroutines
 	mq                      *mqtt.MQTT
+	instance                string         // optional, see SetInstance
+	logger                  logging.Logger // tags log lines with the instance, if any
+
+	// For InfluxDB 1.8+ set Version1 and use these rather than Bucket, Org, and Token
+	Version1           bool
+	Database           string
+	RetentionPolicy    string // optional, the default is used if omitted
+	Username, Password string
 }
 
 type loggerT struct {
@@ -54,80 +63,105 @@ type loggerT struct {
 	Topic    string
 	Key      string
 	DataType string
+	Qos      *int // optional, MQTT QoS of the subscription
+	qos      byte
+}
+
+// SetInstance allows logging to several databases, each instance loads its own configuration file, eg. influx-energy.toml
+func (i *Influx) SetInstance(instance string) {
+	i.instance = instance
+	i.logger = logging.New(instance)
 }
 
 // LoadConfig loads and stores the configuration for this Integration
 func (i *Influx) LoadConfig(confdir string) error {
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
-	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	confBytes, err := config.PreprocessTOML(confdir, config.InstanceConfigFilename(configFilename, i.instance))
 	if err != nil {
-		log.Println("ERROR: Could not load Influx configuration ", err.Error())
+		i.logger.Println("ERROR: Could not load Influx configuration ", err.Error())
 		return err
 	}
 	err = toml.Unmarshal(confBytes, i)
 	if err != nil {
-		log.Fatalf("ERROR: Could not load Influx config due to %s\n", err.Error())
+		i.logger.Printf("ERROR: Could not load Influx config due to %s\n", err.Error())
 		return err
 	}
-	log.Printf("INFO: Influx has %d loggers\n", len(i.Logger))
+	if i.Version1 && i.Database == "" {
+		i.logger.Println("ERROR: Influx - a Database must be configured when Version1 is set")
+		return errors.New("Influx configuration error")
+	}
+	for ix, l := range i.Logger {
+		if i.Logger[ix].qos, err = mqtt.SubscribeQos(l.Qos); err != nil {
+			i.logger.Printf("ERROR: Influx - %s for %s\n", err.Error(), l.Topic)
+			return err
+		}
+	}
+	i.logger.Printf("INFO: Influx has %d loggers\n", len(i.Logger))
 	return nil
 }
 
 // Start launches the Integration, LoadConfig() should have been called beforehand.
-func (i *Influx) Start(mq *mqtt.MQTT) {
+func (i *Influx) Start(mq *mqtt.MQTT) error {
 	i.mutex.Lock()
 	i.mq = mq
-	i.client = influxdb2.NewClient(i.URL, i.Token)
-	i.writeAPI = i.client.WriteAPI(i.Org, i.Bucket)
+	if i.Version1 {
+		// InfluxDB 1.8+ accepts v2 writes with a "user:password" token and a "database/retention-policy" bucket
+		bucket := i.Database
+		if i.RetentionPolicy != "" {
+			bucket += "/" + i.RetentionPolicy
+		}
+		i.client = influxdb2.NewClient(i.URL, i.Username+":"+i.Password)
+		i.writeAPI = i.client.WriteAPI("", bucket)
+	} else {
+		i.client = influxdb2.NewClient(i.URL, i.Token)
+		i.writeAPI = i.client.WriteAPI(i.Org, i.Bucket)
+	}
 	i.mutex.Unlock()
 	for _, l := range i.Logger {
-		go i.logger(l)
+		l := l
+		i.stopper.Go("Influx logger "+l.Topic, false, func(stopChan chan bool) { i.runLogger(l, stopChan) })
 	}
+	return nil
 }
 
 // Stop terminates the Integration and all Goroutines it contains
 func (i *Influx) Stop() {
-	for _, ch := range i.stopChans {
-		ch <- true
+	if i.stopper.Stop() {
+		i.logger.Println("DEBUG: Influx - All Goroutines have stopped")
 	}
-	log.Println("DEBUG: Influx - All Goroutines should have stopped")
 }
 
-func (i *Influx) addStopChan() chan bool {
-	newChan := make(chan bool)
-	i.mutex.Lock()
-	i.stopChans = append(i.stopChans, newChan)
-	i.mutex.Unlock()
-	return newChan
-}
-
-func (i *Influx) logger(l loggerT) {
-	ch := i.mq.SubscribeToTopic(l.Topic)
+func (i *Influx) runLogger(l loggerT, stopChan chan bool) {
+	ch := i.mq.SubscribeToTopicQos(l.Topic, l.qos)
 	defer i.mq.UnsubscribeFromTopic(l.Topic, ch)
 
-	stopChan := i.addStopChan()
-
-	log.Printf("INFO: Influx logger starting for %s, optional key: %s\n", l.Topic, l.Key)
+	i.logger.Printf("INFO: Influx logger starting for %s, optional key: %s\n", l.Topic, l.Key)
 	for {
 		select {
 		case <-stopChan:
 			i.writeAPI.Flush()
 			return
 		case msg := <-ch:
+			ts := config.LogTime()
+			raw, ok := mqtt.PayloadBytes(msg.Payload)
+			if !ok {
+				i.logger.Printf("WARNING: Influx - Ignoring unexpected %T payload on %s\n", msg.Payload, msg.Topic)
+				continue
+			}
 			var value interface{}
 			if l.Key == "" {
-				value = string(msg.Payload.([]uint8))
+				value = string(raw)
 			} else {
 				jsonMap := make(map[string]interface{})
-				err := json.Unmarshal([]byte(msg.Payload.([]uint8)), &jsonMap)
+				err := json.Unmarshal(raw, &jsonMap)
 				if err != nil {
-					log.Printf("ERROR: Influx - Could not understand JSON %s\n", msg.Payload.(string))
+					i.logger.Printf("ERROR: Influx - Could not understand JSON %s\n", raw)
 					return
 				}
 				v, found := jsonMap[l.Key]
 				if !found {
-					log.Printf("ERROR: Influx - Could find Key in JSON %s\n", msg.Payload.(string))
+					i.logger.Printf("ERROR: Influx - Could find Key in JSON %s\n", raw)
 					return
 				}
 				value = v
@@ -148,7 +182,7 @@ func (i *Influx) logger(l loggerT) {
 				case string:
 					fl, err = strconv.ParseFloat(value.(string), 64)
 					if err != nil {
-						log.Printf("WARNING: Influx logger could not parse float from %v\n", value.(string))
+						i.logger.Printf("WARNING: Influx logger could not parse float from %v\n", value.(string))
 						continue
 					}
 				}
@@ -159,7 +193,7 @@ func (i *Influx) logger(l loggerT) {
 					map[string]interface{}{
 						key: fl,
 					},
-					time.Now())
+					ts)
 				i.writeAPI.WritePoint(p)
 			case "integer":
 				var num int
@@ -174,7 +208,7 @@ func (i *Influx) logger(l loggerT) {
 					num, err = strconv.Atoi(value.(string))
 				}
 				if err != nil {
-					log.Printf("WARNING: Influx logger could not parse integer from %v\n", value.(string))
+					i.logger.Printf("WARNING: Influx logger could not parse integer from %v\n", value.(string))
 					continue
 				}
 				p := influxdb2.NewPoint(l.Name,
@@ -184,7 +218,7 @@ func (i *Influx) logger(l loggerT) {
 					map[string]interface{}{
 						key: num,
 					},
-					time.Now())
+					ts)
 				i.writeAPI.WritePoint(p)
 			default:
 				// everything else treated as a string
@@ -195,7 +229,7 @@ func (i *Influx) logger(l loggerT) {
 					map[string]interface{}{
 						key: value.(string),
 					},
-					time.Now())
+					ts)
 				i.writeAPI.WritePoint(p)
 			}
 		}
@@ -0,0 +1,300 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package localsensors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/events"
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/registry"
+	"github.com/SMerrony/aghast/safego"
+)
+
+const (
+	configFilename  = "/localsensors.toml"
+	subscriberName  = "LocalSensors"
+	mqttPrefix      = "/localsensors/"
+	defaultInterval = 60
+)
+
+// LocalSensors encapsulates the type of this Integration
+type LocalSensors struct {
+	Sensor        []sensorT
+	sensorsByName map[string]int
+	mutex         sync.RWMutex
+	stopper       safego.Stopper
+	cancel        context.CancelFunc // ends the event subscriptions
+	mq            *mqtt.MQTT
+	availability  *mqtt.Availability
+}
+
+type sensorT struct {
+	Name      string
+	Path      string      // sysfs file to read, eg. /sys/bus/w1/devices/28-0316a2793cff/w1_slave
+	Type      string      // One of "w1" (DS18B20 etc.), "thermal" (thermal zone), or "raw" (the default)
+	Interval  int         // seconds between readings
+	Every     string      // optional readable alternative to Interval, eg. "5m"
+	ValueType string      // for "raw" sensors, one of "string" (the default), "integer", or "float"
+	Factor    float64     // optional multiplier for numeric values
+	value     interface{} // the last good reading
+	valid     bool        // value has been set
+	available bool        // the last reading succeeded
+}
+
+// LoadConfig func should simply load any config (TOML) files for this Integration
+func (l *LocalSensors) LoadConfig(confdir string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	if err != nil {
+		log.Println("ERROR: Could not preprocess LocalSensors configuration ", err.Error())
+		return err
+	}
+	err = toml.Unmarshal(confBytes, l)
+	if err != nil {
+		log.Println("ERROR: Could not load LocalSensors configuration ", err.Error())
+		return err
+	}
+	l.sensorsByName = make(map[string]int)
+	for i, s := range l.Sensor {
+		if s.Name == "" || s.Path == "" {
+			log.Println("ERROR: LocalSensors - every Sensor must have a Name and Path")
+			return errors.New("LocalSensors configuration error")
+		}
+		switch s.Type {
+		case "":
+			l.Sensor[i].Type = "raw"
+		case "raw", "w1", "thermal":
+		default:
+			log.Printf("ERROR: LocalSensors - unknown Type '%s' for %s\n", s.Type, s.Name)
+			return errors.New("LocalSensors configuration error")
+		}
+		switch s.ValueType {
+		case "":
+			l.Sensor[i].ValueType = "string"
+		case "string", "integer", "float":
+		default:
+			log.Printf("ERROR: LocalSensors - unknown ValueType '%s' for %s\n", s.ValueType, s.Name)
+			return errors.New("LocalSensors configuration error")
+		}
+		if l.Sensor[i].Interval, err = config.DurationSecs(s.Every, s.Interval); err != nil {
+			log.Printf("ERROR: LocalSensors - %s for %s\n", err.Error(), s.Name)
+			return errors.New("LocalSensors configuration error")
+		}
+		if l.Sensor[i].Interval <= 0 {
+			l.Sensor[i].Interval = defaultInterval
+		}
+		if s.Factor == 0 {
+			l.Sensor[i].Factor = 1
+		}
+		l.sensorsByName[s.Name] = i
+	}
+	log.Printf("INFO: LocalSensors has %d sensors configured\n", len(l.Sensor))
+	return nil
+}
+
+// Start launches the Integration, LoadConfig() should have been called beforehand.
+func (l *LocalSensors) Start(mq *mqtt.MQTT) error {
+	l.mutex.Lock()
+	l.mq = mq
+	l.availability = mqtt.NewAvailability(mqttPrefix)
+	sensors := l.Sensor
+	l.mutex.Unlock()
+	for _, s := range sensors {
+		s := s
+		l.stopper.Go("LocalSensors "+s.Name, true, func(stopChan chan bool) { l.runSensor(s, stopChan) })
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	l.stopper.Go("LocalSensors query monitor", true, func(stopChan chan bool) { l.monitorQueries(ctx, stopChan) })
+	return nil
+}
+
+// Stop terminates the Integration and all Goroutines it contains
+func (l *LocalSensors) Stop() {
+	if l.cancel != nil {
+		l.cancel()
+	}
+	l.stopper.Stop()
+}
+
+// ProvidesDeviceTypes lists the sensors which answer Queries via the event bus
+func (l *LocalSensors) ProvidesDeviceTypes() registry.Devices {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	var names []string
+	for _, s := range l.Sensor {
+		names = append(names, s.Name)
+	}
+	return registry.Devices{
+		Integration: subscriberName,
+		Labels:      map[string][]string{events.QueryDeviceType: names},
+	}
+}
+
+func (l *LocalSensors) runSensor(s sensorT, stopChan chan bool) {
+	log.Printf("INFO: LocalSensors will read %s every %ds - %s\n", s.Path, s.Interval, s.Name)
+	ticker := time.NewTicker(time.Duration(s.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		value, err := read(s)
+		l.availability.Set(l.mq, s.Name, err == nil)
+		l.mutex.Lock()
+		sensor := &l.Sensor[l.sensorsByName[s.Name]]
+		sensor.available = err == nil
+		if err == nil {
+			sensor.value, sensor.valid = value, true
+		}
+		l.mutex.Unlock()
+		if err != nil {
+			log.Printf("WARNING: LocalSensors could not read %s - %s\n", s.Name, err.Error())
+		} else {
+			l.mq.PublishChan <- mqtt.AghastMsgT{
+				Subtopic: mqttPrefix + s.Name,
+				Qos:      0,
+				Retained: true,
+				Payload:  fmt.Sprintf("%v", value),
+			}
+		}
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// read gets the current value of the sensor, converted according to its Type and ValueType
+func read(s sensorT) (interface{}, error) {
+	raw, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parse(s, string(raw))
+}
+
+func parse(s sensorT, raw string) (interface{}, error) {
+	switch s.Type {
+	case "w1":
+		// eg. "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"
+		lines := strings.Split(strings.TrimSpace(raw), "\n")
+		if len(lines) < 2 || !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+			return nil, errors.New("1-Wire CRC check failed")
+		}
+		ix := strings.LastIndex(lines[1], "t=")
+		if ix < 0 {
+			return nil, errors.New("no 1-Wire temperature found")
+		}
+		milli, err := strconv.ParseFloat(strings.TrimSpace(lines[1][ix+2:]), 64)
+		if err != nil {
+			return nil, err
+		}
+		return milli / 1000 * s.Factor, nil
+	case "thermal":
+		// millidegrees Celsius, eg. "45678\n"
+		milli, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return nil, err
+		}
+		return milli / 1000 * s.Factor, nil
+	}
+	raw = strings.TrimSpace(raw)
+	switch s.ValueType {
+	case "integer":
+		i, err := strconv.ParseInt(raw, 10, 0)
+		if err != nil {
+			return nil, err
+		}
+		if s.Factor != 1 {
+			return float64(i) * s.Factor, nil
+		}
+		return int(i), nil
+	case "float":
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, err
+		}
+		return f * s.Factor, nil
+	}
+	return raw, nil
+}
+
+// monitorQueries answers FetchLast and IsAvailable Queries arriving via the event bus
+func (l *LocalSensors) monitorQueries(ctx context.Context, stopChan chan bool) {
+	sid := events.GetSubscriberID(subscriberName)
+	queryEvName := subscriberName + "/" + events.QueryDeviceType + "/+/+"
+	queryChan, err := events.Subscribe(ctx, sid, queryEvName)
+	if err != nil {
+		log.Fatalf("ERROR: LocalSensors Integration could not subscribe to event - %v\n", err)
+	}
+	defer events.Unsubscribe(sid, queryEvName)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case ev, ok := <-queryChan:
+			if !ok {
+				return // cancelled
+			}
+			replyChan, ok := ev.Value.(chan interface{})
+			if !ok {
+				log.Printf("WARNING: LocalSensors Query %s has no reply channel\n", ev.Name)
+				continue
+			}
+			l.mutex.RLock()
+			ix, found := l.sensorsByName[ev.Field(events.EvDeviceName)]
+			var s sensorT
+			if found {
+				s = l.Sensor[ix]
+			}
+			l.mutex.RUnlock()
+			if !found {
+				log.Printf("WARNING: LocalSensors Query for unknown sensor <%s>\n", ev.Field(events.EvDeviceName))
+				replyChan <- nil
+				continue
+			}
+			switch ev.Field(events.EvQueryType) {
+			case events.FetchLast:
+				if s.valid {
+					replyChan <- s.value
+				} else {
+					replyChan <- nil
+				}
+			case events.IsAvailable:
+				replyChan <- s.available
+			default:
+				log.Printf("WARNING: LocalSensors received unknown query type %s\n", ev.Name)
+				replyChan <- nil
+			}
+		}
+	}
+}
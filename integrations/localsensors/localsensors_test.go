@@ -0,0 +1,53 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package localsensors
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		sensor  sensorT
+		raw     string
+		want    interface{}
+		wantErr bool
+	}{
+		{"w1", sensorT{Type: "w1", Factor: 1},
+			"72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n", 23.125, false},
+		{"w1 bad CRC", sensorT{Type: "w1", Factor: 1},
+			"72 01 4b 46 7f ff 0e 10 57 : crc=57 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n", nil, true},
+		{"thermal", sensorT{Type: "thermal", Factor: 1}, "45500\n", 45.5, false},
+		{"raw string", sensorT{Type: "raw", ValueType: "string", Factor: 1}, " on\n", "on", false},
+		{"raw integer", sensorT{Type: "raw", ValueType: "integer", Factor: 1}, "42\n", 42, false},
+		{"raw integer scaled", sensorT{Type: "raw", ValueType: "integer", Factor: 0.5}, "42\n", 21.0, false},
+		{"raw float", sensorT{Type: "raw", ValueType: "float", Factor: 1}, "3.5\n", 3.5, false},
+		{"raw float bad", sensorT{Type: "raw", ValueType: "float", Factor: 1}, "n/a\n", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parse(tt.sensor, tt.raw)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: unexpected error state %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %v (%T), expected %v (%T)", tt.name, got, got, tt.want, tt.want)
+		}
+	}
+}
@@ -29,6 +29,7 @@ import (
 
 	"github.com/SMerrony/aghast/config"
 	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
 )
 
 const (
@@ -42,8 +43,8 @@ type Mqtt2smtp struct {
 	mutex sync.RWMutex
 	SmtpHost, SmtpPort,
 	SmtpUser, SmtpPassword string
-	mq       *mqtt.MQTT
-	stopChan chan bool
+	mq      *mqtt.MQTT
+	stopper safego.Stopper
 }
 
 // LoadConfig func should simply load any config (TOML) files for this Integration
@@ -62,46 +63,49 @@ func (m *Mqtt2smtp) LoadConfig(confdir string) error {
 }
 
 // Start func begins running the Integration GoRoutines and should return quickly
-func (m *Mqtt2smtp) Start(mq *mqtt.MQTT) {
+func (m *Mqtt2smtp) Start(mq *mqtt.MQTT) error {
 	m.mq = mq
-	go m.sender()
+	m.stopper.Go("Mqtt2smtp sender", false, m.sender)
+	return nil
 }
 
 // Stop terminates the Integration and all Goroutines it contains
 func (m *Mqtt2smtp) Stop() {
-	m.stopChan <- true
+	m.stopper.Stop()
 }
 
-func (m *Mqtt2smtp) sender() {
-	m.mutex.Lock()
-	m.stopChan = make(chan bool)
-	m.mutex.Unlock()
+func (m *Mqtt2smtp) sender(stopChan chan bool) {
 	ch := m.mq.SubscribeToTopic(sendTopic)
 	for {
 		select {
-		case <-m.stopChan:
+		case <-stopChan:
 			m.mq.UnsubscribeFromTopic(sendTopic, ch)
 			return
 		case msg := <-ch:
+			raw, ok := mqtt.PayloadBytes(msg.Payload)
+			if !ok {
+				log.Printf("WARNING: mqtt2smtp - Ignoring unexpected %T payload\n", msg.Payload)
+				continue
+			}
 			jsonMap := make(map[string]interface{})
-			err := json.Unmarshal([]byte(msg.Payload.([]uint8)), &jsonMap)
+			err := json.Unmarshal(raw, &jsonMap)
 			if err != nil {
-				log.Printf("ERROR: mqtt2smtp - Could not parse JSON %s\n", msg.Payload.([]uint8))
+				log.Printf("ERROR: mqtt2smtp - Could not parse JSON %s\n", raw)
 				continue
 			}
 			dest, found := jsonMap["To"]
 			if !found {
-				log.Printf("ERROR: mqtt2smtp - no 'To' field for message in %s\n", msg.Payload.([]uint8))
+				log.Printf("ERROR: mqtt2smtp - no 'To' field for message in %s\n", raw)
 				continue
 			}
 			subject, found := jsonMap["Subject"]
 			if !found {
-				log.Printf("ERROR: mqtt2smtp - no 'Subject' field for message in %s\n", msg.Payload.([]uint8))
+				log.Printf("ERROR: mqtt2smtp - no 'Subject' field for message in %s\n", raw)
 				continue
 			}
 			body, found := jsonMap["Message"]
 			if !found {
-				log.Printf("ERROR: mqtt2smtp - no 'Message' field in message in %s\n", msg.Payload.([]uint8))
+				log.Printf("ERROR: mqtt2smtp - no 'Message' field in message in %s\n", raw)
 				continue
 			}
 			message := "Subject: " + subject.(string) + "\n\n" + body.(string)
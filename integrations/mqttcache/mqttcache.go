@@ -20,7 +20,9 @@
 package mqttcache
 
 import (
+	"encoding/json"
 	"log"
+	"strings"
 	"sync"
 	"time"
 
@@ -28,6 +30,7 @@ import (
 
 	"github.com/SMerrony/aghast/config"
 	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
 )
 
 const (
@@ -35,6 +38,8 @@ const (
 	topicPrefix       = "aghast/mqttcache/"
 	getTopicPrefix    = topicPrefix + "get/"
 	getTopicPrefixLen = len(getTopicPrefix)
+	defaultMaxEntries = 1000
+	purgeInterval     = time.Minute
 )
 
 // MqttCache encapsulates the type of this Integration
@@ -42,16 +47,33 @@ type MqttCache struct {
 	Cache            []cacheT
 	cacheMap         map[string]cacheT
 	mutex            sync.RWMutex
-	stopChans        []chan bool
+	stopper          safego.Stopper
 	allMsgs, allReqs chan mqtt.GeneralMsgT
 	mq               *mqtt.MQTT
+
+	// MaxEntries limits the number of topics held when wildcards are used, the least recently used are evicted
+	MaxEntries int
+	// Envelope wraps every response as {"ok": true, "payload": ...} or {"ok": false, "error": "..."}
+	Envelope bool
+}
+
+// envelopeT is the response sent when Envelope is set
+type envelopeT struct {
+	Ok      bool            `json:"ok"`
+	Error   string          `json:"error,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
 type cacheT struct {
 	Topic       string
 	RetainSecs  int
+	Qos         *int // optional, MQTT QoS of the subscription
+	qos         byte
 	lastMessage mqtt.GeneralMsgT
 	lastMsgTime time.Time
+
+	lastUsed time.Time // for LRU eviction
+	matched  bool      // created for a topic matching a wildcard Topic, rather than configured
 }
 
 // LoadConfig func should simply load any config (TOML) files for this Integration
@@ -66,16 +88,23 @@ func (m *MqttCache) LoadConfig(confdir string) error {
 	if err != nil {
 		log.Fatalf("ERROR: Could not load MqttCache config due to %s\n", err.Error())
 	}
+	if m.MaxEntries <= 0 {
+		m.MaxEntries = defaultMaxEntries
+	}
 	m.cacheMap = make(map[string]cacheT)
-	for _, b := range m.Cache {
-		m.cacheMap[b.Topic] = b
+	for ix, b := range m.Cache {
+		if m.Cache[ix].qos, err = mqtt.SubscribeQos(b.Qos); err != nil {
+			log.Printf("ERROR: MqttCache - %s for %s\n", err.Error(), b.Topic)
+			return err
+		}
+		m.cacheMap[b.Topic] = m.Cache[ix]
 	}
 	log.Printf("INFO: MqttCache Integration has %d Buffers configured\n", len(m.Cache))
 	return nil
 }
 
 // Start func begins running the Integration GoRoutines and should return quickly
-func (m *MqttCache) Start(mq *mqtt.MQTT) {
+func (m *MqttCache) Start(mq *mqtt.MQTT) error {
 	m.mutex.Lock()
 	m.mq = mq
 	// subscribe to all buffer sources and funnel the messages into a single chan
@@ -84,31 +113,22 @@ func (m *MqttCache) Start(mq *mqtt.MQTT) {
 	m.mutex.Unlock()
 	m.mutex.Lock()
 	for _, cache := range m.Cache {
-		m.mq.SubscribeToTopicUsingChan(cache.Topic, m.allMsgs)
+		m.mq.SubscribeToTopicUsingChanQos(cache.Topic, m.allMsgs, cache.qos)
 		m.mq.SubscribeToTopicUsingChan(getTopicPrefix+cache.Topic, m.allReqs)
 	}
 	m.mutex.Unlock()
-	go m.monitorMsgSources()
-	go m.monitorRequests()
+	m.stopper.Go("MqttCache source monitor", true, m.monitorMsgSources)
+	m.stopper.Go("MqttCache request monitor", true, m.monitorRequests)
+	m.stopper.Go("MqttCache purger", true, m.purgeExpired)
+	return nil
 }
 
 // Stop terminates the Integration and all Goroutines it contains
 func (m *MqttCache) Stop() {
-	for _, ch := range m.stopChans {
-		ch <- true
-	}
+	m.stopper.Stop()
 }
 
-func (m *MqttCache) addStopChan() chan bool {
-	newChan := make(chan bool)
-	m.mutex.Lock()
-	m.stopChans = append(m.stopChans, newChan)
-	m.mutex.Unlock()
-	return newChan
-}
-
-func (m *MqttCache) monitorMsgSources() {
-	stopChan := m.addStopChan()
+func (m *MqttCache) monitorMsgSources(stopChan chan bool) {
 	for {
 		select {
 		case <-stopChan:
@@ -120,9 +140,13 @@ func (m *MqttCache) monitorMsgSources() {
 			return
 		case msg := <-m.allMsgs:
 			m.mutex.Lock()
-			tmpCache := m.cacheMap[msg.Topic]
+			tmpCache, found := m.cacheMap[msg.Topic]
+			if !found {
+				tmpCache = m.newMatchedEntry(msg.Topic)
+			}
 			tmpCache.lastMessage = msg
 			tmpCache.lastMsgTime = time.Now()
+			tmpCache.lastUsed = tmpCache.lastMsgTime
 			m.cacheMap[msg.Topic] = tmpCache
 			m.mutex.Unlock()
 			// log.Printf("DEBUG: mqttcache got data for %s\n", tmpCache.Topic)
@@ -130,8 +154,7 @@ func (m *MqttCache) monitorMsgSources() {
 	}
 }
 
-func (m *MqttCache) monitorRequests() {
-	stopChan := m.addStopChan()
+func (m *MqttCache) monitorRequests(stopChan chan bool) {
 	for {
 		select {
 		case <-stopChan:
@@ -147,25 +170,144 @@ func (m *MqttCache) monitorRequests() {
 			// 4. We don't know this topic (not configured)
 			reqTopic := req.Topic[getTopicPrefixLen:]
 			// log.Printf("DEBUG: mqttcache got request for topic '%s'\n", reqTopic)
-			m.mutex.RLock()
+			m.mutex.Lock()
 			cache, ok := m.cacheMap[reqTopic]
-			m.mutex.RUnlock()
-			var payload string
+			if ok {
+				cache.lastUsed = time.Now()
+				m.cacheMap[reqTopic] = cache
+			}
+			m.mutex.Unlock()
+			var payload, errMsg string
 			if !ok { // case 4
-				payload = "{\"Error\": \"Not configured in mqttcache\"}"
+				errMsg = "Not configured in mqttcache"
 			} else if (cache.lastMsgTime == time.Time{}) { // case 3
-				payload = "{\"Error\": \"No data collected yet\"}"
+				errMsg = "No data collected yet"
 			} else if time.Since(cache.lastMsgTime) > (time.Duration(cache.RetainSecs) * time.Second) {
-				payload = "{\"Error\": \"Data expired\"}" // case 2
+				errMsg = "Data expired" // case 2
 			} else { // case 1
-				payload = string(cache.lastMessage.Payload.([]uint8))
+				raw, _ := mqtt.PayloadBytes(cache.lastMessage.Payload)
+				payload = string(raw)
+				if key := requestedKey(req); key != "" {
+					payload, errMsg = extractKey(payload, key)
+				}
 			}
 			m.mq.ThirdPartyChan <- mqtt.GeneralMsgT{
 				Topic:    topicPrefix + reqTopic,
 				Qos:      0,
 				Retained: false,
-				Payload:  payload,
+				Payload:  response(m.Envelope, payload, errMsg),
+			}
+		}
+	}
+}
+
+// newMatchedEntry returns a cache entry for a topic which matches a wildcard Topic, evicting
+// the least recently used matched entry if the cache is full.  The mutex must be held.
+func (m *MqttCache) newMatchedEntry(topic string) cacheT {
+	entry := cacheT{Topic: topic, matched: true}
+	for _, c := range m.Cache {
+		if strings.ContainsAny(c.Topic, "+#") && mqtt.TopicMatches(topic, c.Topic) {
+			entry.RetainSecs = c.RetainSecs
+			break
+		}
+	}
+	if len(m.cacheMap) >= m.MaxEntries {
+		var (
+			lruTopic string
+			lruTime  time.Time
+		)
+		for t, c := range m.cacheMap {
+			if c.matched && (lruTopic == "" || c.lastUsed.Before(lruTime)) {
+				lruTopic, lruTime = t, c.lastUsed
+			}
+		}
+		if lruTopic != "" {
+			delete(m.cacheMap, lruTopic)
+		}
+	}
+	return entry
+}
+
+// purgeExpired periodically frees data older than its RetainSecs, matched entries are removed entirely
+func (m *MqttCache) purgeExpired(stopChan chan bool) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			m.mutex.Lock()
+			for t, c := range m.cacheMap {
+				if (c.lastMsgTime == time.Time{}) || time.Since(c.lastMsgTime) <= time.Duration(c.RetainSecs)*time.Second {
+					continue
+				}
+				if c.matched {
+					delete(m.cacheMap, t)
+				} else {
+					c.lastMessage = mqtt.GeneralMsgT{} // keep lastMsgTime so that requests still see "Data expired"
+					m.cacheMap[t] = c
+				}
 			}
+			m.mutex.Unlock()
+		}
+	}
+}
+
+// requestedKey returns the JSON key asked for in the payload of a get request, eg. {"Key": "temperature"},
+// or an empty string if the whole cached payload is wanted.
+func requestedKey(req mqtt.GeneralMsgT) string {
+	reqBytes, ok := mqtt.PayloadBytes(req.Payload)
+	if !ok || len(reqBytes) == 0 {
+		return ""
+	}
+	var getReq struct{ Key string }
+	if err := json.Unmarshal(reqBytes, &getReq); err != nil {
+		log.Printf("WARNING: MqttCache ignoring non-JSON payload in get request on %s\n", req.Topic)
+		return ""
+	}
+	return getReq.Key
+}
+
+// extractKey returns just the value for key from the cached JSON payload, or an error message
+func extractKey(payload string, key string) (value string, errMsg string) {
+	jsonMap := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(payload), &jsonMap); err != nil {
+		return "", "Cached data is not JSON"
+	}
+	v, found := jsonMap[key]
+	if !found {
+		return "", "Key not found"
+	}
+	if str, isString := v.(string); isString {
+		return str, ""
+	}
+	val, err := json.Marshal(v)
+	if err != nil {
+		return "", "Could not encode value"
+	}
+	return string(val), ""
+}
+
+// response formats the reply to a get request, either the payload or {"Error": errMsg}, or when
+// envelope is set, always an envelopeT with JSON payloads embedded as-is and anything else as a string
+func response(envelope bool, payload, errMsg string) string {
+	if !envelope {
+		if errMsg != "" {
+			return "{\"Error\": \"" + errMsg + "\"}"
 		}
+		return payload
+	}
+	env := envelopeT{Ok: errMsg == "", Error: errMsg}
+	if env.Ok {
+		env.Payload = json.RawMessage(payload)
+		if !json.Valid(env.Payload) {
+			env.Payload, _ = json.Marshal(payload)
+		}
+	}
+	resp, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("WARNING: MqttCache could not encode response - %s\n", err.Error())
 	}
+	return string(resp)
 }
@@ -0,0 +1,85 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package mqttcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SMerrony/aghast/mqtt/mqtttest"
+)
+
+func TestResponse(t *testing.T) {
+	tests := []struct {
+		envelope        bool
+		payload, errMsg string
+		want            string
+	}{
+		{false, `{"temperature": 21.5}`, "", `{"temperature": 21.5}`},
+		{false, "", "Data expired", `{"Error": "Data expired"}`},
+		{true, `{"temperature": 21.5}`, "", `{"ok":true,"payload":{"temperature":21.5}}`},
+		{true, "ON", "", `{"ok":true,"payload":"ON"}`},
+		{true, "21.5", "", `{"ok":true,"payload":21.5}`},
+		{true, "", "Key not found", `{"ok":false,"error":"Key not found"}`},
+	}
+	for _, tt := range tests {
+		if got := response(tt.envelope, tt.payload, tt.errMsg); got != tt.want {
+			t.Errorf("response(%v, %q, %q) = %s, expected %s", tt.envelope, tt.payload, tt.errMsg, got, tt.want)
+		}
+	}
+}
+
+func TestCacheRequests(t *testing.T) {
+	b := mqtttest.NewBroker(t)
+	mq := mqtttest.Connect(t, b)
+	confDir := mqtttest.ConfigDir(t, map[string]string{
+		"mqttcache.toml": `Envelope = true
+[[Cache]]
+  Topic = "test/sensor/+"
+  RetainSecs = 600
+`,
+	})
+	m := &MqttCache{}
+	if err := m.LoadConfig(confDir); err != nil {
+		t.Fatal(err)
+	}
+	responses := b.Watch(topicPrefix + "test/sensor/office")
+	m.Start(mq)
+	defer m.Stop()
+	b.WaitForSubscriber(t, "test/sensor/+")
+	b.WaitForSubscriber(t, getTopicPrefix+"test/sensor/+")
+
+	b.Publish(getTopicPrefix+"test/sensor/office", nil, false)
+	if msg := mqtttest.Receive(t, responses); string(msg.Payload) != `{"ok":false,"error":"Not configured in mqttcache"}` {
+		t.Errorf("response before any data %s", msg.Payload)
+	}
+	b.Publish("test/sensor/office", []byte(`{"temperature": 21.5}`), false)
+	want := `{"ok":true,"payload":{"temperature":21.5}}`
+	got := ""
+	// the data and the request are handled by different Goroutines, so the data may not be cached at first
+	for tries := 0; tries < 10 && got != want; tries++ {
+		time.Sleep(10 * time.Millisecond)
+		b.Publish(getTopicPrefix+"test/sensor/office", nil, false)
+		got = string(mqtttest.Receive(t, responses).Payload)
+	}
+	if got != want {
+		t.Errorf("response %s, expected %s", got, want)
+	}
+}
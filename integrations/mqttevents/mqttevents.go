@@ -0,0 +1,111 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package mqttevents
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/events"
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
+)
+
+const configFilename = "/mqttevents.toml"
+
+// MqttEvents encapsulates the type of this Integration
+type MqttEvents struct {
+	Topic   []topicT
+	mutex   sync.RWMutex
+	stopper safego.Stopper
+	mq      *mqtt.MQTT
+}
+
+type topicT struct {
+	Topic string // the MQTT topic, which may contain wildcards
+	Qos   *int   // optional QoS of the subscription
+	qos   byte
+}
+
+// LoadConfig func should simply load any config (TOML) files for this Integration
+func (m *MqttEvents) LoadConfig(confdir string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	if err != nil {
+		log.Println("ERROR: Could not preprocess MqttEvents configuration ", err.Error())
+		return err
+	}
+	err = toml.Unmarshal(confBytes, m)
+	if err != nil {
+		log.Println("ERROR: Could not load MqttEvents configuration ", err.Error())
+		return err
+	}
+	for i, t := range m.Topic {
+		if t.Topic == "" {
+			log.Println("ERROR: MqttEvents - every Topic entry must have a Topic")
+			return errors.New("MqttEvents configuration error")
+		}
+		if m.Topic[i].qos, err = mqtt.SubscribeQos(t.Qos); err != nil {
+			log.Printf("ERROR: MqttEvents - %s for %s\n", err.Error(), t.Topic)
+			return err
+		}
+	}
+	log.Printf("INFO: MqttEvents Integration has %d Topics configured\n", len(m.Topic))
+	return nil
+}
+
+// Start func begins running the Integration GoRoutines and should return quickly
+func (m *MqttEvents) Start(mq *mqtt.MQTT) error {
+	m.mq = mq
+	for _, t := range m.Topic {
+		t := t
+		m.stopper.Go("MqttEvents "+t.Topic, true, func(stopChan chan bool) { m.forward(t, stopChan) })
+	}
+	return nil
+}
+
+// Stop terminates the Integration and all Goroutines it contains
+func (m *MqttEvents) Stop() {
+	m.stopper.Stop()
+}
+
+// forward publishes each message received on the topic as an Event named after the message's topic
+func (m *MqttEvents) forward(t topicT, stopChan chan bool) {
+	ch := m.mq.SubscribeToTopicQos(t.Topic, t.qos)
+	defer m.mq.UnsubscribeFromTopic(t.Topic, ch)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg := <-ch:
+			raw, ok := mqtt.PayloadBytes(msg.Payload)
+			if !ok {
+				log.Printf("WARNING: MqttEvents - Ignoring unexpected %T payload on %s\n", msg.Payload, msg.Topic)
+				continue
+			}
+			events.Publish(events.EventT{Name: msg.Topic, Value: string(raw)})
+		}
+	}
+}
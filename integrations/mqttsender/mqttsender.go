@@ -28,6 +28,7 @@ import (
 
 	"github.com/SMerrony/aghast/config"
 	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
 )
 
 const (
@@ -36,17 +37,19 @@ const (
 
 // MqttSender encapsulates the type of this Integration
 type MqttSender struct {
-	Sender    []senderT
-	mutex     sync.RWMutex
-	stopChans []chan bool
-	mq        *mqtt.MQTT
+	Sender  []senderT
+	mutex   sync.RWMutex
+	stopper safego.Stopper
+	mq      *mqtt.MQTT
 }
 
 type senderT struct {
-	Topic    string
-	Payload  string
-	Interval string
-	Period   int
+	Topic       string
+	Payload     string
+	SourceTopic string // if set, the latest payload received on this topic is sent instead of Payload
+	Interval    string // One of Days, Hours, Minutes, or Seconds
+	Period      int    // an integral number of Intervals
+	Every       string // optional readable alternative to Interval and Period, eg. "90s"
 	// periodSecs is calculated from the user-provided config
 	periodSecs int
 }
@@ -64,6 +67,12 @@ func (m *MqttSender) LoadConfig(confdir string) error {
 		log.Fatalf("ERROR: Could not load MqttSender config due to %s\n", err.Error())
 	}
 	for i, _ := range m.Sender {
+		if m.Sender[i].Every != "" {
+			if m.Sender[i].periodSecs, err = config.DurationSecs(m.Sender[i].Every, 0); err != nil {
+				log.Fatalf("ERROR: Could not load MqttSender config due to %s\n", err.Error())
+			}
+			continue
+		}
 		switch m.Sender[i].Interval {
 		case "Seconds":
 			m.Sender[i].periodSecs = m.Sender[i].Period
@@ -83,47 +92,58 @@ func (m *MqttSender) LoadConfig(confdir string) error {
 }
 
 // Start func begins running the Integration GoRoutines and should return quickly
-func (m *MqttSender) Start(mq *mqtt.MQTT) {
+func (m *MqttSender) Start(mq *mqtt.MQTT) error {
 	m.mq = mq
-	go m.sender()
+	m.stopper.Go("MqttSender", false, m.sender)
+	return nil
 }
 
 // Stop terminates the Integration and all Goroutines it contains
 func (m *MqttSender) Stop() {
-	for _, ch := range m.stopChans {
-		ch <- true
-	}
+	m.stopper.Stop()
 }
 
-func (m *MqttSender) addStopChan() chan bool {
-	newChan := make(chan bool)
-	m.mutex.Lock()
-	m.stopChans = append(m.stopChans, newChan)
-	m.mutex.Unlock()
-	return newChan
-}
-
-func (m *MqttSender) sender() {
-	stopChan := m.addStopChan()
+func (m *MqttSender) sender(stopChan chan bool) {
+	// mirrored Senders republish the latest payload from their SourceTopic, the channel is buffered as
+	// mqtt.SubscribeToTopic's are so that other subscribers are not held up while we are publishing
+	sourceChan := make(chan mqtt.GeneralMsgT, m.mq.InboundQueueLen)
+	latest := make(map[string]interface{})
+	for _, s := range m.Sender {
+		if _, subscribed := latest[s.SourceTopic]; s.SourceTopic != "" && !subscribed {
+			latest[s.SourceTopic] = nil
+			m.mq.SubscribeToTopicUsingChan(s.SourceTopic, sourceChan)
+			defer m.mq.UnsubscribeFromTopic(s.SourceTopic, sourceChan)
+		}
+	}
 	secs := time.NewTicker(time.Second)
+	defer secs.Stop()
 	tock := 0
 	for {
 		select {
 		case <-stopChan:
 			return
+		case msg := <-sourceChan:
+			latest[msg.Topic] = msg.Payload
 		case <-secs.C:
 			tock++
 			// we could add more data structures (indices) to make this a little more efficient
 			// but I doubt there's any benefit unless there are thousands of Senders
 			for _, s := range m.Sender {
-				if tock%s.periodSecs == 0 {
-					m.mq.ThirdPartyChan <- mqtt.GeneralMsgT{
-						Topic:    s.Topic,
-						Qos:      0,
-						Retained: false,
-						Payload:  s.Payload,
+				if tock%s.periodSecs != 0 {
+					continue
+				}
+				var payload interface{} = s.Payload
+				if s.SourceTopic != "" {
+					if payload = latest[s.SourceTopic]; payload == nil {
+						continue // nothing received yet
 					}
 				}
+				m.mq.ThirdPartyChan <- mqtt.GeneralMsgT{
+					Topic:    s.Topic,
+					Qos:      0,
+					Retained: false,
+					Payload:  payload,
+				}
 			}
 		}
 	}
@@ -0,0 +1,246 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
+)
+
+const (
+	configFilename = "/notify.toml"
+	sendTopic      = "aghast/notify/send"
+	ackTopic       = "aghast/notify/sent"
+	telegramURL    = "https://api.telegram.org/bot"
+	httpTimeout    = 10 * time.Second
+)
+
+// Notify encapsulates the type of this Integration
+type Notify struct {
+	Target        []targetT
+	targetsByName map[string]int
+	mutex         sync.RWMutex
+	mq            *mqtt.MQTT
+	stopper       safego.Stopper
+	client        http.Client
+}
+
+type targetT struct {
+	Name    string
+	Service string // either "telegram" or "matrix"
+	// Telegram
+	BotToken string
+	ChatID   string
+	// Matrix
+	Homeserver  string
+	AccessToken string
+	RoomID      string
+}
+
+// notificationT is the JSON payload expected on the sendTopic
+type notificationT struct {
+	Service string // Name of the Target, may be omitted if only one is configured
+	Message string
+}
+
+// ackT is the JSON payload published on the ackTopic after each attempt
+type ackT struct {
+	Service string
+	OK      bool
+	Error   string `json:",omitempty"`
+}
+
+// LoadConfig func should simply load any config (TOML) files for this Integration
+func (n *Notify) LoadConfig(confdir string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	if err != nil {
+		log.Println("ERROR: Could not preprocess Notify configuration ", err.Error())
+		return err
+	}
+	err = toml.Unmarshal(confBytes, n)
+	if err != nil {
+		log.Printf("ERROR: Could not load Notify config due to %s\n", err.Error())
+		return err
+	}
+	n.targetsByName = make(map[string]int)
+	for ix, t := range n.Target {
+		if _, dup := n.targetsByName[t.Name]; dup || t.Name == "" {
+			log.Printf("ERROR: Notify Target names must be unique and not empty - '%s'\n", t.Name)
+			return errors.New("Notify configuration error")
+		}
+		switch t.Service {
+		case "telegram":
+			if t.BotToken == "" || t.ChatID == "" {
+				log.Printf("ERROR: Notify Target %s needs a BotToken and ChatID\n", t.Name)
+				return errors.New("Notify configuration error")
+			}
+		case "matrix":
+			if t.Homeserver == "" || t.AccessToken == "" || t.RoomID == "" {
+				log.Printf("ERROR: Notify Target %s needs a Homeserver, AccessToken and RoomID\n", t.Name)
+				return errors.New("Notify configuration error")
+			}
+		default:
+			log.Printf("ERROR: Notify Target %s has unknown Service '%s'\n", t.Name, t.Service)
+			return errors.New("Notify configuration error")
+		}
+		n.targetsByName[t.Name] = ix
+	}
+	n.client = http.Client{Timeout: httpTimeout}
+	log.Printf("INFO: Notify Integration has %d Targets configured\n", len(n.Target))
+	return nil
+}
+
+// Start func begins running the Integration GoRoutines and should return quickly
+func (n *Notify) Start(mq *mqtt.MQTT) error {
+	n.mutex.Lock()
+	n.mq = mq
+	n.mutex.Unlock()
+	n.stopper.Go("Notify sender", true, n.sender)
+	return nil
+}
+
+// Stop terminates the Integration and all Goroutines it contains
+func (n *Notify) Stop() {
+	n.stopper.Stop()
+}
+
+func (n *Notify) sender(stopChan chan bool) {
+	ch := n.mq.SubscribeToTopic(sendTopic)
+	defer n.mq.UnsubscribeFromTopic(sendTopic, ch)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg := <-ch:
+			raw, ok := mqtt.PayloadBytes(msg.Payload)
+			if !ok {
+				log.Printf("WARNING: Notify - Ignoring unexpected %T payload\n", msg.Payload)
+				continue
+			}
+			var notification notificationT
+			if err := json.Unmarshal(raw, &notification); err != nil {
+				log.Printf("ERROR: Notify - Could not parse JSON %s\n", raw)
+				continue
+			}
+			err := n.send(notification)
+			ack := ackT{Service: notification.Service, OK: err == nil}
+			if err != nil {
+				log.Printf("ERROR: Notify could not send to %s - %s\n", notification.Service, err.Error())
+				ack.Error = err.Error()
+			} else {
+				log.Printf("INFO: Notify - Sent message to %s\n", notification.Service)
+			}
+			ackBytes, _ := json.Marshal(ack)
+			n.mq.ThirdPartyChan <- mqtt.GeneralMsgT{
+				Topic:    ackTopic,
+				Qos:      0,
+				Retained: false,
+				Payload:  ackBytes,
+			}
+		}
+	}
+}
+
+// send delivers the notification to its Target
+func (n *Notify) send(notification notificationT) error {
+	if notification.Message == "" {
+		return errors.New("no Message")
+	}
+	n.mutex.RLock()
+	var t targetT
+	ix, found := n.targetsByName[notification.Service]
+	switch {
+	case found:
+		t = n.Target[ix]
+	case notification.Service == "" && len(n.Target) == 1:
+		t = n.Target[0]
+	}
+	n.mutex.RUnlock()
+	switch t.Service {
+	case "telegram":
+		return n.sendTelegram(t, notification.Message)
+	case "matrix":
+		return n.sendMatrix(t, notification.Message)
+	}
+	return errors.New("unknown Service")
+}
+
+func (n *Notify) sendTelegram(t targetT, message string) error {
+	body, err := json.Marshal(map[string]string{"chat_id": t.ChatID, "text": message})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, telegramURL+t.BotToken+"/sendMessage", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return n.do(req, "")
+}
+
+func (n *Notify) sendMatrix(t targetT, message string) error {
+	body, err := json.Marshal(map[string]string{"msgtype": "m.text", "body": message})
+	if err != nil {
+		return err
+	}
+	// the transaction ID must be unique for each message
+	txnID := strconv.FormatInt(time.Now().UnixNano(), 10)
+	reqURL := t.Homeserver + "/_matrix/client/r0/rooms/" + url.PathEscape(t.RoomID) + "/send/m.room.message/" + txnID
+	req, err := http.NewRequest(http.MethodPut, reqURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return n.do(req, t.AccessToken)
+}
+
+// do sends a JSON request, with a bearer token if one is supplied, and checks the response status
+func (n *Notify) do(req *http.Request, token string) error {
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err // the URL may contain a secret token, so don't report it
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
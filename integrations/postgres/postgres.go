@@ -24,21 +24,26 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"math"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/pelletier/go-toml"
 
 	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/logging"
 	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
 )
 
 const (
-	configFilename = "/postgres.toml"
+	configFilename    = "/postgres.toml"
+	initialRetryDelay = 5 * time.Second
+	maxRetryDelay     = 5 * time.Minute
+	maxBuffered       = 10000 // per Logger
 )
 
 // The Postgres type encapsulates the Postgres Data Logging Integration
@@ -48,11 +53,21 @@ type Postgres struct {
 	PgUser     string
 	PgPassword string
 	PgDatabase string
-	Logger     []loggerT
-	mutex      sync.RWMutex
-	stopChans  []chan bool // used for stopping Goroutines
-	dbpool     *pgxpool.Pool
-	mq         *mqtt.MQTT
+	// BufferOutages causes values to be kept (up to a limit) while the DB is unreachable, rather than dropped
+	BufferOutages bool
+	Logger        []loggerT
+	mutex         sync.RWMutex
+	stopper       safego.Stopper // used for stopping Goroutines
+	dbpool        *pgxpool.Pool
+	mq            *mqtt.MQTT
+	instance      string         // optional, see SetInstance
+	logger        logging.Logger // tags log lines with the instance, if any
+}
+
+// insertT is a pending INSERT, the timestamp is taken when the value arrives
+type insertT struct {
+	sql  string
+	args []interface{}
 }
 
 type loggerT struct {
@@ -60,62 +75,83 @@ type loggerT struct {
 	Topic    string
 	Key      string
 	DataType string
+	Qos      *int // optional, MQTT QoS of the subscription
+	qos      byte
+}
+
+// SetInstance allows logging to several databases, each instance loads its own configuration file, eg. postgres-energy.toml
+func (p *Postgres) SetInstance(instance string) {
+	p.instance = instance
+	p.logger = logging.New(instance)
 }
 
 // LoadConfig loads and stores the configuration for this Integration
 func (p *Postgres) LoadConfig(confdir string) error {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	confBytes, err := config.PreprocessTOML(confdir, config.InstanceConfigFilename(configFilename, p.instance))
 	if err != nil {
-		log.Println("ERROR: Could not load Postgres configuration ", err.Error())
+		p.logger.Println("ERROR: Could not load Postgres configuration ", err.Error())
 		return err
 	}
 	err = toml.Unmarshal(confBytes, p)
 	if err != nil {
-		log.Fatalf("ERROR: Could not load Postgres config due to %s\n", err.Error())
+		p.logger.Printf("ERROR: Could not load Postgres config due to %s\n", err.Error())
 		return err
 	}
-	log.Printf("INFO: Postgres has %d loggers\n", len(p.Logger))
+	for ix, l := range p.Logger {
+		if p.Logger[ix].qos, err = mqtt.SubscribeQos(l.Qos); err != nil {
+			p.logger.Printf("ERROR: Postgres - %s for %s\n", err.Error(), l.Topic)
+			return err
+		}
+	}
+	p.logger.Printf("INFO: Postgres has %d loggers\n", len(p.Logger))
 	return nil
 }
 
 // Start launches the Integration, LoadConfig() should have been called beforehand.
-func (p *Postgres) Start(mq *mqtt.MQTT) {
+func (p *Postgres) Start(mq *mqtt.MQTT) error {
 	p.mutex.Lock()
 	p.mq = mq
 	var err error
 	dbURL := "postgresql://" + p.PgUser + ":" + p.PgPassword + "@" + p.PgHost + ":" + p.PgPort + "/" + p.PgDatabase
 	p.dbpool, err = pgxpool.Connect(context.Background(), dbURL)
 	if err != nil {
-		log.Printf("WARNING: Postgres Integration failed to connect to DB with %s - %s\n", dbURL, err.Error())
-		return
+		p.logger.Printf("WARNING: Postgres Integration failed to connect to DB with %s - %s\n", dbURL, err.Error())
+		p.mutex.Unlock()
+		return err
 	}
 	p.mutex.Unlock()
 	for _, l := range p.Logger {
-		go p.logger(l)
+		l := l
+		p.stopper.Go("Postgres logger "+l.Topic, false, func(stopChan chan bool) { p.runLogger(l, stopChan) })
 	}
+	return nil
 }
 
 // Stop terminates the Integration and all Goroutines it contains
 func (p *Postgres) Stop() {
-	for _, ch := range p.stopChans {
-		ch <- true
+	allStopped := p.stopper.Stop()
+	if p.dbpool != nil {
+		p.dbpool.Close()
+	}
+	if allStopped {
+		p.logger.Println("DEBUG: Postgres - All Goroutines have stopped")
 	}
-	p.dbpool.Close()
-	log.Println("DEBUG: Postgres - All Goroutines should have stopped")
 }
 
-func (p *Postgres) addStopChan() chan bool {
-	newChan := make(chan bool)
-	p.mutex.Lock()
-	p.stopChans = append(p.stopChans, newChan)
-	p.mutex.Unlock()
-	return newChan
+// ping checks that the DB is reachable, the pool will re-establish connections if it has been restarted
+func (p *Postgres) ping() error {
+	conn, err := p.dbpool.Acquire(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	return conn.Conn().Ping(context.Background())
 }
 
-func (p *Postgres) logger(l loggerT) {
-	ch := p.mq.SubscribeToTopic(l.Topic)
+func (p *Postgres) runLogger(l loggerT, stopChan chan bool) {
+	ch := p.mq.SubscribeToTopicQos(l.Topic, l.qos)
 	defer p.mq.UnsubscribeFromTopic(l.Topic, ch)
 
 	// lookup or create id value for this data name
@@ -126,42 +162,70 @@ func (p *Postgres) logger(l loggerT) {
 		sql = "INSERT INTO names(id, name, topic) VALUES(DEFAULT, '" + l.Name + "', '" + l.Topic + "')"
 		_, err = p.dbpool.Exec(context.Background(), sql)
 		if err != nil {
-			log.Printf("ERROR: Postgres Integration could not insert into 'names' table with query\n%s\n", sql)
+			p.logger.Printf("ERROR: Postgres Integration could not insert into 'names' table with query\n%s\n", sql)
 			return
 		}
 		sql := "SELECT id FROM names WHERE name = '" + l.Name + "'"
 		err = p.dbpool.QueryRow(context.Background(), sql).Scan(&nameID)
 		if err != nil {
-			log.Println("ERROR: Postgres Integration could not SELECT from  'names' table")
+			p.logger.Println("ERROR: Postgres Integration could not SELECT from  'names' table")
 			return
 		}
 	} else {
 		if err != nil {
-			log.Println("ERROR: Postgres Integration could not query 'names' table")
+			p.logger.Println("ERROR: Postgres Integration could not query 'names' table")
 			return
 		}
 	}
-	idString := strconv.Itoa(nameID)
-	stopChan := p.addStopChan()
-	log.Printf("DEBUG: Postgres logger starting for %s\n", l.Topic)
+	p.logger.Printf("DEBUG: Postgres logger starting for %s\n", l.Topic)
+	// if the DB becomes unreachable we periodically retry, buffering inserts if configured to
+	var (
+		outage     bool
+		pending    []insertT
+		dropped    int
+		retryDelay time.Duration
+		retryChan  <-chan time.Time
+	)
 	for {
 		select {
 		case <-stopChan:
 			return
+		case <-retryChan:
+			if err := p.ping(); err != nil {
+				if retryDelay *= 2; retryDelay > maxRetryDelay {
+					retryDelay = maxRetryDelay
+				}
+				retryChan = time.After(retryDelay)
+				continue
+			}
+			p.logger.Printf("INFO: Postgres logger %s reconnected, writing %d buffered value(s), %d were dropped\n", l.Name, len(pending), dropped)
+			for _, ins := range pending {
+				if _, err := p.dbpool.Exec(context.Background(), ins.sql, ins.args...); err != nil {
+					p.logger.Printf("WARNING: Postgres Integration could not INSERT buffered value - %s\n", err.Error())
+				}
+			}
+			outage, pending, dropped, retryChan = false, nil, 0, nil
 		case msg := <-ch:
+			raw, ok := mqtt.PayloadBytes(msg.Payload)
+			if !ok {
+				p.logger.Printf("WARNING: Postgres Logger - Ignoring unexpected %T payload on %s\n", msg.Payload, msg.Topic)
+				continue
+			}
+			ts := config.LogTime()
+			var ins insertT
 			var value interface{}
 			if l.Key == "" {
-				value = string(msg.Payload.([]uint8))
+				value = string(raw)
 			} else {
 				jsonMap := make(map[string]interface{})
-				err := json.Unmarshal([]byte(msg.Payload.([]uint8)), &jsonMap)
+				err := json.Unmarshal(raw, &jsonMap)
 				if err != nil {
-					log.Printf("ERROR: Postgres Logger - Could not understand JSON %s\n", msg.Payload.(string))
+					p.logger.Printf("ERROR: Postgres Logger - Could not understand JSON %s\n", raw)
 					return
 				}
 				v, found := jsonMap[l.Key]
 				if !found {
-					log.Printf("ERROR: Postgres Logger - Could find Key in JSON %s\n", msg.Payload.(string))
+					p.logger.Printf("ERROR: Postgres Logger - Could find Key in JSON %s\n", raw)
 					return
 				}
 				value = v
@@ -177,11 +241,11 @@ func (p *Postgres) logger(l loggerT) {
 				case string:
 					fl, err = strconv.ParseFloat(value.(string), 64)
 					if err != nil {
-						log.Printf("WARNING: Postgres logger could not parse float from %v\n", value)
+						p.logger.Printf("WARNING: Postgres logger could not parse float from %v\n", value)
 						continue
 					}
 				}
-				sql = fmt.Sprintf("INSERT INTO logged_floats(id, ts, float_val) VALUES( %s, NOW(), %f)", idString, fl)
+				ins = insertT{"INSERT INTO logged_floats(id, ts, float_val) VALUES($1, $2, $3)", []interface{}{nameID, ts, fl}}
 			case "integer":
 				var num int
 				switch t := value.(type) {
@@ -196,23 +260,38 @@ func (p *Postgres) logger(l loggerT) {
 				case string:
 					num, err = strconv.Atoi(value.(string))
 				default:
-					log.Printf("WARNING: Postgres Logger expected integer type, got: %T\n", t)
+					p.logger.Printf("WARNING: Postgres Logger expected integer type, got: %T\n", t)
 					err = errors.New("Type error")
 				}
 				if err != nil {
-					log.Printf("WARNING: Postgres logger could not parse integer from %v\n", value)
+					p.logger.Printf("WARNING: Postgres logger could not parse integer from %v\n", value)
 					continue
 				}
-				sql = fmt.Sprintf("INSERT INTO logged_integers(id, ts, int_val) VALUES( %s, NOW(), %d)", idString, num)
+				ins = insertT{"INSERT INTO logged_integers(id, ts, int_val) VALUES($1, $2, $3)", []interface{}{nameID, ts, num}}
 			case "string":
-				sql = fmt.Sprintf("INSERT INTO logged_strings(id, ts, string_val) VALUES( %s, NOW(), %s)", idString, value.(string))
+				ins = insertT{"INSERT INTO logged_strings(id, ts, string_val) VALUES($1, $2, $3)", []interface{}{nameID, ts, fmt.Sprintf("%v", value)}}
 			default:
-				log.Printf("WARNING: Postgres unrecognised ValueType: %s\n", l.DataType)
+				p.logger.Printf("WARNING: Postgres unrecognised ValueType: %s\n", l.DataType)
 				continue
 			}
-			_, err = p.dbpool.Exec(context.Background(), sql)
-			if err != nil {
-				log.Printf("WARNING: Postgres Integration could not INSERT value - %s\n", err.Error())
+			if !outage {
+				_, err = p.dbpool.Exec(context.Background(), ins.sql, ins.args...)
+				if err == nil {
+					continue
+				}
+				if pingErr := p.ping(); pingErr == nil {
+					p.logger.Printf("WARNING: Postgres Integration could not INSERT value - %s\n", err.Error())
+					continue
+				}
+				p.logger.Printf("WARNING: Postgres logger %s lost DB connection - %s, will retry\n", l.Name, err.Error())
+				outage = true
+				retryDelay = initialRetryDelay
+				retryChan = time.After(retryDelay)
+			}
+			if p.BufferOutages && len(pending) < maxBuffered {
+				pending = append(pending, ins)
+			} else {
+				dropped++
 			}
 		}
 	}
@@ -0,0 +1,161 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package rateofchange
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
+)
+
+const (
+	configFilename = "/rateofchange.toml"
+	mqttPrefix     = "/rateofchange/"
+	trendSubtopic  = "/trend"
+)
+
+// Trends published when a Rate's thresholds are crossed
+const (
+	rising  = "rising"
+	falling = "falling"
+	steady  = "steady"
+)
+
+// RateOfChange encapsulates the type of this Integration
+type RateOfChange struct {
+	Rate    []rateT
+	mutex   sync.RWMutex
+	stopper safego.Stopper
+	mq      *mqtt.MQTT
+}
+
+type rateT struct {
+	Name    string
+	Topic   string
+	Key     string  // optional, JSON key of the value in the payload
+	MaxRise float64 // optional, a faster rise per minute is a "rising" trend
+	MaxFall float64 // optional, a faster fall per minute is a "falling" trend
+}
+
+// LoadConfig func should simply load any config (TOML) files for this Integration
+func (r *RateOfChange) LoadConfig(confdir string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	if err != nil {
+		log.Println("ERROR: Could not preprocess RateOfChange configuration ", err.Error())
+		return err
+	}
+	err = toml.Unmarshal(confBytes, r)
+	if err != nil {
+		log.Println("ERROR: Could not load RateOfChange configuration ", err.Error())
+		return err
+	}
+	for _, rt := range r.Rate {
+		if rt.Name == "" || rt.Topic == "" {
+			log.Println("ERROR: RateOfChange - every Rate must have a Name and Topic")
+			return errors.New("RateOfChange configuration error")
+		}
+		if rt.MaxRise < 0 || rt.MaxFall < 0 {
+			log.Printf("ERROR: RateOfChange - MaxRise and MaxFall must not be negative for %s\n", rt.Name)
+			return errors.New("RateOfChange configuration error")
+		}
+	}
+	log.Printf("INFO: RateOfChange Integration has %d Rates configured\n", len(r.Rate))
+	return nil
+}
+
+// Start func begins running the Integration GoRoutines and should return quickly
+func (r *RateOfChange) Start(mq *mqtt.MQTT) error {
+	r.mq = mq
+	for _, rt := range r.Rate {
+		rt := rt
+		r.stopper.Go("RateOfChange "+rt.Name, true, func(stopChan chan bool) { r.runRate(rt, stopChan) })
+	}
+	return nil
+}
+
+// Stop terminates the Integration and all Goroutines it contains
+func (r *RateOfChange) Stop() {
+	r.stopper.Stop()
+}
+
+func (r *RateOfChange) runRate(rt rateT, stopChan chan bool) {
+	ch := r.mq.SubscribeToTopic(rt.Topic)
+	defer r.mq.UnsubscribeFromTopic(rt.Topic, ch)
+	var (
+		prevValue float64
+		prevTime  time.Time
+		havePrev  bool
+		lastTrend = steady
+	)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg := <-ch:
+			value, err := mqtt.PayloadNumber(msg.Payload, rt.Key)
+			if err != nil {
+				log.Printf("WARNING: RateOfChange %s - %s\n", rt.Name, err.Error())
+				continue
+			}
+			now := time.Now()
+			if havePrev && now.After(prevTime) {
+				perMinute := (value - prevValue) / now.Sub(prevTime).Minutes()
+				r.mq.PublishChan <- mqtt.AghastMsgT{
+					Subtopic: mqttPrefix + rt.Name,
+					Qos:      0,
+					Retained: false,
+					Payload:  strconv.FormatFloat(perMinute, 'f', -1, 64),
+				}
+				if t := trend(rt, perMinute); t != lastTrend {
+					lastTrend = t
+					r.mq.PublishChan <- mqtt.AghastMsgT{
+						Subtopic: mqttPrefix + rt.Name + trendSubtopic,
+						Qos:      0,
+						Retained: false,
+						Payload:  t,
+					}
+				}
+			}
+			prevValue, prevTime, havePrev = value, now, true
+		}
+	}
+}
+
+// trend classifies a rate of change according to the Rate's thresholds
+func trend(rt rateT, perMinute float64) string {
+	switch {
+	case rt.MaxRise > 0 && perMinute > rt.MaxRise:
+		return rising
+	case rt.MaxFall > 0 && perMinute < -rt.MaxFall:
+		return falling
+	default:
+		return steady
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package rateofchange
+
+import "testing"
+
+func TestTrend(t *testing.T) {
+	rt := rateT{MaxRise: 0.5, MaxFall: 1.0}
+	tests := []struct {
+		perMinute float64
+		want      string
+	}{
+		{0, steady},
+		{0.5, steady},
+		{0.6, rising},
+		{-1.0, steady},
+		{-1.5, falling},
+	}
+	for _, tt := range tests {
+		if got := trend(rt, tt.perMinute); got != tt.want {
+			t.Errorf("trend(%v) = %s, expected %s", tt.perMinute, got, tt.want)
+		}
+	}
+	if got := trend(rateT{}, 100); got != steady {
+		t.Errorf("trend without thresholds = %s, expected %s", got, steady)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scenes
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/SMerrony/aghast/audit"
+	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/events"
+	"github.com/SMerrony/aghast/maintenance"
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/registry"
+	"github.com/SMerrony/aghast/safego"
+)
+
+const (
+	configFilename         = "/scenes.toml"
+	subscriberName         = "Scenes"
+	activateControl        = "activate"
+	activateTopicPrefix    = "aghast/scenes/activate/"
+	activateTopicPrefixLen = len(activateTopicPrefix)
+)
+
+// Scenes encapsulates the type of this Integration
+type Scenes struct {
+	Scene        []sceneT
+	scenesByName map[string]int
+	mutex        sync.RWMutex
+	stopper      safego.Stopper
+	cancel       context.CancelFunc // ends the event subscription
+	mq           *mqtt.MQTT
+}
+
+type sceneT struct {
+	Name string
+	Set  []setT
+}
+
+// setT is one element of a Scene, either a Control Action sent via the event bus,
+// or a message sent directly via MQTT
+type setT struct {
+	Integration string
+	Device      string
+	Control     string
+	Value       interface{}
+	Topic       string
+	Payload     string
+}
+
+// LoadConfig func should simply load any config (TOML) files for this Integration
+func (s *Scenes) LoadConfig(confdir string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	if err != nil {
+		log.Println("ERROR: Could not preprocess Scenes configuration ", err.Error())
+		return err
+	}
+	err = toml.Unmarshal(confBytes, s)
+	if err != nil {
+		log.Printf("ERROR: Could not load Scenes config due to %s\n", err.Error())
+		return err
+	}
+	s.scenesByName = make(map[string]int)
+	for ix, sc := range s.Scene {
+		if _, dup := s.scenesByName[sc.Name]; dup || sc.Name == "" {
+			log.Printf("ERROR: Scene names must be unique and not empty - '%s'\n", sc.Name)
+			return errors.New("Scenes configuration error")
+		}
+		for _, set := range sc.Set {
+			isAction := set.Integration != "" && set.Device != "" && set.Control != ""
+			if isAction == (set.Topic != "") {
+				log.Printf("ERROR: Each Set in Scene %s needs either Integration, Device and Control, or a Topic\n", sc.Name)
+				return errors.New("Scenes configuration error")
+			}
+		}
+		s.scenesByName[sc.Name] = ix
+	}
+	log.Printf("INFO: Scenes Integration has %d Scenes configured\n", len(s.Scene))
+	return nil
+}
+
+// Start func begins running the Integration GoRoutines and should return quickly
+func (s *Scenes) Start(mq *mqtt.MQTT) error {
+	s.mutex.Lock()
+	s.mq = mq
+	for _, sc := range s.Scene {
+		for _, set := range sc.Set {
+			if set.Integration == "" {
+				continue
+			}
+			// the Integration should have started first, so we can catch typos in the target now
+			if err := registry.Check(set.Integration, events.ActionControlDeviceType, set.Device); err != nil {
+				log.Printf("WARNING: Scene %s - %s\n", sc.Name, err.Error())
+			}
+		}
+	}
+	s.mutex.Unlock()
+	s.stopper.Go("Scenes MQTT monitor", true, s.monitorMqtt)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.stopper.Go("Scenes event monitor", true, func(stopChan chan bool) { s.monitorEvents(ctx, stopChan) })
+	return nil
+}
+
+// Stop terminates the Integration and all Goroutines it contains
+func (s *Scenes) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.stopper.Stop()
+}
+
+// ProvidesDeviceTypes lists the Scenes which may be activated via the event bus
+func (s *Scenes) ProvidesDeviceTypes() registry.Devices {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var names []string
+	for _, sc := range s.Scene {
+		names = append(names, sc.Name)
+	}
+	return registry.Devices{
+		Integration: subscriberName,
+		Labels:      map[string][]string{events.ActionControlDeviceType: names},
+	}
+}
+
+// activate performs every Set in the named Scene, in order
+func (s *Scenes) activate(name string, source string) {
+	s.mutex.RLock()
+	ix, found := s.scenesByName[name]
+	if !found {
+		s.mutex.RUnlock()
+		log.Printf("WARNING: Scenes asked to activate unknown Scene: %s\n", name)
+		audit.Record(source, subscriberName+"/"+name, activateControl, errors.New("unknown scene"))
+		return
+	}
+	scene := s.Scene[ix]
+	s.mutex.RUnlock()
+	if maintenance.Suppressed(source, subscriberName+"/"+name, activateControl) {
+		return
+	}
+	log.Printf("INFO: Activating Scene %s\n", name)
+	for _, set := range scene.Set {
+		if set.Topic != "" {
+			s.mq.ThirdPartyChan <- mqtt.GeneralMsgT{
+				Topic:    set.Topic,
+				Qos:      0,
+				Retained: false,
+				Payload:  set.Payload,
+			}
+			continue
+		}
+		events.Publish(events.EventT{
+			Name:  set.Integration + "/" + events.ActionControlDeviceType + "/" + set.Device + "/" + set.Control,
+			Value: set.Value,
+		})
+	}
+	audit.Record(source, subscriberName+"/"+name, activateControl, nil)
+}
+
+// monitorMqtt handles activation requests arriving via MQTT
+func (s *Scenes) monitorMqtt(stopChan chan bool) {
+	ch := s.mq.SubscribeToTopic(activateTopicPrefix + "+")
+	defer s.mq.UnsubscribeFromTopic(activateTopicPrefix+"+", ch)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg := <-ch:
+			if msg.Retained {
+				continue // a retained message is an old request, replayed when we subscribe, not a new one
+			}
+			s.activate(msg.Topic[activateTopicPrefixLen:], "client")
+		}
+	}
+}
+
+// monitorEvents handles activation requests arriving via the event bus
+func (s *Scenes) monitorEvents(ctx context.Context, stopChan chan bool) {
+	sid := events.GetSubscriberID(subscriberName)
+	evName := subscriberName + "/" + events.ActionControlDeviceType + "/+/" + activateControl
+	ch, err := events.Subscribe(ctx, sid, evName)
+	if err != nil {
+		log.Fatalf("ERROR: Scenes Integration could not subscribe to event - %v\n", err)
+	}
+	defer events.Unsubscribe(sid, evName)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return // cancelled
+			}
+			s.activate(ev.Field(events.EvDeviceName), "automation")
+		}
+	}
+}
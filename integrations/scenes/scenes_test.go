@@ -0,0 +1,71 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package scenes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SMerrony/aghast/events"
+	"github.com/SMerrony/aghast/mqtt/mqtttest"
+)
+
+func TestActivate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events.StartEventManager(ctx, false, 0)
+	b := mqtttest.NewBroker(t)
+	mq := mqtttest.Connect(t, b)
+	confDir := mqtttest.ConfigDir(t, map[string]string{
+		"scenes.toml": `[[Scene]]
+  Name = "Movie"
+  [[Scene.Set]]
+    Topic = "lounge/lamp/set"
+    Payload = "DIM"
+  [[Scene.Set]]
+    Topic = "lounge/blind/set"
+    Payload = "CLOSE"
+`,
+	})
+	s := &Scenes{}
+	if err := s.LoadConfig(confDir); err != nil {
+		t.Fatal(err)
+	}
+	sets := b.Watch("lounge/#")
+	// an old request, which must not be replayed when the Scenes subscribe
+	b.Publish("aghast/scenes/activate/Movie", []byte("go"), true)
+	s.Start(mq)
+	defer s.Stop()
+	b.WaitForSubscriber(t, "aghast/scenes/activate/+")
+
+	b.Publish("aghast/scenes/activate/Nosuch", []byte("go"), false)
+	b.Publish("aghast/scenes/activate/Movie", []byte("go"), false)
+	for _, want := range []struct{ topic, payload string }{{"lounge/lamp/set", "DIM"}, {"lounge/blind/set", "CLOSE"}} {
+		if msg := mqtttest.Receive(t, sets); msg.Topic != want.topic || string(msg.Payload) != want.payload {
+			t.Errorf("Scene sent %s to %s, expected %s to %s", msg.Payload, msg.Topic, want.payload, want.topic)
+		}
+	}
+	select {
+	case msg := <-sets:
+		t.Errorf("Scene activated again, sent %s to %s", msg.Payload, msg.Topic)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
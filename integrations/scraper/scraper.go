@@ -20,15 +20,20 @@
 package scraper
 
 import (
+	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/logging"
 	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
 	"github.com/gocolly/colly/v2"
 	"github.com/pelletier/go-toml"
 )
@@ -37,6 +42,7 @@ const (
 	configFilename = "/scraper.toml"
 	mqttPrefix     = "/scraper/"
 	subscriberName = "Scraper"
+	defaultTimeout = 10 * time.Second
 )
 
 // The Scraper type encapsulates the web scraper Integration.
@@ -45,25 +51,68 @@ type Scraper struct {
 	mutex          sync.RWMutex
 	Scrape         []scraperT
 	scrapersByName map[string]int
-	stopChans      []chan bool // used for stopping Goroutines
+	stopper        safego.Stopper // used for stopping Goroutines
+	availability   *mqtt.Availability
+	instance       string         // optional, see SetInstance
+	logger         logging.Logger // tags log lines with the instance, if any
 }
 
 type scraperT struct {
 	Name      string
 	URL       string
-	Interval  int
+	Interval  int    // seconds between scrapes
+	Every     string // optional readable alternative to Interval, eg. "5m"
+	Mode      string // Either "html" (the default) or "json"
 	Selector  string
 	Attribute string
 	Indices   []int
+	Keys      []string // dotted paths to values for "json" mode, eg. "sensors.0.temp"
 	Subtopics []string
+	// Selection allows values under several different Selectors to be scraped from one page fetch,
+	// the top-level Selector, Attribute, Indices and Subtopics (if given) become the first Selection
+	Selection []selectionT
 	// Factor    float64
-	Suffix       string
-	ValueType    string // One of "string", "integer", or "float"
+	Suffix    string
+	ValueType string // One of "string", "integer", or "float"
+	// PublishAlways causes every scraped value to be published, even if it is unchanged
+	PublishAlways bool
+	// Retained controls whether the Broker keeps the last published value, default is true
+	Retained     *bool
 	hasSuffix    bool
 	savedString  map[int]string
 	savedInteger map[int]int
 	savedFloat   map[int]float64
 	// hasFactor bool
+
+	// for sites which need a session, either post LoginFields to LoginURL, or send a fixed Cookie header
+	LoginURL    string
+	LoginFields map[string]string
+	Cookie      string
+
+	// MinPublishIntervalSecs limits publication of each value to once per interval, only the latest is sent
+	MinPublishIntervalSecs int
+	lastPublished          map[string]time.Time // by topic
+	pending                map[string]string    // latest unpublished value, by topic
+
+	// Timeout abandons a hung request so that the next scrape stays on schedule, default is 10s
+	Timeout string
+	// MaxConnsPerHost optionally limits the connections made to the site
+	MaxConnsPerHost int
+	timeout         time.Duration
+}
+
+type selectionT struct {
+	Selector  string
+	Attribute string
+	Indices   []int
+	Subtopics []string
+	base      int // saved values for this Selection are keyed from here
+}
+
+// SetInstance allows several Scrapers, each instance loads its own configuration file, eg. scraper-printers.toml
+func (s *Scraper) SetInstance(instance string) {
+	s.instance = instance
+	s.logger = logging.New(instance)
 }
 
 // LoadConfig loads and stores the configuration for this Integration
@@ -71,133 +120,337 @@ func (s *Scraper) LoadConfig(confdir string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	confBytes, err := config.PreprocessTOML(confdir, config.InstanceConfigFilename(configFilename, s.instance))
 	if err != nil {
-		log.Println("ERROR: Could not preprocess Scraper configuration ", err.Error())
+		s.logger.Println("ERROR: Could not preprocess Scraper configuration ", err.Error())
 		return err
 	}
 	err = toml.Unmarshal(confBytes, s)
 	if err != nil {
-		log.Fatalf("ERROR: Could not load Scraper config due to %s\n", err.Error())
+		s.logger.Fatalf("ERROR: Could not load Scraper config due to %s\n", err.Error())
 		s.mutex.Unlock()
 		return err
 	}
 	for i, sc := range s.Scrape {
-		numIx := len(sc.Indices)
-		numSubs := len(sc.Subtopics)
-		if numIx != numSubs {
-			log.Printf("WARNING: Scraper - # Indices <> # Subtopics in %s\n", sc.Name)
+		var numIx int
+		switch sc.Mode {
+		case "", "html":
+			if sc.Selector != "" {
+				top := selectionT{Selector: sc.Selector, Attribute: sc.Attribute, Indices: sc.Indices, Subtopics: sc.Subtopics}
+				sc.Selection = append([]selectionT{top}, sc.Selection...)
+			}
+			if len(sc.Selection) == 0 {
+				s.logger.Printf("WARNING: Scraper - no Selector in %s\n", sc.Name)
+				return errors.New("Scraper configuration error")
+			}
+			for j, sel := range sc.Selection {
+				if len(sel.Indices) != len(sel.Subtopics) {
+					s.logger.Printf("WARNING: Scraper - # Indices <> # Subtopics in %s\n", sc.Name)
+					return errors.New("Scraper configuration error")
+				}
+				sc.Selection[j].base = numIx
+				numIx += len(sel.Indices)
+			}
+		case "json":
+			numIx = len(sc.Keys)
+			if numIx != len(sc.Subtopics) {
+				s.logger.Printf("WARNING: Scraper - # Keys <> # Subtopics in %s\n", sc.Name)
+				return errors.New("Scraper configuration error")
+			}
+		default:
+			s.logger.Printf("WARNING: Scraper - unknown Mode '%s' in %s\n", sc.Mode, sc.Name)
+			return errors.New("Scraper configuration error")
+		}
+		if sc.Interval, err = config.DurationSecs(sc.Every, sc.Interval); err != nil {
+			s.logger.Printf("WARNING: Scraper - %s in %s\n", err.Error(), sc.Name)
 			return errors.New("Scraper configuration error")
 		}
+		sc.timeout = defaultTimeout
+		if sc.Timeout != "" {
+			if sc.timeout, err = config.ParseDuration(sc.Timeout); err != nil || sc.timeout <= 0 {
+				s.logger.Printf("WARNING: Scraper - invalid Timeout '%s' in %s\n", sc.Timeout, sc.Name)
+				return errors.New("Scraper configuration error")
+			}
+		}
+		if sc.timeout >= time.Duration(sc.Interval)*time.Second {
+			s.logger.Printf("WARNING: Scraper - Timeout is not shorter than the Interval in %s, scrapes may be missed\n", sc.Name)
+		}
+		if sc.LoginURL != "" {
+			if _, err := url.Parse(sc.LoginURL); err != nil {
+				s.logger.Printf("WARNING: Scraper - invalid LoginURL in %s\n", sc.Name)
+				return errors.New("Scraper configuration error")
+			}
+		} else if len(sc.LoginFields) > 0 {
+			s.logger.Printf("WARNING: Scraper - LoginFields given without LoginURL in %s\n", sc.Name)
+			return errors.New("Scraper configuration error")
+		}
+		if sc.Retained == nil {
+			retained := true // *** Yes, in this case retention makes sense! ***
+			sc.Retained = &retained
+		}
 		sc.savedFloat = make(map[int]float64, numIx)
 		sc.savedInteger = make(map[int]int, numIx)
 		sc.savedString = make(map[int]string, numIx)
+		sc.lastPublished = make(map[string]time.Time, numIx)
+		sc.pending = make(map[string]string, numIx)
 		s.Scrape[i] = sc
 	}
 	s.scrapersByName = make(map[string]int)
 	for i, sc := range s.Scrape {
 		s.scrapersByName[sc.Name] = i
 	}
-	log.Printf("INFO: Scraper has %d scrapers configured\n", len(s.Scrape))
+	s.logger.Printf("INFO: Scraper has %d scrapers configured\n", len(s.Scrape))
 	return nil
 }
 
 // Start launches the Integration, LoadConfig() should have been called beforehand.
-func (s *Scraper) Start(mq *mqtt.MQTT) {
+func (s *Scraper) Start(mq *mqtt.MQTT) error {
 	s.mq = mq
+	s.availability = mqtt.NewAvailability(mqttPrefix)
 	for _, sc := range s.Scrape {
-		go s.runScraper(sc)
+		sc := sc
+		s.stopper.Go("Scraper "+sc.Name, true, func(stopChan chan bool) { s.runScraper(sc, stopChan) })
 	}
-	log.Printf("INFO: Scraper has started %d scraper(s)\n", len(s.Scrape))
-}
-
-func (s *Scraper) addStopChan() (ix int) {
-	s.mutex.Lock()
-	s.stopChans = append(s.stopChans, make(chan bool))
-	ix = len(s.stopChans) - 1
-	s.mutex.Unlock()
-	return ix
+	s.logger.Printf("INFO: Scraper has started %d scraper(s)\n", len(s.Scrape))
+	return nil
 }
 
 // Stop terminates the Integration and all Goroutines it contains
 func (s *Scraper) Stop() {
-	for _, ch := range s.stopChans {
-		ch <- true
+	if s.stopper.Stop() {
+		s.logger.Println("DEBUG: Scraper - All Goroutines have stopped")
 	}
-	log.Println("DEBUG: Scraper - All Goroutines should have stopped")
 }
 
-func (s *Scraper) runScraper(scr scraperT) {
-	log.Printf("DEBUG: Scraper - starting %v\n", scr)
+func (s *Scraper) runScraper(scr scraperT, stopChan chan bool) {
+	s.logger.Printf("DEBUG: Scraper - starting %v\n", scr)
 	c := colly.NewCollector()
-	// for _, d := range scr.Details {
-	c.OnHTML("body", func(e *colly.HTMLElement) {
-		e.ForEach(scr.Selector, func(ix int, el *colly.HTMLElement) {
-			a := el.Attr(scr.Attribute)
-			// if _, wanted := scr.Indices[ix]; wanted {
-			wanted := false
-			for ind := range scr.Indices {
-				if ind == ix {
-					wanted = true
-				}
+	c.AllowURLRevisit = true
+	c.SetRequestTimeout(scr.timeout)
+	if scr.MaxConnsPerHost > 0 {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxConnsPerHost = scr.MaxConnsPerHost
+		c.WithTransport(transport)
+	}
+	if scr.Cookie != "" {
+		c.OnRequest(func(r *colly.Request) {
+			r.Headers.Set("Cookie", scr.Cookie)
+		})
+	}
+	// sessionExpired is set if a visit is refused, or redirected to the login page
+	sessionExpired := false
+	if scr.LoginURL != "" {
+		loginURL, _ := url.Parse(scr.LoginURL)
+		c.OnResponse(func(r *colly.Response) {
+			sessionExpired = r.Request.URL.Host == loginURL.Host && r.Request.URL.Path == loginURL.Path
+		})
+		c.OnError(func(r *colly.Response, err error) {
+			sessionExpired = r.StatusCode == http.StatusUnauthorized || r.StatusCode == http.StatusForbidden
+		})
+	}
+	switch scr.Mode {
+	case "json":
+		c.OnResponse(func(r *colly.Response) {
+			if sessionExpired {
+				return
 			}
-			if wanted {
-				// log.Printf("DEBUG: Scraper found Selector %s, index %d, attribute %s\n", scr.Selector, ix, a)
-				if len(scr.Suffix) > 0 {
-					a = strings.TrimSuffix(a, scr.Suffix)
-				}
-				// if scr.hasFactor {
-
-				// }
-				s.mutex.Lock()
-				switch scr.ValueType {
-				case "float":
-					floatVal, err := strconv.ParseFloat(a, 64)
-					if err != nil {
-						log.Printf("WARNING: Scraper could not convert value '%s' to float, ignoring\n", a)
-					} else {
-						scr.savedFloat[ix] = floatVal
-					}
-				case "integer":
-					intVal, err := strconv.ParseInt(a, 10, 0)
-					if err != nil {
-						log.Printf("WARNING: Scraper could not convert value '%s' to integer, ignoring\n", a)
-					} else {
-						// log.Printf("DEBUG: Scraper ix: %d in scraper %s\n", ix, scr.Name)
-						scr.savedInteger[ix] = int(intVal)
+			s.extractJSON(scr, r.Body)
+		})
+	default:
+		c.OnHTML("body", func(e *colly.HTMLElement) {
+			if sessionExpired {
+				return
+			}
+			for _, sel := range scr.Selection {
+				sel := sel
+				e.ForEach(sel.Selector, func(ix int, el *colly.HTMLElement) {
+					for p, wanted := range sel.Indices {
+						if wanted == ix {
+							a := el.Attr(sel.Attribute)
+							// log.Printf("DEBUG: Scraper found Selector %s, index %d, attribute %s\n", sel.Selector, ix, a)
+							s.saveAndPublish(scr, sel.base+p, sel.Subtopics[p], a)
+						}
 					}
-				case "string":
-					scr.savedString[ix] = a
-				}
-				t := mqttPrefix + scr.Name + "/" + scr.Subtopics[scr.Indices[ix]]
-				s.mutex.Unlock()
-				// log.Printf("DEBUG: ... would publish %s to topic %s\n", a, t)
-				s.mq.PublishChan <- mqtt.AghastMsgT{
-					Subtopic: t,
-					Qos:      0,
-					Retained: true, // *** Yes, in this case retention makes sense! ***
-					Payload:  a,
-				}
+				})
 			}
 		})
-	})
-	// }
-	sc := s.addStopChan()
+	}
 	s.mutex.RLock()
-	stopChan := s.stopChans[sc]
 	interval := scr.Interval
 	s.mutex.RUnlock()
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
 
+	if scr.LoginURL != "" {
+		s.login(c, scr)
+	}
+	var flush <-chan time.Time
+	if scr.MinPublishIntervalSecs > 0 {
+		flushTicker := time.NewTicker(time.Second)
+		defer flushTicker.Stop()
+		flush = flushTicker.C
+	}
 	for {
-		c.Visit(scr.URL)
+		err := c.Visit(scr.URL)
 		// log.Println("DEBUG: Scraped finished Visit()")
-		select {
-		case <-stopChan:
-			return
-		case <-ticker.C:
+		if sessionExpired {
+			s.logger.Printf("INFO: Scraper %s session has expired, logging in again\n", scr.Name)
+			s.login(c, scr)
+			err = c.Visit(scr.URL)
+		}
+		s.availability.Set(s.mq, scr.Name, err == nil)
+	waiting:
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-ticker.C:
+				break waiting
+			case <-flush:
+				s.flushPending(scr)
+			}
+		}
+	}
+}
+
+// login posts the LoginFields to the LoginURL, the session cookie(s) are kept in the collector's cookie jar
+func (s *Scraper) login(c *colly.Collector, scr scraperT) {
+	// a clone shares the cookie jar but not the scraping callbacks
+	if err := c.Clone().Post(scr.LoginURL, scr.LoginFields); err != nil {
+		s.logger.Printf("WARNING: Scraper %s could not log in - %v\n", scr.Name, err)
+	}
+}
+
+// extractJSON finds each of the configured Keys in a JSON response and publishes their values
+func (s *Scraper) extractJSON(scr scraperT, body []byte) {
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		s.logger.Printf("WARNING: Scraper %s could not understand JSON response - %v\n", scr.Name, err)
+		return
+	}
+	for ix, key := range scr.Keys {
+		v, found := lookupKey(data, key)
+		if !found {
+			s.logger.Printf("WARNING: Scraper %s could not find Key '%s' in JSON response\n", scr.Name, key)
 			continue
 		}
+		var a string
+		switch v := v.(type) {
+		case string:
+			a = v
+		case float64:
+			a = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			a = fmt.Sprintf("%v", v)
+		}
+		s.saveAndPublish(scr, ix, scr.Subtopics[ix], a)
+	}
+}
+
+// lookupKey follows a dotted path such as "sensors.0.temp" through decoded JSON,
+// numeric elements are used as array indices.
+func lookupKey(data interface{}, key string) (interface{}, bool) {
+	for _, elem := range strings.Split(key, ".") {
+		switch d := data.(type) {
+		case map[string]interface{}:
+			v, found := d[elem]
+			if !found {
+				return nil, false
+			}
+			data = v
+		case []interface{}:
+			ix, err := strconv.Atoi(elem)
+			if err != nil || ix < 0 || ix >= len(d) {
+				return nil, false
+			}
+			data = d[ix]
+		default:
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// saveAndPublish stores a typed copy of a scraped value and publishes it if it has changed
+// (or PublishAlways is set)
+func (s *Scraper) saveAndPublish(scr scraperT, ix int, subtopic string, a string) {
+	if len(scr.Suffix) > 0 {
+		a = strings.TrimSuffix(a, scr.Suffix)
+	}
+	// if scr.hasFactor {
+
+	// }
+	changed := true
+	s.mutex.Lock()
+	switch scr.ValueType {
+	case "float":
+		floatVal, err := strconv.ParseFloat(a, 64)
+		if err != nil {
+			s.logger.Printf("WARNING: Scraper could not convert value '%s' to float, ignoring\n", a)
+		} else {
+			prev, seen := scr.savedFloat[ix]
+			changed = !seen || prev != floatVal
+			scr.savedFloat[ix] = floatVal
+		}
+	case "integer":
+		intVal, err := strconv.ParseInt(a, 10, 0)
+		if err != nil {
+			s.logger.Printf("WARNING: Scraper could not convert value '%s' to integer, ignoring\n", a)
+		} else {
+			// log.Printf("DEBUG: Scraper ix: %d in scraper %s\n", ix, scr.Name)
+			prev, seen := scr.savedInteger[ix]
+			changed = !seen || prev != int(intVal)
+			scr.savedInteger[ix] = int(intVal)
+		}
+	case "string":
+		prev, seen := scr.savedString[ix]
+		changed = !seen || prev != a
+		scr.savedString[ix] = a
+	}
+	t := mqttPrefix + scr.Name + "/" + subtopic
+	s.mutex.Unlock()
+	if !changed && !scr.PublishAlways {
+		return
+	}
+	if scr.MinPublishIntervalSecs > 0 {
+		s.mutex.Lock()
+		if time.Since(scr.lastPublished[t]) < time.Duration(scr.MinPublishIntervalSecs)*time.Second {
+			scr.pending[t] = a // flushPending will send it, unless it is superseded first
+			s.mutex.Unlock()
+			return
+		}
+		scr.lastPublished[t] = time.Now()
+		delete(scr.pending, t)
+		s.mutex.Unlock()
+	}
+	s.publish(scr, t, a)
+}
+
+// flushPending publishes any throttled values whose MinPublishIntervalSecs has passed
+func (s *Scraper) flushPending(scr scraperT) {
+	minInterval := time.Duration(scr.MinPublishIntervalSecs) * time.Second
+	due := make(map[string]string)
+	s.mutex.Lock()
+	for t, a := range scr.pending {
+		if time.Since(scr.lastPublished[t]) >= minInterval {
+			due[t] = a
+			scr.lastPublished[t] = time.Now()
+			delete(scr.pending, t)
+		}
+	}
+	s.mutex.Unlock()
+	for t, a := range due {
+		s.publish(scr, t, a)
+	}
+}
+
+func (s *Scraper) publish(scr scraperT, t string, a string) {
+	// log.Printf("DEBUG: ... would publish %s to topic %s\n", a, t)
+	s.mq.PublishChan <- mqtt.AghastMsgT{
+		Subtopic: t,
+		Qos:      0,
+		Retained: *scr.Retained,
+		Payload:  a,
 	}
 }
 
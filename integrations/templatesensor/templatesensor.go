@@ -0,0 +1,212 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package templatesensor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	"github.com/pelletier/go-toml"
+
+	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
+)
+
+const (
+	configFilename = "/template.toml"
+	mqttPrefix     = "/template/"
+)
+
+// TemplateSensor encapsulates the type of this Integration
+type TemplateSensor struct {
+	Template []templateT
+	mutex    sync.RWMutex
+	stopper  safego.Stopper
+	mq       *mqtt.MQTT
+}
+
+type templateT struct {
+	Name       string
+	Expression string
+	Interval   int    // seconds between publications, 0 means publish whenever an input changes
+	Every      string // optional readable alternative to Interval, eg. "5m"
+	Input      []inputT
+	expr       *govaluate.EvaluableExpression
+}
+
+type inputT struct {
+	Name  string // the variable name used in the Expression
+	Topic string
+	Key   string // optional JSON key of the value
+}
+
+// LoadConfig func should simply load any config (TOML) files for this Integration
+func (t *TemplateSensor) LoadConfig(confdir string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	if err != nil {
+		log.Printf("ERROR: Could not read Template config due to %s\n", err.Error())
+		return err
+	}
+	err = toml.Unmarshal(confBytes, t)
+	if err != nil {
+		log.Printf("ERROR: Could not load Template config due to %s\n", err.Error())
+		return err
+	}
+	for i, tmpl := range t.Template {
+		if len(tmpl.Input) == 0 {
+			log.Printf("ERROR: Template %s has no Inputs\n", tmpl.Name)
+			return errors.New("Template configuration error")
+		}
+		if t.Template[i].Interval, err = config.DurationSecs(tmpl.Every, tmpl.Interval); err != nil {
+			log.Printf("ERROR: Template %s - %s\n", tmpl.Name, err.Error())
+			return errors.New("Template configuration error")
+		}
+		t.Template[i].expr, err = govaluate.NewEvaluableExpression(tmpl.Expression)
+		if err != nil {
+			log.Printf("ERROR: Template %s has an invalid Expression - %s\n", tmpl.Name, err.Error())
+			return err
+		}
+	}
+	log.Printf("INFO: Template Integration has %d Templates configured\n", len(t.Template))
+	return nil
+}
+
+// Start func begins running the Integration GoRoutines and should return quickly
+func (t *TemplateSensor) Start(mq *mqtt.MQTT) error {
+	t.mq = mq
+	for _, tmpl := range t.Template {
+		tmpl := tmpl
+		t.stopper.Go("Template "+tmpl.Name, true, func(stopChan chan bool) { t.runTemplate(tmpl, stopChan) })
+	}
+	return nil
+}
+
+// Stop terminates the Integration and all Goroutines it contains
+func (t *TemplateSensor) Stop() {
+	t.stopper.Stop()
+}
+
+func (t *TemplateSensor) runTemplate(tmpl templateT, stopChan chan bool) {
+	// several inputs may use the same topic, so we only subscribe once to each
+	inputsByTopic := make(map[string][]inputT)
+	for _, in := range tmpl.Input {
+		inputsByTopic[in.Topic] = append(inputsByTopic[in.Topic], in)
+	}
+	ch := make(chan mqtt.GeneralMsgT, len(inputsByTopic))
+	for topic := range inputsByTopic {
+		t.mq.SubscribeToTopicUsingChan(topic, ch)
+		defer t.mq.UnsubscribeFromTopic(topic, ch)
+	}
+	var tick <-chan time.Time
+	if tmpl.Interval > 0 {
+		ticker := time.NewTicker(time.Duration(tmpl.Interval) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	values := make(map[string]interface{})
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-tick:
+			t.evaluateAndPublish(tmpl, values)
+		case msg := <-ch:
+			for _, in := range matchingInputs(inputsByTopic, msg.Topic) {
+				v, err := inputValue(in, msg.Payload)
+				if err != nil {
+					log.Printf("WARNING: Template %s could not get value for %s - %s\n", tmpl.Name, in.Name, err.Error())
+					continue
+				}
+				values[in.Name] = v
+			}
+			if tmpl.Interval == 0 {
+				t.evaluateAndPublish(tmpl, values)
+			}
+		}
+	}
+}
+
+// matchingInputs returns the inputs whose Topic, which may contain wildcards, matches the topic of a message
+func matchingInputs(inputsByTopic map[string][]inputT, topic string) (matched []inputT) {
+	for filter, inputs := range inputsByTopic {
+		if mqtt.TopicMatches(topic, filter) {
+			matched = append(matched, inputs...)
+		}
+	}
+	return matched
+}
+
+// inputValue extracts the value for an input from an MQTT payload, numbers are converted to float64
+func inputValue(in inputT, payload interface{}) (interface{}, error) {
+	raw, ok := mqtt.PayloadBytes(payload)
+	if !ok {
+		return nil, fmt.Errorf("unexpected payload type %T", payload)
+	}
+	if in.Key == "" {
+		if fl, err := strconv.ParseFloat(string(raw), 64); err == nil {
+			return fl, nil
+		}
+		return string(raw), nil
+	}
+	jsonMap := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &jsonMap); err != nil {
+		return nil, err
+	}
+	v, found := jsonMap[in.Key]
+	if !found {
+		return nil, errors.New("key not found: " + in.Key)
+	}
+	return v, nil
+}
+
+func (t *TemplateSensor) evaluateAndPublish(tmpl templateT, values map[string]interface{}) {
+	for _, in := range tmpl.Input {
+		if _, ok := values[in.Name]; !ok {
+			return // not all inputs have arrived yet
+		}
+	}
+	result, err := tmpl.expr.Evaluate(values)
+	if err != nil {
+		log.Printf("WARNING: Template %s could not evaluate Expression - %s\n", tmpl.Name, err.Error())
+		return
+	}
+	var payload string
+	switch r := result.(type) {
+	case float64:
+		payload = strconv.FormatFloat(r, 'f', -1, 64)
+	default:
+		payload = fmt.Sprintf("%v", r)
+	}
+	t.mq.PublishChan <- mqtt.AghastMsgT{
+		Subtopic: mqttPrefix + tmpl.Name,
+		Qos:      0,
+		Retained: true,
+		Payload:  payload,
+	}
+}
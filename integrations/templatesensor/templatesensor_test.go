@@ -0,0 +1,123 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package templatesensor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SMerrony/aghast/mqtt/mqtttest"
+)
+
+func TestMatchingInputs(t *testing.T) {
+	inputsByTopic := map[string][]inputT{
+		"sensors/kitchen/temp": {{Name: "kitchen"}},
+		"sensors/+/humidity":   {{Name: "humidity"}},
+		"meters/#":             {{Name: "meters"}, {Name: "power"}},
+	}
+	tests := []struct {
+		topic string
+		want  int
+	}{
+		{"sensors/kitchen/temp", 1},
+		{"sensors/lounge/temp", 0},
+		{"sensors/lounge/humidity", 1},
+		{"meters/main/power", 2},
+		{"other", 0},
+	}
+	for _, tt := range tests {
+		if got := matchingInputs(inputsByTopic, tt.topic); len(got) != tt.want {
+			t.Errorf("matchingInputs(%s) matched %d inputs, expected %d", tt.topic, len(got), tt.want)
+		}
+	}
+}
+
+func TestTemplatePublishes(t *testing.T) {
+	b := mqtttest.NewBroker(t)
+	mq := mqtttest.Connect(t, b)
+	confDir := mqtttest.ConfigDir(t, map[string]string{
+		"template.toml": `[[Template]]
+  Name = "Total"
+  Expression = "house + garage"
+  [[Template.Input]]
+    Name = "house"
+    Topic = "meters/house"
+  [[Template.Input]]
+    Name = "garage"
+    Topic = "meters/garage"
+    Key = "power"
+
+[[Template]]
+  Name = "Double"
+  Expression = "level * 2"
+  Interval = 1
+  [[Template.Input]]
+    Name = "level"
+    Topic = "sensors/+/level"
+`,
+	})
+	ts := &TemplateSensor{}
+	if err := ts.LoadConfig(confDir); err != nil {
+		t.Fatal(err)
+	}
+	totals, doubles := b.Watch("aghast/template/Total"), b.Watch("aghast/template/Double")
+	ts.Start(mq)
+	defer ts.Stop()
+	for _, topic := range []string{"meters/house", "meters/garage", "sensors/+/level"} {
+		b.WaitForSubscriber(t, topic)
+	}
+
+	// nothing is published until every input has a value, a payload without the Key gives no value
+	b.Publish("meters/house", []byte("100"), false)
+	b.Publish("meters/garage", []byte(`{"voltage": 240}`), false)
+	b.Publish("meters/garage", []byte(`{"power": 50.5}`), false)
+	if msg := mqtttest.Receive(t, totals); string(msg.Payload) != "150.5" || !msg.Retained {
+		t.Errorf("Total published %s (retained %v), expected retained 150.5", msg.Payload, msg.Retained)
+	}
+	// each change is published
+	b.Publish("meters/house", []byte("200"), false)
+	if msg := mqtttest.Receive(t, totals); string(msg.Payload) != "250.5" {
+		t.Errorf("Total published %s after an input changed, expected 250.5", msg.Payload)
+	}
+
+	// a non-numeric value cannot be doubled, so nothing is published until a number arrives and the ticker fires
+	b.Publish("sensors/attic/level", []byte("unknown"), false)
+	select {
+	case msg := <-doubles:
+		t.Errorf("Double published %s for a non-numeric input", msg.Payload)
+	case <-time.After(1500 * time.Millisecond):
+	}
+	b.Publish("sensors/attic/level", []byte("21"), false)
+	if msg := mqtttest.Receive(t, doubles); string(msg.Payload) != "42" {
+		t.Errorf("Double published %s, expected 42", msg.Payload)
+	}
+	select {
+	case msg := <-totals:
+		t.Errorf("Total published %s without an input changing", msg.Payload)
+	default:
+	}
+}
+
+func TestLoadMissingConfig(t *testing.T) {
+	ts := &TemplateSensor{}
+	if err := ts.LoadConfig(mqtttest.ConfigDir(t, nil)); err == nil {
+		t.Error("LoadConfig did not return an error for a missing configuration file")
+	}
+}
@@ -28,6 +28,7 @@ import (
 
 	"github.com/SMerrony/aghast/config"
 	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
 	"github.com/nathan-osman/go-sunrise"
 	"github.com/pelletier/go-toml"
 )
@@ -49,14 +50,15 @@ type Time struct {
 	Latitude, Longitude float64
 	Alert               []timeEventT            `toml:"Event"`
 	alertsByTime        map[string][]timeEventT // indexed by "hh:mm:ss"
-	stopChans           []chan bool             // used for stopping Goroutines
+	stopper             safego.Stopper          // used for stopping Goroutines
 }
 
 type timeEventT struct {
 	Name       string
 	Hhmmss     string `toml:"Time"`
-	Daily      string // "Sunrise" or "Sunset"
+	Daily      string // "Sunrise", "Sunset", or "Both"
 	OffsetMins int64
+	Offset     string // optional readable alternative to OffsetMins, eg. "-30m" or "1h15m"
 }
 
 // LoadConfig is required to satisfy the Integration interface.
@@ -78,46 +80,57 @@ func (t *Time) LoadConfig(confdir string) error {
 
 	t.alertsByTime = make(map[string][]timeEventT)
 	for _, ev := range t.Alert {
-		var te timeEventT
-		te.Name = ev.Name
-		var hhmmss string
 		if len(ev.Hhmmss) > 0 {
-			hhmmss = ev.Hhmmss
-			_, _, _, err := getHhmmssFromString(hhmmss)
+			// an explicit Time takes precedence
+			if len(ev.Daily) > 0 {
+				log.Printf("WARNING: Time Integration event %s has both Time and Daily set, Daily will be ignored\n", ev.Name)
+			}
+			_, _, _, err := getHhmmssFromString(ev.Hhmmss)
 			if err != nil {
 				log.Fatalf("ERROR: Time Integration could not parse time for event %s  - %v\n", ev.Name, err)
 			}
-		} else {
-			if len(ev.Daily) > 0 {
-				// For sunrise/sunset we get the next time and use that for the event
-				// Time Integration is reloaded every day to update offsets
-				var nextTime time.Time
-				offset := time.Minute * time.Duration(ev.OffsetMins)
-				sunrise, sunset := sunrise.SunriseSunset(t.Latitude, t.Longitude,
-					time.Now().Year(), time.Now().Month(), time.Now().Day())
-				// log.Printf("DEBUG: Time - %f, %f, %d / %d / %d\n", t.Latitude, t.Longitude,
-				// 	time.Now().Year(), time.Now().Month(), time.Now().Day())
-				// log.Printf("DEBUG: Time - Sunrise: %s, Sunset: %s\n", sunrise.Format("15:04:05"), sunset.Format("15:04:05"))
-				switch ev.Daily {
-				case "Sunrise":
-					nextTime = sunrise.Add(offset).Local()
-				case "Sunset":
-					nextTime = sunset.Add(offset).Local()
-				default:
-					log.Fatalf("ERROR: Time Integration configuration for %s\n", ev.Name)
-				}
-				hhmmss = nextTime.Format("15:04:05")
-			} else {
-				log.Fatalf("ERROR: Time Integration configuration for %s\n", ev.Name)
+			t.addAlert(ev.Name, ev.Hhmmss)
+			continue
+		}
+		if ev.Offset != "" {
+			offset, err := config.ParseDuration(ev.Offset)
+			if err != nil {
+				log.Fatalf("ERROR: Time Integration could not parse Offset for event %s - %v\n", ev.Name, err)
 			}
+			ev.OffsetMins = int64(offset / time.Minute)
+		}
+		// For sunrise/sunset we get the next time and use that for the event
+		// Time Integration is reloaded every day to update offsets
+		switch ev.Daily {
+		case "Sunrise", "Sunset":
+			t.addAlert(ev.Name, t.dailyTime(ev.Daily, ev.OffsetMins))
+		case "Both":
+			t.addAlert(ev.Name+"Sunrise", t.dailyTime("Sunrise", ev.OffsetMins))
+			t.addAlert(ev.Name+"Sunset", t.dailyTime("Sunset", ev.OffsetMins))
+		default:
+			log.Fatalf("ERROR: Time Integration configuration for %s\n", ev.Name)
 		}
-		te.Hhmmss = hhmmss
-		t.alertsByTime[hhmmss] = append(t.alertsByTime[hhmmss], te)
-		log.Printf("INFO: Timer Event %s set for %s\n", te.Name, te.Hhmmss)
 	}
 	return nil
 }
 
+func (t *Time) addAlert(name, hhmmss string) {
+	t.alertsByTime[hhmmss] = append(t.alertsByTime[hhmmss], timeEventT{Name: name, Hhmmss: hhmmss})
+	log.Printf("INFO: Timer Event %s set for %s\n", name, hhmmss)
+}
+
+// dailyTime returns today's "Sunrise" or "Sunset" time plus offsetMins as "hh:mm:ss"
+func (t *Time) dailyTime(daily string, offsetMins int64) string {
+	offset := time.Minute * time.Duration(offsetMins)
+	sunrise, sunset := sunrise.SunriseSunset(t.Latitude, t.Longitude,
+		time.Now().Year(), time.Now().Month(), time.Now().Day())
+	// log.Printf("DEBUG: Time - Sunrise: %s, Sunset: %s\n", sunrise.Format("15:04:05"), sunset.Format("15:04:05"))
+	if daily == "Sunrise" {
+		return sunrise.Add(offset).Local().Format(tomlTimeFmt)
+	}
+	return sunset.Add(offset).Local().Format(tomlTimeFmt)
+}
+
 func getHhmmssFromString(Hhmmss string) (hh, mm, ss int, e error) {
 	t := strings.Split(Hhmmss, ":")
 	hh, e = strconv.Atoi(t[0])
@@ -136,30 +149,21 @@ func getHhmmssFromString(Hhmmss string) (hh, mm, ss int, e error) {
 }
 
 // Start any services this Integration provides.
-func (t *Time) Start(mq *mqtt.MQTT) {
+func (t *Time) Start(mq *mqtt.MQTT) error {
 	t.mq = mq
-	go t.tickers()
-	go t.timeEvents()
-}
-
-func (t *Time) addStopChan() chan bool {
-	newChan := make(chan bool)
-	t.mutex.Lock()
-	t.stopChans = append(t.stopChans, newChan)
-	t.mutex.Unlock()
-	return newChan
+	t.stopper.Go("Time tickers", false, t.tickers)
+	t.stopper.Go("Time events", false, t.timeEvents)
+	return nil
 }
 
 // Stop terminates the Integration and all Goroutines it contains
 func (t *Time) Stop() {
-	for _, ch := range t.stopChans {
-		ch <- true
+	if t.stopper.Stop() {
+		log.Println("WARNING: Time - All Goroutines have stopped")
 	}
-	log.Println("WARNING: Time - All Goroutines are stopping")
 }
 
-func (t *Time) timeEvents() {
-	stopChan := t.addStopChan()
+func (t *Time) timeEvents(stopChan chan bool) {
 	secs := time.NewTicker(time.Second)
 	for {
 		select {
@@ -182,11 +186,10 @@ func (t *Time) timeEvents() {
 	}
 }
 
-func (t *Time) tickers() {
+func (t *Time) tickers(stopChan chan bool) {
 	lastMinute := time.Now().Minute()
 	lastHour := time.Now().Hour()
 	lastDay := time.Now().Day()
-	stopChan := t.addStopChan()
 	secs := time.NewTicker(time.Second)
 	for {
 		select {
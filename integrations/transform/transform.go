@@ -0,0 +1,207 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package transform
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/safego"
+)
+
+const (
+	configFilename = "/transform.toml"
+	mqttPrefix     = "/transform/"
+)
+
+// Transform encapsulates the type of this Integration
+type Transform struct {
+	Transform []transformT
+	mutex     sync.RWMutex
+	stopper   safego.Stopper
+	mq        *mqtt.MQTT
+}
+
+type transformT struct {
+	Name        string
+	InputTopic  string
+	OutputTopic string // optional, the default is aghast/transform/<Name>
+	Retained    bool
+	Field       []fieldT
+}
+
+type fieldT struct {
+	From   string  // dotted path into the input JSON, eg. "sensor.temp" or "readings.0"
+	To     string  // key in the output JSON
+	Scale  float64 // optional multiplier for numeric values
+	Offset float64 // optional addition to numeric values, applied after Scale
+}
+
+// LoadConfig func should simply load any config (TOML) files for this Integration
+func (t *Transform) LoadConfig(confdir string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	if err != nil {
+		log.Printf("ERROR: Could not read Transform config due to %s\n", err.Error())
+		return err
+	}
+	err = toml.Unmarshal(confBytes, t)
+	if err != nil {
+		log.Printf("ERROR: Could not load Transform config due to %s\n", err.Error())
+		return err
+	}
+	for _, tr := range t.Transform {
+		if tr.Name == "" || tr.InputTopic == "" {
+			log.Println("ERROR: Transform - every Transform must have a Name and InputTopic")
+			return errors.New("Transform configuration error")
+		}
+		if len(tr.Field) == 0 {
+			log.Printf("ERROR: Transform %s has no Fields\n", tr.Name)
+			return errors.New("Transform configuration error")
+		}
+		for _, f := range tr.Field {
+			if f.From == "" || f.To == "" {
+				log.Printf("ERROR: Transform %s has a Field without From or To\n", tr.Name)
+				return errors.New("Transform configuration error")
+			}
+		}
+	}
+	log.Printf("INFO: Transform Integration has %d Transforms configured\n", len(t.Transform))
+	return nil
+}
+
+// Start func begins running the Integration GoRoutines and should return quickly
+func (t *Transform) Start(mq *mqtt.MQTT) error {
+	t.mq = mq
+	for _, tr := range t.Transform {
+		tr := tr
+		t.stopper.Go("Transform "+tr.Name, true, func(stopChan chan bool) { t.runTransform(tr, stopChan) })
+	}
+	return nil
+}
+
+// Stop terminates the Integration and all Goroutines it contains
+func (t *Transform) Stop() {
+	t.stopper.Stop()
+}
+
+func (t *Transform) runTransform(tr transformT, stopChan chan bool) {
+	ch := t.mq.SubscribeToTopic(tr.InputTopic)
+	defer t.mq.UnsubscribeFromTopic(tr.InputTopic, ch)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg := <-ch:
+			raw, ok := mqtt.PayloadBytes(msg.Payload)
+			if !ok {
+				log.Printf("WARNING: Transform %s got unexpected %T payload\n", tr.Name, msg.Payload)
+				continue
+			}
+			var data interface{}
+			if err := json.Unmarshal(raw, &data); err != nil {
+				log.Printf("WARNING: Transform %s could not parse JSON from %s - %v\n", tr.Name, msg.Topic, err)
+				continue
+			}
+			out := transformed(tr, data)
+			if len(out) == 0 {
+				continue
+			}
+			payload, err := json.Marshal(out)
+			if err != nil {
+				log.Printf("WARNING: Transform %s could not encode output - %v\n", tr.Name, err)
+				continue
+			}
+			if tr.OutputTopic == "" {
+				t.mq.PublishChan <- mqtt.AghastMsgT{
+					Subtopic: mqttPrefix + tr.Name,
+					Qos:      0,
+					Retained: tr.Retained,
+					Payload:  payload,
+				}
+			} else {
+				t.mq.ThirdPartyChan <- mqtt.GeneralMsgT{
+					Topic:    tr.OutputTopic,
+					Qos:      0,
+					Retained: tr.Retained,
+					Payload:  payload,
+				}
+			}
+		}
+	}
+}
+
+// transformed builds the output object from the configured Fields of the input data,
+// Fields which are not found are omitted.
+func transformed(tr transformT, data interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(tr.Field))
+	for _, f := range tr.Field {
+		v, found := lookupKey(data, f.From)
+		if !found {
+			log.Printf("WARNING: Transform %s could not find '%s' in input\n", tr.Name, f.From)
+			continue
+		}
+		if f.Scale != 0 || f.Offset != 0 {
+			num, isNum := v.(float64)
+			if !isNum {
+				log.Printf("WARNING: Transform %s cannot convert non-numeric '%s'\n", tr.Name, f.From)
+				continue
+			}
+			if f.Scale != 0 {
+				num *= f.Scale
+			}
+			v = num + f.Offset
+		}
+		out[f.To] = v
+	}
+	return out
+}
+
+// lookupKey follows a dotted path of object keys and array indices into some JSON data
+func lookupKey(data interface{}, key string) (interface{}, bool) {
+	for _, elem := range strings.Split(key, ".") {
+		switch d := data.(type) {
+		case map[string]interface{}:
+			v, found := d[elem]
+			if !found {
+				return nil, false
+			}
+			data = v
+		case []interface{}:
+			ix, err := strconv.Atoi(elem)
+			if err != nil || ix < 0 || ix >= len(d) {
+				return nil, false
+			}
+			data = d[ix]
+		default:
+			return nil, false
+		}
+	}
+	return data, true
+}
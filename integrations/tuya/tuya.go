@@ -20,48 +20,71 @@
 package tuya
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/SMerrony/aghast/audit"
 	agconfig "github.com/SMerrony/aghast/config"
 	"github.com/SMerrony/aghast/events"
+	"github.com/SMerrony/aghast/logging"
+	"github.com/SMerrony/aghast/maintenance"
 	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/registry"
+	"github.com/SMerrony/aghast/safego"
 	"github.com/pelletier/go-toml"
 	"github.com/tuya/tuya-cloud-sdk-go/api/common"
 	"github.com/tuya/tuya-cloud-sdk-go/api/device"
+	"github.com/tuya/tuya-cloud-sdk-go/api/user"
 	"github.com/tuya/tuya-cloud-sdk-go/config"
 )
 
+// default device ranges for lamps which do not configure their own
+const (
+	defaultBrightMin = 10
+	defaultBrightMax = 1000
+	defaultTempMin   = 0
+	defaultTempMax   = 1000
+)
+
 const (
 	configFilename    = "/tuya.toml"
 	subscriberName    = "Tuya"
 	mqttPrefix        = "/tuya/"
-	changeUpdatePause = 500 * time.Millisecond // wait between operation and requery
+	changeUpdatePause = 500 * time.Millisecond // default wait between operation and requery
 )
 
 // The Tuya type encapsulates the Tuya IoT Integration
 type Tuya struct {
 	conf           confT
 	mqttChan       chan mqtt.AghastMsgT
-	stopChans      []chan bool // used for stopping Goroutines
+	stopper        safego.Stopper     // used for stopping Goroutines
+	cancel         context.CancelFunc // ends the event subscription
 	mq             *mqtt.MQTT
 	tuyaMu         sync.RWMutex
 	lampsByLabel   map[string]int
 	socketsByLabel map[string]int
+	availability   *mqtt.Availability
+	logger         logging.Logger
 }
 
 // confT fields exported for unmarshalling
 type confT struct {
-	ApiID      string
-	ApiKey     string
-	TuyaRegion string
-	Lamp       []lamp
-	Socket     []socket
+	ApiID        string
+	ApiKey       string
+	TuyaRegion   string
+	Discover     bool   // list the devices on the Tuya account at startup
+	UserID       string // optional Tuya user ID for discovery, found via a configured device if omitted
+	InstanceName string // optional, tags log lines so that this instance can be told apart
+	RequeryMs    int    // optional wait between a command and re-reading the status, default 500ms
+	Lamp         []lamp
+	Socket       []socket
 }
 
 type lamp struct {
@@ -70,7 +93,11 @@ type lamp struct {
 	Dimmable    bool
 	Colour      bool
 	Temperature bool
-	status      lampStatusT
+	// client and Action brightness and colour temperature are 0-100, scaled to these device ranges
+	BrightMin, BrightMax int // default 10-1000
+	TempMin, TempMax     int // default 0-1000
+	RequeryMs            int // optional, overrides the Integration's RequeryMs
+	status               lampStatusT
 }
 
 type lampStatusT struct {
@@ -86,9 +113,10 @@ type hsvT struct {
 }
 
 type socket struct {
-	DeviceID string
-	Label    string
-	status   socketStatusT
+	DeviceID  string
+	Label     string
+	RequeryMs int // optional, overrides the Integration's RequeryMs
+	status    socketStatusT
 }
 
 type socketStatusT struct {
@@ -113,15 +141,22 @@ func (t *Tuya) LoadConfig(confdir string) error {
 	if err != nil {
 		log.Fatalf("ERROR: Could not load Tuya config due to %s\n", err.Error())
 	}
-	log.Printf("DEBUG: Tuya config is... %v\n", t.conf)
+	t.logger = logging.New(t.conf.InstanceName)
+	t.logger.Printf("DEBUG: Tuya config is... %v\n", t.conf)
 	if len(t.conf.Lamp) > 0 {
-		log.Printf("INFO: Tuya Integration has %d lamp(s) configured\n", len(t.conf.Lamp))
+		t.logger.Printf("INFO: Tuya Integration has %d lamp(s) configured\n", len(t.conf.Lamp))
 		for ix, l := range t.conf.Lamp {
+			if l.BrightMax == 0 {
+				t.conf.Lamp[ix].BrightMin, t.conf.Lamp[ix].BrightMax = defaultBrightMin, defaultBrightMax
+			}
+			if l.TempMax == 0 {
+				t.conf.Lamp[ix].TempMin, t.conf.Lamp[ix].TempMax = defaultTempMin, defaultTempMax
+			}
 			t.lampsByLabel[l.Label] = ix
 		}
 	}
 	if len(t.conf.Socket) > 0 {
-		log.Printf("INFO: Tuya Integration has %d socket(s) configured\n", len(t.conf.Socket))
+		t.logger.Printf("INFO: Tuya Integration has %d socket(s) configured\n", len(t.conf.Socket))
 		for ix, s := range t.conf.Socket {
 			t.socketsByLabel[s.Label] = ix
 		}
@@ -130,9 +165,10 @@ func (t *Tuya) LoadConfig(confdir string) error {
 }
 
 // Start launches the Integration, LoadConfig() should have been called beforehand.
-func (t *Tuya) Start(mq *mqtt.MQTT) {
+func (t *Tuya) Start(mq *mqtt.MQTT) error {
 	t.mqttChan = mq.PublishChan
 	t.mq = mq
+	t.availability = mqtt.NewAvailability(mqttPrefix)
 	var server string
 	switch t.conf.TuyaRegion {
 	case "CN":
@@ -144,155 +180,366 @@ func (t *Tuya) Start(mq *mqtt.MQTT) {
 	case "US":
 		server = common.URLUS
 	default:
-		log.Printf("WARNING: Tuya - Unknown Region configured - <%s>\n", t.conf.TuyaRegion)
+		t.logger.Printf("WARNING: Tuya - Unknown Region configured - <%s>\n", t.conf.TuyaRegion)
 	}
 	config.SetEnv(server, t.conf.ApiID, t.conf.ApiKey)
 	//config.SetEnv(server, "", "")
 
-	go t.monitorClients()
-	go t.monitorActions()
-	go t.monitorLamps()
-	go t.monitorSockets()
+	t.stopper.Go("Tuya client monitor", true, t.monitorClients)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	t.stopper.Go("Tuya action monitor", true, func(stopChan chan bool) { t.monitorActions(ctx, stopChan) })
+	t.stopper.Go("Tuya lamp monitor", true, t.monitorLamps)
+	t.stopper.Go("Tuya socket monitor", true, t.monitorSockets)
+	if t.conf.Discover {
+		safego.Go("Tuya discovery", false, t.discover)
+	}
+	return nil
 }
 
-func (t *Tuya) addStopChan() (ix int) {
-	t.tuyaMu.Lock()
-	t.stopChans = append(t.stopChans, make(chan bool))
-	ix = len(t.stopChans) - 1
-	t.tuyaMu.Unlock()
-	return ix
+// discover logs every device on the Tuya account, flagging whether or not each is configured
+func (t *Tuya) discover() {
+	t.tuyaMu.RLock()
+	uid := t.conf.UserID
+	configured := make(map[string]string)
+	for _, l := range t.conf.Lamp {
+		configured[l.DeviceID] = l.Label
+	}
+	for _, s := range t.conf.Socket {
+		configured[s.DeviceID] = s.Label
+	}
+	t.tuyaMu.RUnlock()
+	if uid == "" {
+		for devID := range configured {
+			dev, err := device.GetDevice(devID)
+			if err == nil && dev.Success {
+				uid = dev.Result.UID
+				break
+			}
+		}
+	}
+	if uid == "" {
+		t.logger.Println("WARNING: Tuya discovery needs a UserID, or at least one valid configured device")
+		return
+	}
+	devList, err := user.GetDeviceListByUID(uid)
+	if err != nil {
+		t.logger.Printf("WARNING: Tuya discovery failed - %s\n", err.Error())
+		return
+	}
+	if !devList.Success {
+		t.logger.Printf("WARNING: Tuya discovery failed - %s\n", devList.Msg)
+		return
+	}
+	t.logger.Printf("INFO: Tuya discovered %d device(s)\n", len(devList.Result))
+	for _, r := range devList.Result {
+		dev, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, _ := dev["id"].(string)
+		name, _ := dev["name"].(string)
+		category, _ := dev["category"].(string)
+		online, _ := dev["online"].(bool)
+		if label, found := configured[id]; found {
+			t.logger.Printf("INFO: ... %s (Category: %s, Online: %v) DeviceID: %s - configured as '%s'\n", name, category, online, id, label)
+		} else {
+			t.logger.Printf("INFO: ... %s (Category: %s, Online: %v) DeviceID: %s - NOT configured\n", name, category, online, id)
+		}
+	}
 }
 
 // Stop terminates the Integration and all Goroutines it contains
 func (t *Tuya) Stop() {
-	for _, ch := range t.stopChans {
-		ch <- true
+	if t.cancel != nil {
+		t.cancel()
+	}
+	if t.stopper.Stop() {
+		t.logger.Println("DEBUG: Tuya - All Goroutines have stopped")
 	}
-	log.Println("DEBUG: Tuya - All Goroutines should have stopped")
 }
 
-// monitorClients waits for client (front-end user) events coming via MQTT and handles them
-func (t *Tuya) monitorClients() {
-
-	type clientHSV struct {
-		H float64
-		S float64
-		V float64
-		A int
+// ProvidesDeviceTypes lists the lamps and sockets which accept Controls via the event bus
+func (t *Tuya) ProvidesDeviceTypes() registry.Devices {
+	t.tuyaMu.RLock()
+	defer t.tuyaMu.RUnlock()
+	var labels []string
+	for _, l := range t.conf.Lamp {
+		labels = append(labels, l.Label)
 	}
+	for _, s := range t.conf.Socket {
+		labels = append(labels, s.Label)
+	}
+	return registry.Devices{
+		Integration: subscriberName,
+		Labels:      map[string][]string{events.ActionControlDeviceType: labels},
+	}
+}
+
+// clientHSV is a colour sent by a front-end client
+type clientHSV struct {
+	H float64
+	S float64
+	V float64
+	A int
+}
 
+// monitorClients waits for client (front-end user) events coming via MQTT and handles them
+func (t *Tuya) monitorClients(stopChan chan bool) {
 	// config.SetEnv(server, t.conf.ApiID, t.conf.ApiKey)
 	clientChan := t.mq.SubscribeToTopic(mqttPrefix + "client/#")
-	sc := t.addStopChan()
-	t.tuyaMu.RLock()
-	stopChan := t.stopChans[sc]
-	t.tuyaMu.RUnlock()
+	defer t.mq.UnsubscribeFromTopic(mqttPrefix+"client/#", clientChan)
 	// topic format is aghast/tuya/client/<Label>/<Control>
 	for {
 		select {
 		case <-stopChan:
 			return
 		case msg := <-clientChan:
-			payload := string(msg.Payload.([]uint8))
-			topicSlice := strings.Split(msg.Topic, "/")
-			t.tuyaMu.RLock()
-			var ix int
-			var foundLamp, foundSocket bool
-			ix, foundLamp = t.lampsByLabel[topicSlice[3]]
-			if !foundLamp {
-				ix, foundSocket = t.socketsByLabel[topicSlice[3]]
-				if !foundSocket {
-					log.Printf("WARNING: Tuya front-end monitor got command for unknown unit <%s>\n", topicSlice[3])
-					t.tuyaMu.RUnlock()
-					continue
-				}
+			raw, ok := mqtt.PayloadBytes(msg.Payload)
+			if !ok {
+				t.logger.Printf("WARNING: Tuya - Ignoring unexpected %T payload on %s\n", msg.Payload, msg.Topic)
+				continue
 			}
-			control := topicSlice[4]
-			if foundLamp {
-				log.Printf("DEBUG: Tuya got control %s for %s with payload %s\n", control, t.conf.Lamp[ix].Label, payload)
-				var code, code2 string
-				var value, value2 interface{}
-				switch control {
-				case "switch":
-					switch payload {
-					case "Off":
-						code = "switch_led"
-						value = false
-					case "White":
-						code = "switch_led"
-						value = true
-						code2 = "work_mode"
-						value2 = "white"
-					case "Colour":
-						code = "switch_led"
-						value = true
-						code2 = "work_mode"
-						value2 = "colour"
-					}
-				case "switch_led":
-					code = "switch_led"
-					value = payload == "true" // bool
-				case "colour_data_v2":
-					code = "colour_data_v2"
-					var cd clientHSV
-					err := json.Unmarshal([]byte(payload), &cd)
-					if err != nil {
-						log.Printf("WARNING: Tuya could not unmarshal HSV from client - %s\n", err.Error())
-						t.tuyaMu.RUnlock()
-						continue
-					}
-					log.Printf("DEBUG: Tuya - H: %f, S: %f, V: %f\n", cd.H, cd.S, cd.V)
-					value = fmt.Sprintf("{\"h\":%d,\"s\":%d,\"v\":%d}", int(cd.H), int(cd.S*1000.0), int(cd.V*1000.0))
-					log.Printf("DEBUG: ... encoding to %s\n", value)
-				case "bright_value_v2":
-					code = "bright_value_v2"
-					value, _ = strconv.Atoi(payload)
-				case "temp_value_v2":
-					code = "temp_value_v2"
-					value, _ = strconv.Atoi(payload)
-				}
-				log.Printf("DEBUG: Tuya sending Code: %s, Value: %v\n", code, value)
-				var err error
-				if code2 == "" {
-					_, err = device.PostDeviceCommand(t.conf.Lamp[ix].DeviceID, []device.Command{{Code: code, Value: value}})
-				} else {
-					_, err = device.PostDeviceCommand(t.conf.Lamp[ix].DeviceID, []device.Command{{Code: code, Value: value}, {Code: code2, Value: value2}})
-				}
-				if err != nil {
-					log.Printf("WARNING: Tuya Integration got error sending command - %s\n", err.Error())
-					t.tuyaMu.RUnlock()
-					continue
-				}
-				t.tuyaMu.RUnlock()
-				// force status update so GUI responds nicely
-				time.Sleep(changeUpdatePause)
-				t.getLampStatus(t.conf.Lamp[ix])
+			topicSlice := strings.Split(msg.Topic, "/")
+			if len(topicSlice) < 5 {
+				t.logger.Printf("WARNING: Tuya front-end monitor ignoring command on short topic %s\n", msg.Topic)
+				continue
 			}
-			if foundSocket {
-				log.Printf("DEBUG: Tuya got control %s for %s with payload %s\n", control, t.conf.Socket[ix].Label, payload)
-				value := false
-				if payload == "On" {
-					value = true
-				}
-				_, err := device.PostDeviceCommand(t.conf.Socket[ix].DeviceID, []device.Command{{Code: "switch_1", Value: value}})
-				if err != nil {
-					log.Printf("WARNING: Tuya Integration got error sending command - %s\n", err.Error())
-					t.tuyaMu.RUnlock()
-					continue
-				}
-				t.tuyaMu.RUnlock()
+			if requery := t.clientCommand(topicSlice[3], topicSlice[4], string(raw)); requery != nil {
 				// force status update so GUI responds nicely
-				time.Sleep(changeUpdatePause)
-				t.getSocketStatus(t.conf.Socket[ix])
+				requery()
 			}
 		}
 	}
 }
 
+// clientCommand sends a front-end client's command to the labelled device.
+// If it was sent, the returned func re-reads the device's status once it has had time to change.
+func (t *Tuya) clientCommand(label, control, payload string) (requery func()) {
+	t.tuyaMu.RLock()
+	defer t.tuyaMu.RUnlock()
+	var ix int
+	var foundLamp, foundSocket bool
+	ix, foundLamp = t.lampsByLabel[label]
+	if !foundLamp {
+		ix, foundSocket = t.socketsByLabel[label]
+		if !foundSocket {
+			t.logger.Printf("WARNING: Tuya front-end monitor got command for unknown unit <%s>\n", label)
+			return nil
+		}
+	}
+	if maintenance.Suppressed("client", "Tuya/"+label, control+"="+payload) {
+		return nil
+	}
+	if foundSocket {
+		sock := t.conf.Socket[ix]
+		t.logger.Printf("DEBUG: Tuya got control %s for %s with payload %s\n", control, sock.Label, payload)
+		value := false
+		if payload == "On" {
+			value = true
+		}
+		_, err := device.PostDeviceCommand(sock.DeviceID, []device.Command{{Code: "switch_1", Value: value}})
+		audit.Record("client", "Tuya/"+sock.Label, control+"="+payload, err)
+		if err != nil {
+			t.logger.Printf("WARNING: Tuya Integration got error sending command - %s\n", err.Error())
+			return nil
+		}
+		return func() {
+			time.Sleep(t.requeryPause(sock.RequeryMs))
+			t.getSocketStatus(sock)
+		}
+	}
+	l := t.conf.Lamp[ix]
+	t.logger.Printf("DEBUG: Tuya got control %s for %s with payload %s\n", control, l.Label, payload)
+	var code, code2 string
+	var value, value2 interface{}
+	switch control {
+	case "switch":
+		switch payload {
+		case "Off":
+			code = "switch_led"
+			value = false
+		case "White":
+			code = "switch_led"
+			value = true
+			code2 = "work_mode"
+			value2 = "white"
+		case "Colour":
+			code = "switch_led"
+			value = true
+			code2 = "work_mode"
+			value2 = "colour"
+		}
+	case "switch_led":
+		code = "switch_led"
+		value = payload == "true" // bool
+	case "colour_data_v2":
+		code = "colour_data_v2"
+		var cd clientHSV
+		err := json.Unmarshal([]byte(payload), &cd)
+		if err != nil {
+			t.logger.Printf("WARNING: Tuya could not unmarshal HSV from client - %s\n", err.Error())
+			return nil
+		}
+		t.logger.Printf("DEBUG: Tuya - H: %f, S: %f, V: %f\n", cd.H, cd.S, cd.V)
+		var clamped bool
+		value, clamped = tuyaColourData(cd.H, cd.S, cd.V)
+		if clamped {
+			t.logger.Printf("WARNING: Tuya HSV from client out of range (H: 0-360, S & V: 0.0-1.0) - H: %f, S: %f, V: %f\n", cd.H, cd.S, cd.V)
+		}
+		t.logger.Printf("DEBUG: ... encoding to %s\n", value)
+	case "bright_value_v2", "temp_value_v2":
+		pct, err := strconv.ParseFloat(strings.TrimSpace(payload), 64)
+		if err != nil {
+			t.logger.Printf("WARNING: Tuya could not understand %s value from client - %s\n", control, payload)
+			return nil
+		}
+		code = control
+		value = t.scaled(l, control, pct)
+	}
+	t.logger.Printf("DEBUG: Tuya sending Code: %s, Value: %v\n", code, value)
+	var err error
+	if code2 == "" {
+		_, err = device.PostDeviceCommand(l.DeviceID, []device.Command{{Code: code, Value: value}})
+	} else {
+		_, err = device.PostDeviceCommand(l.DeviceID, []device.Command{{Code: code, Value: value}, {Code: code2, Value: value2}})
+	}
+	audit.Record("client", "Tuya/"+l.Label, control+"="+payload, err)
+	if err != nil {
+		t.logger.Printf("WARNING: Tuya Integration got error sending command - %s\n", err.Error())
+		return nil
+	}
+	return func() {
+		time.Sleep(t.requeryPause(l.RequeryMs))
+		t.getLampStatus(l)
+	}
+}
+
+// requeryPause returns how long to wait after a command before re-reading a device's status
+func (t *Tuya) requeryPause(deviceMs int) time.Duration {
+	switch {
+	case deviceMs > 0:
+		return time.Duration(deviceMs) * time.Millisecond
+	case t.conf.RequeryMs > 0:
+		return time.Duration(t.conf.RequeryMs) * time.Millisecond
+	}
+	return changeUpdatePause
+}
+
+// scaled maps a 0-100 brightness or colour temperature onto the lamp's device range,
+// out-of-range values are clamped and reported
+func (t *Tuya) scaled(l lamp, code string, pct float64) int {
+	min, max := l.BrightMin, l.BrightMax
+	if code == "temp_value_v2" {
+		min, max = l.TempMin, l.TempMax
+	}
+	v, clamped := scalePercent(pct, min, max)
+	if clamped {
+		t.logger.Printf("WARNING: Tuya %s value for %s out of range (0-100) - %v\n", code, l.Label, pct)
+	}
+	return v
+}
+
+// scalePercent maps pct (0-100) onto min..max, clamping pct if necessary
+func scalePercent(pct float64, min, max int) (int, bool) {
+	pct, clamped := clamp(pct, 0, 100)
+	return min + int(math.Round(pct/100*float64(max-min))), clamped
+}
+
+// lampAction performs a Control Action from an Automation or Scene on a lamp, the caller holds tuyaMu
+func (t *Tuya) lampAction(l lamp, control string, evValue interface{}) {
+	var cmd device.Command
+	switch control {
+	case "power":
+		cmd = device.Command{Code: "switch_led", Value: fmt.Sprintf("%v", evValue) == "on"}
+	case "brightness", "temperature":
+		code := "bright_value_v2"
+		if control == "temperature" {
+			code = "temp_value_v2"
+		}
+		pct, err := strconv.ParseFloat(fmt.Sprintf("%v", evValue), 64)
+		if err != nil {
+			t.logger.Printf("WARNING: Tuya Action could not understand %s value <%v>\n", control, evValue)
+			return
+		}
+		cmd = device.Command{Code: code, Value: t.scaled(l, code, pct)}
+	default:
+		t.logger.Printf("WARNING: Tuya Action got unknown lamp control <%s>\n", control)
+		return
+	}
+	_, err := device.PostDeviceCommand(l.DeviceID, []device.Command{cmd})
+	audit.Record("automation", "Tuya/"+l.Label, fmt.Sprintf("%s=%v", control, evValue), err)
+	if err != nil {
+		t.logger.Printf("WARNING: Tuya Integration got error sending command - %s\n", err.Error())
+	}
+}
+
+// tuyaColourData converts a client HSV colour (H 0-360, S and V 0.0-1.0) into Tuya's
+// colour_data_v2 JSON (h 0-360, s and v 0-1000).  Out-of-range values are clamped and reported.
+func tuyaColourData(h, s, v float64) (colourData string, clamped bool) {
+	var hc, sc, vc bool
+	h, hc = clamp(h, 0, 360)
+	s, sc = clamp(s, 0, 1)
+	v, vc = clamp(v, 0, 1)
+	hsv := hsvT{
+		H: int(math.Round(h)),
+		S: int(math.Round(s * 1000)),
+		V: int(math.Round(v * 1000)),
+	}
+	return fmt.Sprintf("{\"h\":%d,\"s\":%d,\"v\":%d}", hsv.H, hsv.S, hsv.V), hc || sc || vc
+}
+
+// clamp limits x to the range min..max, NaN is treated as min
+func clamp(x, min, max float64) (float64, bool) {
+	switch {
+	case math.IsNaN(x) || x < min:
+		return min, true
+	case x > max:
+		return max, true
+	}
+	return x, false
+}
+
+// boolValue checks a status value, Tuya sometimes sends these as strings
+func boolValue(v interface{}) (bool, bool) {
+	switch val := v.(type) {
+	case bool:
+		return val, true
+	case string:
+		b, err := strconv.ParseBool(val)
+		return b, err == nil
+	}
+	return false, false
+}
+
+// numberValue checks a status value, Tuya sometimes sends numbers as strings
+func numberValue(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case string:
+		f, err := strconv.ParseFloat(val, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// stringValue checks a status value
+func stringValue(v interface{}) (string, bool) {
+	s, ok := v.(string)
+	return s, ok
+}
+
+// unexpectedValue logs a status field which is being skipped because its value is of the wrong type
+func (t *Tuya) unexpectedValue(label, code string, v interface{}) {
+	t.logger.Printf("WARNING: Tuya ignoring unexpected %T value %v for %s of %s\n", v, v, code, label)
+}
+
 func (t *Tuya) getLampStatus(l lamp) {
 	status, err := device.GetDeviceStatus(l.DeviceID)
+	t.availability.Set(t.mq, l.Label, err == nil && status.Success)
 	if err != nil {
-		log.Printf("WARNING: Tuya GetDeviceStatus failed with %s\n", err.Error())
+		t.logger.Printf("WARNING: Tuya GetDeviceStatus failed with %s\n", err.Error())
 	} else {
 		// log.Printf("DEBUG: Tuya device status response Code: %d, Message: %s, Success: %v\n", status.Code, status.Msg, status.Success)
 		if status.Success {
@@ -301,17 +548,38 @@ func (t *Tuya) getLampStatus(l lamp) {
 				// log.Printf("DEBUG: ... Code: %s, Value: %v\n", r.Code, r.Value)
 				switch r.Code {
 				case "switch_led":
-					currentStatus.SwitchLED = r.Value.(bool)
+					if b, ok := boolValue(r.Value); ok {
+						currentStatus.SwitchLED = b
+					} else {
+						t.unexpectedValue(l.Label, r.Code, r.Value)
+					}
 				case "work_mode":
-					currentStatus.WorkMode = r.Value.(string)
+					if s, ok := stringValue(r.Value); ok {
+						currentStatus.WorkMode = s
+					} else {
+						t.unexpectedValue(l.Label, r.Code, r.Value)
+					}
 				case "bright_value_v2":
-					currentStatus.BrightValueV2 = int(r.Value.(float64))
+					if n, ok := numberValue(r.Value); ok {
+						currentStatus.BrightValueV2 = int(n)
+					} else {
+						t.unexpectedValue(l.Label, r.Code, r.Value)
+					}
 				case "temp_value_v2":
-					currentStatus.TempValueV2 = int(r.Value.(float64))
+					if n, ok := numberValue(r.Value); ok {
+						currentStatus.TempValueV2 = int(n)
+					} else {
+						t.unexpectedValue(l.Label, r.Code, r.Value)
+					}
 				case "colour_data_v2":
-					err := json.Unmarshal([]byte(r.Value.(string)), &currentStatus.ColourDataV2)
+					s, ok := stringValue(r.Value)
+					if !ok {
+						t.unexpectedValue(l.Label, r.Code, r.Value)
+						continue
+					}
+					err := json.Unmarshal([]byte(s), &currentStatus.ColourDataV2)
 					if err != nil {
-						log.Printf("WARNING: Tuya could not unmarshal HSV data from map, %s\n", err.Error())
+						t.logger.Printf("WARNING: Tuya could not unmarshal HSV data from map, %s\n", err.Error())
 					}
 				}
 			}
@@ -321,7 +589,7 @@ func (t *Tuya) getLampStatus(l lamp) {
 			// log.Printf("DEBUG: ... current Status: %v\n", currentStatus)
 			payload, err := json.Marshal(currentStatus)
 			if err != nil {
-				log.Fatalf("ERROR: Tuya could not marshal status info - %s\n", err.Error())
+				t.logger.Fatalf("ERROR: Tuya could not marshal status info - %s\n", err.Error())
 			}
 			// log.Println("DEBUG: Tuya - sending MQTT update...")
 			t.mqttChan <- mqtt.AghastMsgT{
@@ -335,12 +603,9 @@ func (t *Tuya) getLampStatus(l lamp) {
 }
 
 // monitorLamps
-func (t *Tuya) monitorLamps() {
-	sc := t.addStopChan()
-	t.tuyaMu.RLock()
-	stopChan := t.stopChans[sc]
-	t.tuyaMu.RUnlock()
+func (t *Tuya) monitorLamps(stopChan chan bool) {
 	everyMinute := time.NewTicker(time.Minute)
+	defer everyMinute.Stop()
 	for {
 		for _, lamp := range t.conf.Lamp {
 			t.getLampStatus(lamp)
@@ -356,8 +621,9 @@ func (t *Tuya) monitorLamps() {
 
 func (t *Tuya) getSocketStatus(sock socket) {
 	status, err := device.GetDeviceStatus(sock.DeviceID)
+	t.availability.Set(t.mq, sock.Label, err == nil && status.Success)
 	if err != nil {
-		log.Printf("WARNING: Tuya GetDeviceStatus failed with %s\n", err.Error())
+		t.logger.Printf("WARNING: Tuya GetDeviceStatus failed with %s\n", err.Error())
 	} else {
 		// log.Printf("DEBUG: Tuya device status response Code: %d, Message: %s, Success: %v\n", status.Code, status.Msg, status.Success)
 		if status.Success {
@@ -366,13 +632,29 @@ func (t *Tuya) getSocketStatus(sock socket) {
 				// log.Printf("DEBUG: ... Code: %s, Value: %v\n", r.Code, r.Value)
 				switch r.Code {
 				case "switch_1":
-					currentStatus.Switch1 = r.Value.(bool)
+					if b, ok := boolValue(r.Value); ok {
+						currentStatus.Switch1 = b
+					} else {
+						t.unexpectedValue(sock.Label, r.Code, r.Value)
+					}
 				case "countdown_1":
-					currentStatus.Countdown1 = r.Value.(float64)
+					if n, ok := numberValue(r.Value); ok {
+						currentStatus.Countdown1 = n
+					} else {
+						t.unexpectedValue(sock.Label, r.Code, r.Value)
+					}
 				case "relay_status":
-					currentStatus.RelayStatus = r.Value.(string)
+					if s, ok := stringValue(r.Value); ok {
+						currentStatus.RelayStatus = s
+					} else {
+						t.unexpectedValue(sock.Label, r.Code, r.Value)
+					}
 				case "light_mode":
-					currentStatus.LightMode = r.Value.(string)
+					if s, ok := stringValue(r.Value); ok {
+						currentStatus.LightMode = s
+					} else {
+						t.unexpectedValue(sock.Label, r.Code, r.Value)
+					}
 				}
 			}
 			t.tuyaMu.Lock()
@@ -381,7 +663,7 @@ func (t *Tuya) getSocketStatus(sock socket) {
 			// log.Printf("DEBUG: ... current Status: %v\n", currentStatus)
 			payload, err := json.Marshal(currentStatus)
 			if err != nil {
-				log.Fatalf("ERROR: Tuya could not marshal status info - %s\n", err.Error())
+				t.logger.Fatalf("ERROR: Tuya could not marshal status info - %s\n", err.Error())
 			}
 			// log.Println("DEBUG: Tuya - sending MQTT update...")
 			t.mqttChan <- mqtt.AghastMsgT{
@@ -395,12 +677,9 @@ func (t *Tuya) getSocketStatus(sock socket) {
 }
 
 // monitorSockets
-func (t *Tuya) monitorSockets() {
-	sc := t.addStopChan()
-	t.tuyaMu.RLock()
-	stopChan := t.stopChans[sc]
-	t.tuyaMu.RUnlock()
+func (t *Tuya) monitorSockets(stopChan chan bool) {
 	everyMinute := time.NewTicker(time.Minute)
+	defer everyMinute.Stop()
 	for {
 		for _, socket := range t.conf.Socket {
 			t.getSocketStatus(socket)
@@ -414,59 +693,57 @@ func (t *Tuya) monitorSockets() {
 	}
 }
 
-func getDeviceName(evName string) string {
-	return strings.Split(evName, "/")[events.EvDeviceName]
-}
-
 // monitorActions listens for Control Actions from Automations and performs them
-func (t *Tuya) monitorActions() {
-	sc := t.addStopChan()
-	t.tuyaMu.RLock()
-	stopChan := t.stopChans[sc]
-	t.tuyaMu.RUnlock()
+func (t *Tuya) monitorActions(ctx context.Context, stopChan chan bool) {
 	sid := events.GetSubscriberID(subscriberName)
-	ch, err := events.Subscribe(sid, "Tuya"+"/"+events.ActionControlDeviceType+"/+/+")
+	evName := "Tuya" + "/" + events.ActionControlDeviceType + "/+/+"
+	ch, err := events.Subscribe(ctx, sid, evName)
 	if err != nil {
-		log.Fatalf("ERROR: Tuya Integration could not subscribe to event - %v\n", err)
+		t.logger.Fatalf("ERROR: Tuya Integration could not subscribe to event - %v\n", err)
 	}
+	defer events.Unsubscribe(sid, evName)
 	for {
 		select {
 		case <-stopChan:
 			return
-		case ev := <-ch:
-			log.Printf("DEBUG: Tuya Action Monitor got %v\n", ev)
-			var ix int
-			var foundLamp, foundSocket bool
-			ix, foundLamp = t.lampsByLabel[getDeviceName(ev.Name)]
-			if !foundLamp {
-				ix, foundSocket = t.socketsByLabel[getDeviceName(ev.Name)]
-			}
-			switch {
-			case foundLamp:
-				log.Println("WARNING: Tuya Integration does not yet support Lamp Automation Actions")
-			case foundSocket:
-				control := strings.Split(ev.Name, "/")[events.EvControl]
-				switch control {
-				case "power":
-					value := false
-					if ev.Value.(string) == "on" {
-						value = true
-					}
-					_, err := device.PostDeviceCommand(t.conf.Socket[ix].DeviceID, []device.Command{{Code: "switch_1", Value: value}})
-					if err != nil {
-						log.Printf("WARNING: Tuya Integration got error sending command - %s\n", err.Error())
-						t.tuyaMu.RUnlock()
-						continue
-					}
-				default:
-					log.Printf("WARNING: Tuya Action got unknown control <%s>\n", control)
-				}
-			default:
-				log.Printf("WARNING: Tuya Action monitor got command for unknown unit <%s>\n", getDeviceName(ev.Name))
-				t.tuyaMu.RUnlock()
-				continue
+		case ev, ok := <-ch:
+			if !ok {
+				return // cancelled
 			}
+			t.performAction(ev)
+		}
+	}
+}
 
+// performAction performs a Control Action from an Automation or Scene
+func (t *Tuya) performAction(ev events.EventT) {
+	t.logger.Printf("DEBUG: Tuya Action Monitor got %v\n", ev)
+	t.tuyaMu.RLock()
+	defer t.tuyaMu.RUnlock()
+	label, control := ev.Field(events.EvDeviceName), ev.Field(events.EvControl)
+	ix, foundLamp := t.lampsByLabel[label]
+	foundSocket := false
+	if !foundLamp {
+		ix, foundSocket = t.socketsByLabel[label]
+	}
+	switch {
+	case !foundLamp && !foundSocket:
+		t.logger.Printf("WARNING: Tuya Action monitor got command for unknown unit <%s>\n", label)
+	case maintenance.Suppressed("automation", "Tuya/"+label, fmt.Sprintf("%s=%v", control, ev.Value)):
+	case foundLamp:
+		t.lampAction(t.conf.Lamp[ix], control, ev.Value)
+	case control != "power":
+		t.logger.Printf("WARNING: Tuya Action got unknown control <%s>\n", control)
+	default:
+		state, ok := ev.Value.(string)
+		if !ok {
+			t.logger.Printf("WARNING: Tuya Action for %s needs a string power value, got %T <%v>\n", label, ev.Value, ev.Value)
+			return
+		}
+		_, err := device.PostDeviceCommand(t.conf.Socket[ix].DeviceID, []device.Command{{Code: "switch_1", Value: state == "on"}})
+		audit.Record("automation", "Tuya/"+t.conf.Socket[ix].Label, fmt.Sprintf("%s=%v", control, ev.Value), err)
+		if err != nil {
+			t.logger.Printf("WARNING: Tuya Integration got error sending command - %s\n", err.Error())
 		}
 	}
 }
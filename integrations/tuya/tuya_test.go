@@ -0,0 +1,157 @@
+// Copyright ©2020,2021 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package tuya
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/SMerrony/aghast/events"
+	"github.com/SMerrony/aghast/logging"
+)
+
+func TestTuyaColourData(t *testing.T) {
+	tests := []struct {
+		h, s, v float64
+		want    string
+		clamped bool
+	}{
+		{0, 0, 0, `{"h":0,"s":0,"v":0}`, false},
+		{360, 1, 1, `{"h":360,"s":1000,"v":1000}`, false},
+		{120.4, 0.5, 0.2505, `{"h":120,"s":500,"v":251}`, false},
+		{-10, 0.5, 0.5, `{"h":0,"s":500,"v":500}`, true},
+		{400, 1.5, 2, `{"h":360,"s":1000,"v":1000}`, true},
+		{90, -0.1, 0.5, `{"h":90,"s":0,"v":500}`, true},
+		{math.NaN(), 0.5, math.Inf(1), `{"h":0,"s":500,"v":1000}`, true},
+	}
+	for _, tt := range tests {
+		got, clamped := tuyaColourData(tt.h, tt.s, tt.v)
+		if got != tt.want {
+			t.Errorf("tuyaColourData(%v, %v, %v) got %s, expected %s", tt.h, tt.s, tt.v, got, tt.want)
+		}
+		if clamped != tt.clamped {
+			t.Errorf("tuyaColourData(%v, %v, %v) clamped got %v, expected %v", tt.h, tt.s, tt.v, clamped, tt.clamped)
+		}
+		var hsv hsvT
+		if err := json.Unmarshal([]byte(got), &hsv); err != nil {
+			t.Errorf("tuyaColourData(%v, %v, %v) produced invalid JSON %s - %v", tt.h, tt.s, tt.v, got, err)
+		}
+	}
+}
+
+func TestScalePercent(t *testing.T) {
+	tests := []struct {
+		pct      float64
+		min, max int
+		want     int
+		clamped  bool
+	}{
+		{0, 10, 1000, 10, false},
+		{100, 10, 1000, 1000, false},
+		{50, 10, 1000, 505, false},
+		{50, 0, 255, 128, false},
+		{25, 0, 1000, 250, false},
+		{-5, 10, 1000, 10, true},
+		{150, 0, 255, 255, true},
+		{math.NaN(), 25, 255, 25, true},
+	}
+	for _, tt := range tests {
+		got, clamped := scalePercent(tt.pct, tt.min, tt.max)
+		if got != tt.want || clamped != tt.clamped {
+			t.Errorf("scalePercent(%v, %d, %d) got %d, %v, expected %d, %v", tt.pct, tt.min, tt.max, got, clamped, tt.want, tt.clamped)
+		}
+	}
+	tuya := new(Tuya)
+	l := lamp{Label: "Test", BrightMin: 25, BrightMax: 255, TempMin: 0, TempMax: 1000}
+	if got := tuya.scaled(l, "bright_value_v2", 100); got != 255 {
+		t.Errorf("lamp brightness scaled to %d, expected 255", got)
+	}
+	if got := tuya.scaled(l, "temp_value_v2", 30); got != 300 {
+		t.Errorf("lamp temperature scaled to %d, expected 300", got)
+	}
+}
+
+func TestStatusValues(t *testing.T) {
+	if b, ok := boolValue(true); !b || !ok {
+		t.Errorf("boolValue(true) got %v, %v", b, ok)
+	}
+	if b, ok := boolValue("true"); !b || !ok {
+		t.Errorf(`boolValue("true") got %v, %v`, b, ok)
+	}
+	if _, ok := boolValue(1.0); ok {
+		t.Error("boolValue(1.0) should not be ok")
+	}
+	if n, ok := numberValue(500.0); n != 500 || !ok {
+		t.Errorf("numberValue(500.0) got %v, %v", n, ok)
+	}
+	if n, ok := numberValue("250"); n != 250 || !ok {
+		t.Errorf(`numberValue("250") got %v, %v`, n, ok)
+	}
+	if _, ok := numberValue("bright"); ok {
+		t.Error(`numberValue("bright") should not be ok`)
+	}
+	if _, ok := numberValue(nil); ok {
+		t.Error("numberValue(nil) should not be ok")
+	}
+	if s, ok := stringValue("white"); s != "white" || !ok {
+		t.Errorf(`stringValue("white") got %v, %v`, s, ok)
+	}
+	if _, ok := stringValue(false); ok {
+		t.Error("stringValue(false) should not be ok")
+	}
+}
+
+func TestRequeryPause(t *testing.T) {
+	tuya := new(Tuya)
+	if got := tuya.requeryPause(0); got != changeUpdatePause {
+		t.Errorf("default requeryPause got %v, expected %v", got, changeUpdatePause)
+	}
+	tuya.conf.RequeryMs = 1000
+	if got := tuya.requeryPause(0); got != time.Second {
+		t.Errorf("Integration requeryPause got %v, expected 1s", got)
+	}
+	if got := tuya.requeryPause(2000); got != 2*time.Second {
+		t.Errorf("device requeryPause got %v, expected 2s", got)
+	}
+}
+
+func TestPerformActionBadValue(t *testing.T) {
+	tuya := &Tuya{
+		logger:         logging.New(""),
+		lampsByLabel:   map[string]int{},
+		socketsByLabel: map[string]int{"Kettle": 0},
+	}
+	tuya.conf.Socket = []socket{{Label: "Kettle", DeviceID: "dev1"}}
+	// eg. a Scene with Value = true, which must not panic before it can post a command
+	tuya.performAction(events.EventT{Name: "Tuya/Control/Kettle/power", Value: true})
+	locked := make(chan struct{})
+	go func() {
+		tuya.tuyaMu.Lock()
+		tuya.tuyaMu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("tuyaMu was left locked after a bad Action")
+	}
+}
@@ -0,0 +1,450 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package virtualswitch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pelletier/go-toml"
+
+	"github.com/SMerrony/aghast/audit"
+	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/events"
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/registry"
+	"github.com/SMerrony/aghast/safego"
+)
+
+const (
+	configFilename    = "/virtualswitch.toml"
+	stateFilename     = "/virtualswitch.state"
+	subscriberName    = "VirtualSwitch"
+	mqttPrefix        = "/virtualswitch/"
+	setTopicPrefix    = "aghast/virtualswitch/set/"
+	setTopicPrefixLen = len(setTopicPrefix)
+	getTopicPrefix    = "aghast/virtualswitch/get/"
+	getTopicPrefixLen = len(getTopicPrefix)
+	setControl        = "set"
+	// latchSource is the audit source when a latching switch resets itself
+	latchSource = "latch"
+)
+
+// VirtualSwitch encapsulates the type of this Integration
+type VirtualSwitch struct {
+	StateFile      string // OPTIONAL, defaults to virtualswitch.state in the config directory
+	Switch         []switchT
+	switchesByName map[string]int
+	resetTimers    map[string]*time.Timer // by name, for latching switches which are on
+	mutex          sync.RWMutex
+	stopper        safego.Stopper
+	cancel         context.CancelFunc // ends the event subscriptions
+	mq             *mqtt.MQTT
+}
+
+type switchT struct {
+	Name    string
+	States  []string // the permitted values of an enumerated switch, it is a boolean switch if empty
+	Default string
+	// a latching boolean switch turns itself off after Hold, eg. to turn a momentary button press into a state
+	Hold    string // optional duration, eg. "30s"
+	Topic   string // optional, messages on this topic turn the switch on
+	Key     string // optional, JSON key of the value in the Topic's payload
+	Trigger string // optional, only this value turns the switch on, otherwise any message does
+	hold    time.Duration
+	state   string
+}
+
+// LoadConfig func should simply load any config (TOML) files for this Integration
+func (v *VirtualSwitch) LoadConfig(confdir string) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	confBytes, err := config.PreprocessTOML(confdir, configFilename)
+	if err != nil {
+		log.Println("ERROR: Could not preprocess VirtualSwitch configuration ", err.Error())
+		return err
+	}
+	err = toml.Unmarshal(confBytes, v)
+	if err != nil {
+		log.Printf("ERROR: Could not load VirtualSwitch config due to %s\n", err.Error())
+		return err
+	}
+	if v.StateFile == "" {
+		v.StateFile = confdir + stateFilename
+	}
+	v.switchesByName = make(map[string]int)
+	for i, sw := range v.Switch {
+		if _, dup := v.switchesByName[sw.Name]; dup || sw.Name == "" {
+			log.Printf("ERROR: VirtualSwitch names must be unique and not empty - '%s'\n", sw.Name)
+			return errors.New("VirtualSwitch configuration error")
+		}
+		if len(sw.States) == 0 && sw.Default == "" {
+			sw.Default = "false"
+		}
+		if len(sw.States) > 0 && sw.Default == "" {
+			sw.Default = sw.States[0]
+		}
+		sw.Default, err = normalise(sw, sw.Default)
+		if err != nil {
+			log.Printf("ERROR: VirtualSwitch %s has an invalid Default - %s\n", sw.Name, err.Error())
+			return err
+		}
+		if sw.Hold != "" {
+			if len(sw.States) > 0 {
+				log.Printf("ERROR: VirtualSwitch %s - only boolean switches may have a Hold\n", sw.Name)
+				return errors.New("VirtualSwitch configuration error")
+			}
+			if sw.hold, err = config.ParseDuration(sw.Hold); err != nil || sw.hold <= 0 {
+				log.Printf("ERROR: VirtualSwitch %s has an invalid Hold '%s'\n", sw.Name, sw.Hold)
+				return errors.New("VirtualSwitch configuration error")
+			}
+		}
+		if sw.Topic != "" && sw.hold == 0 {
+			log.Printf("ERROR: VirtualSwitch %s - a Topic may only be given with a Hold\n", sw.Name)
+			return errors.New("VirtualSwitch configuration error")
+		}
+		sw.state = sw.Default
+		v.Switch[i] = sw
+		v.switchesByName[sw.Name] = i
+	}
+	v.restoreStates()
+	log.Printf("INFO: VirtualSwitch Integration has %d Switches configured\n", len(v.Switch))
+	return nil
+}
+
+// normalise checks that value is permitted for the switch, boolean switches accept
+// true/false, on/off, or 1/0 and always return "true" or "false".
+func normalise(sw switchT, value string) (string, error) {
+	if len(sw.States) == 0 {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "true", "on", "1":
+			return "true", nil
+		case "false", "off", "0":
+			return "false", nil
+		}
+		return "", fmt.Errorf("'%s' is not a boolean value", value)
+	}
+	for _, s := range sw.States {
+		if s == value {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("'%s' is not one of the States %v", value, sw.States)
+}
+
+// restoreStates loads any saved states, switches which are no longer configured,
+// or whose saved value is no longer permitted, are ignored.  The mutex must be held.
+func (v *VirtualSwitch) restoreStates() {
+	stateBytes, err := ioutil.ReadFile(v.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("WARNING: VirtualSwitch could not read saved states - %s\n", err.Error())
+		}
+		return
+	}
+	saved := make(map[string]string)
+	if err = json.Unmarshal(stateBytes, &saved); err != nil {
+		log.Printf("WARNING: VirtualSwitch could not understand saved states - %s\n", err.Error())
+		return
+	}
+	for name, val := range saved {
+		ix, found := v.switchesByName[name]
+		if !found || v.Switch[ix].hold > 0 {
+			continue // latching switches would never be reset
+		}
+		if val, err = normalise(v.Switch[ix], val); err != nil {
+			log.Printf("WARNING: VirtualSwitch ignoring saved state for %s - %s\n", name, err.Error())
+			continue
+		}
+		v.Switch[ix].state = val
+	}
+}
+
+// saveStates writes the current states to the StateFile.  The mutex must be held.
+func (v *VirtualSwitch) saveStates() {
+	saved := make(map[string]string, len(v.Switch))
+	for _, sw := range v.Switch {
+		saved[sw.Name] = sw.state
+	}
+	stateBytes, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		log.Printf("WARNING: VirtualSwitch could not marshal states - %s\n", err.Error())
+		return
+	}
+	tmpName := v.StateFile + ".tmp"
+	if err = ioutil.WriteFile(tmpName, stateBytes, 0644); err == nil {
+		err = os.Rename(tmpName, v.StateFile)
+	}
+	if err != nil {
+		log.Printf("WARNING: VirtualSwitch could not save states - %s\n", err.Error())
+	}
+}
+
+// Start func begins running the Integration GoRoutines and should return quickly
+func (v *VirtualSwitch) Start(mq *mqtt.MQTT) error {
+	v.mutex.Lock()
+	v.mq = mq
+	v.resetTimers = make(map[string]*time.Timer)
+	v.mutex.Unlock()
+	v.mutex.RLock()
+	for _, sw := range v.Switch {
+		v.publishState(sw)
+	}
+	v.mutex.RUnlock()
+	v.stopper.Go("VirtualSwitch MQTT monitor", true, v.monitorMqtt)
+	ctx, cancel := context.WithCancel(context.Background())
+	v.cancel = cancel
+	v.stopper.Go("VirtualSwitch event monitor", true, func(stopChan chan bool) { v.monitorEvents(ctx, stopChan) })
+	for _, sw := range v.Switch {
+		if sw.Topic != "" {
+			sw := sw
+			v.stopper.Go("VirtualSwitch trigger "+sw.Name, true, func(stopChan chan bool) { v.monitorTrigger(sw, stopChan) })
+		}
+	}
+	return nil
+}
+
+// Stop terminates the Integration and all Goroutines it contains
+func (v *VirtualSwitch) Stop() {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.stopper.Stop()
+	v.mutex.Lock()
+	for name, t := range v.resetTimers {
+		t.Stop()
+		delete(v.resetTimers, name)
+	}
+	v.mutex.Unlock()
+}
+
+// ProvidesDeviceTypes lists the switches which accept Controls and Queries via the event bus
+func (v *VirtualSwitch) ProvidesDeviceTypes() registry.Devices {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	var names []string
+	for _, sw := range v.Switch {
+		names = append(names, sw.Name)
+	}
+	return registry.Devices{
+		Integration: subscriberName,
+		Labels:      map[string][]string{events.ActionControlDeviceType: names, events.QueryDeviceType: names},
+	}
+}
+
+func (v *VirtualSwitch) publishState(sw switchT) {
+	v.mq.PublishChan <- mqtt.AghastMsgT{
+		Subtopic: mqttPrefix + sw.Name + "/state",
+		Qos:      0,
+		Retained: true,
+		Payload:  sw.state,
+	}
+}
+
+// setState changes the state of the named switch, saving and publishing it if it has changed
+func (v *VirtualSwitch) setState(name string, value string, source string) (err error) {
+	defer func() { audit.Record(source, subscriberName+"/"+name, setControl+"="+value, err) }()
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	ix, found := v.switchesByName[name]
+	if !found {
+		return errors.New("unknown switch")
+	}
+	newState, err := normalise(v.Switch[ix], value)
+	if err != nil {
+		return err
+	}
+	if v.Switch[ix].hold > 0 {
+		v.latch(name, v.Switch[ix].hold, newState == "true")
+	}
+	if v.Switch[ix].state == newState {
+		return nil
+	}
+	v.Switch[ix].state = newState
+	v.saveStates()
+	v.publishState(v.Switch[ix])
+	return nil
+}
+
+// latch (re)starts the reset timer of a latching switch which is being turned on, so that it turns off again
+// after hold, and cancels it if the switch is being turned off.  The mutex must be held.
+func (v *VirtualSwitch) latch(name string, hold time.Duration, on bool) {
+	if t, running := v.resetTimers[name]; running {
+		t.Stop()
+		delete(v.resetTimers, name)
+	}
+	if on {
+		v.resetTimers[name] = time.AfterFunc(hold, func() {
+			if err := v.setState(name, "false", latchSource); err != nil {
+				log.Printf("WARNING: VirtualSwitch could not reset %s - %s\n", name, err.Error())
+			}
+		})
+	}
+}
+
+// triggered reports whether a message received on a latching switch's Topic should turn it on
+func triggered(sw switchT, payload interface{}) bool {
+	raw, ok := mqtt.PayloadBytes(payload)
+	if !ok {
+		return false
+	}
+	value := strings.TrimSpace(string(raw))
+	if sw.Key != "" {
+		jsonMap := make(map[string]interface{})
+		if err := json.Unmarshal(raw, &jsonMap); err != nil {
+			return false
+		}
+		v, found := jsonMap[sw.Key]
+		if !found {
+			return false
+		}
+		value = fmt.Sprintf("%v", v)
+	}
+	return sw.Trigger == "" || value == sw.Trigger
+}
+
+// monitorTrigger turns a latching switch on whenever its Trigger arrives on its Topic
+func (v *VirtualSwitch) monitorTrigger(sw switchT, stopChan chan bool) {
+	ch := v.mq.SubscribeToTopic(sw.Topic)
+	defer v.mq.UnsubscribeFromTopic(sw.Topic, ch)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg := <-ch:
+			if msg.Retained || !triggered(sw, msg.Payload) {
+				continue // a retained message is an old press, not a new one
+			}
+			if err := v.setState(sw.Name, "true", "trigger"); err != nil {
+				log.Printf("WARNING: VirtualSwitch could not set %s - %s\n", sw.Name, err.Error())
+			}
+		}
+	}
+}
+
+// getState returns the current state of the named switch
+func (v *VirtualSwitch) getState(name string) (sw switchT, found bool) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+	ix, found := v.switchesByName[name]
+	if !found {
+		return sw, false
+	}
+	return v.Switch[ix], true
+}
+
+// monitorMqtt handles set and get requests arriving via MQTT
+func (v *VirtualSwitch) monitorMqtt(stopChan chan bool) {
+	setChan := v.mq.SubscribeToTopic(setTopicPrefix + "+")
+	defer v.mq.UnsubscribeFromTopic(setTopicPrefix+"+", setChan)
+	getChan := v.mq.SubscribeToTopic(getTopicPrefix + "+")
+	defer v.mq.UnsubscribeFromTopic(getTopicPrefix+"+", getChan)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case msg := <-setChan:
+			name := msg.Topic[setTopicPrefixLen:]
+			raw, ok := mqtt.PayloadBytes(msg.Payload)
+			if !ok {
+				log.Printf("WARNING: VirtualSwitch - Ignoring unexpected %T payload on %s\n", msg.Payload, msg.Topic)
+				continue
+			}
+			if err := v.setState(name, string(raw), "client"); err != nil {
+				log.Printf("WARNING: VirtualSwitch could not set %s to '%s' - %s\n", name, raw, err.Error())
+			}
+		case msg := <-getChan:
+			name := msg.Topic[getTopicPrefixLen:]
+			sw, found := v.getState(name)
+			if !found {
+				log.Printf("WARNING: VirtualSwitch received /get for unknown switch: %s\n", name)
+				continue
+			}
+			v.publishState(sw)
+		}
+	}
+}
+
+// monitorEvents handles Control Actions and Queries arriving via the event bus
+func (v *VirtualSwitch) monitorEvents(ctx context.Context, stopChan chan bool) {
+	sid := events.GetSubscriberID(subscriberName)
+	controlEvName := subscriberName + "/" + events.ActionControlDeviceType + "/+/+"
+	queryEvName := subscriberName + "/" + events.QueryDeviceType + "/+/+"
+	controlChan, err := events.Subscribe(ctx, sid, controlEvName)
+	if err != nil {
+		log.Fatalf("ERROR: VirtualSwitch Integration could not subscribe to event - %v\n", err)
+	}
+	defer events.Unsubscribe(sid, controlEvName)
+	queryChan, err := events.Subscribe(ctx, sid, queryEvName)
+	if err != nil {
+		log.Fatalf("ERROR: VirtualSwitch Integration could not subscribe to event - %v\n", err)
+	}
+	defer events.Unsubscribe(sid, queryEvName)
+	for {
+		select {
+		case <-stopChan:
+			return
+		case ev, ok := <-controlChan:
+			if !ok {
+				return // cancelled
+			}
+			name := ev.Field(events.EvDeviceName)
+			if ev.Field(events.EvControl) != setControl {
+				log.Printf("WARNING: VirtualSwitch Action got unknown control <%s>\n", ev.Field(events.EvControl))
+				continue
+			}
+			if err := v.setState(name, fmt.Sprintf("%v", ev.Value), "automation"); err != nil {
+				log.Printf("WARNING: VirtualSwitch could not set %s to '%v' - %s\n", name, ev.Value, err.Error())
+			}
+		case ev, ok := <-queryChan:
+			if !ok {
+				return // cancelled
+			}
+			replyChan, ok := ev.Value.(chan interface{})
+			if !ok {
+				log.Printf("WARNING: VirtualSwitch Query %s has no reply channel\n", ev.Name)
+				continue
+			}
+			sw, found := v.getState(ev.Field(events.EvDeviceName))
+			if !found {
+				log.Printf("WARNING: VirtualSwitch Query for unknown switch <%s>\n", ev.Field(events.EvDeviceName))
+				replyChan <- nil
+				continue
+			}
+			switch ev.Field(events.EvQueryType) {
+			case events.IsOn:
+				replyChan <- sw.state == "true"
+			case events.FetchLast:
+				replyChan <- sw.state
+			default:
+				log.Printf("WARNING: VirtualSwitch received unknown query type %s\n", ev.Name)
+				replyChan <- nil
+			}
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package virtualswitch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SMerrony/aghast/mqtt"
+)
+
+func TestTriggered(t *testing.T) {
+	tests := []struct {
+		key, trigger string
+		payload      interface{}
+		want         bool
+	}{
+		{"", "", []byte("anything"), true},
+		{"", "ON", []byte("ON"), true},
+		{"", "ON", []byte("OFF"), false},
+		{"action", "single", []byte(`{"action": "single", "battery": 90}`), true},
+		{"action", "single", []byte(`{"action": "double"}`), false},
+		{"action", "", []byte(`{"battery": 90}`), false},
+		{"action", "single", []byte("single"), false},
+		{"", "", 42, false},
+	}
+	for _, tt := range tests {
+		sw := switchT{Name: "Test", Key: tt.key, Trigger: tt.trigger}
+		if got := triggered(sw, tt.payload); got != tt.want {
+			t.Errorf("triggered(Key %q, Trigger %q, %v) got %v, expected %v", tt.key, tt.trigger, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestLatch(t *testing.T) {
+	hold := 50 * time.Millisecond
+	v := &VirtualSwitch{
+		StateFile:      t.TempDir() + stateFilename,
+		Switch:         []switchT{{Name: "Doorbell", Default: "false", state: "false", hold: hold}},
+		switchesByName: map[string]int{"Doorbell": 0},
+		resetTimers:    make(map[string]*time.Timer),
+		mq:             &mqtt.MQTT{PublishChan: make(chan mqtt.AghastMsgT, 10)},
+	}
+	if err := v.setState("Doorbell", "true", "test"); err != nil {
+		t.Fatalf("setState failed - %v", err)
+	}
+	if sw, _ := v.getState("Doorbell"); sw.state != "true" {
+		t.Fatalf("latching switch state %s, expected true", sw.state)
+	}
+	time.Sleep(hold / 2)
+	v.setState("Doorbell", "on", "test") // pressed again, so the hold restarts
+	time.Sleep(hold * 3 / 4)
+	if sw, _ := v.getState("Doorbell"); sw.state != "true" {
+		t.Error("latching switch reset before its restarted hold expired")
+	}
+	time.Sleep(hold)
+	if sw, _ := v.getState("Doorbell"); sw.state != "false" {
+		t.Error("latching switch not reset after its hold")
+	}
+	v.Stop()
+}
@@ -0,0 +1,72 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package logging tags the log lines of an Integration with its optional instance name, so that
+// eg. the logs of AGHAST servers in different buildings may be told apart.
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// the levels used at the start of every log line
+var levels = []string{"DEBUG: ", "INFO: ", "WARNING: ", "ERROR: "}
+
+// Logger writes to the standard logger, inserting "[<instance>] " after the level of each line.
+// The zero value adds no tag.
+type Logger struct {
+	tag string
+}
+
+// New returns a Logger for the named instance, which may be empty
+func New(instance string) Logger {
+	if instance == "" {
+		return Logger{}
+	}
+	return Logger{tag: "[" + instance + "] "}
+}
+
+// Printf logs as log.Printf, the format should begin with the level, eg. "WARNING: "
+func (l Logger) Printf(format string, v ...interface{}) {
+	log.Output(2, l.tagged(fmt.Sprintf(format, v...)))
+}
+
+// Println logs as log.Println, the first operand should begin with the level
+func (l Logger) Println(v ...interface{}) {
+	log.Output(2, l.tagged(fmt.Sprintln(v...)))
+}
+
+// Fatalf is equivalent to Printf followed by os.Exit(1), as log.Fatalf
+func (l Logger) Fatalf(format string, v ...interface{}) {
+	log.Fatal(l.tagged(fmt.Sprintf(format, v...)))
+}
+
+func (l Logger) tagged(line string) string {
+	if l.tag == "" {
+		return line
+	}
+	for _, level := range levels {
+		if strings.HasPrefix(line, level) {
+			return level + l.tag + line[len(level):]
+		}
+	}
+	return l.tag + line
+}
@@ -0,0 +1,41 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package logging
+
+import "testing"
+
+func TestTagged(t *testing.T) {
+	l := New("tuya-upstairs")
+	tests := []struct {
+		line, want string
+	}{
+		{"WARNING: Tuya discovery failed\n", "WARNING: [tuya-upstairs] Tuya discovery failed\n"},
+		{"DEBUG: Tuya sending Code: switch_led\n", "DEBUG: [tuya-upstairs] Tuya sending Code: switch_led\n"},
+		{"no level\n", "[tuya-upstairs] no level\n"},
+	}
+	for _, tt := range tests {
+		if got := l.tagged(tt.line); got != tt.want {
+			t.Errorf("tagged(%q) = %q, expected %q", tt.line, got, tt.want)
+		}
+	}
+	if got := New("").tagged("INFO: untagged\n"); got != "INFO: untagged\n" {
+		t.Errorf("untagged line became %q", got)
+	}
+}
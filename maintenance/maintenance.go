@@ -0,0 +1,71 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package maintenance provides a system-wide switch which stops Integrations from controlling devices,
+// eg. while wiring is being worked on.  Monitoring and logging carry on as usual.
+package maintenance
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/SMerrony/aghast/audit"
+)
+
+// ErrSuppressed is recorded in the audit log for each suppressed Control action
+var ErrSuppressed = errors.New("suppressed (maintenance)")
+
+var (
+	modeMu  sync.RWMutex
+	enabled bool
+)
+
+// Set turns maintenance mode on or off
+func Set(on bool) {
+	modeMu.Lock()
+	changed := enabled != on
+	enabled = on
+	modeMu.Unlock()
+	if changed {
+		if on {
+			log.Println("INFO: Maintenance mode is ON, Control actions will be suppressed")
+		} else {
+			log.Println("INFO: Maintenance mode is OFF")
+		}
+	}
+}
+
+// Enabled reports whether maintenance mode is on
+func Enabled() bool {
+	modeMu.RLock()
+	defer modeMu.RUnlock()
+	return enabled
+}
+
+// Suppressed should be called by Integrations before performing a Control action, if it returns true
+// the action must not be performed, it has already been logged and audited.
+func Suppressed(source, target, action string) bool {
+	if !Enabled() {
+		return false
+	}
+	log.Printf("INFO: %s %s for %s %s\n", target, action, source, ErrSuppressed.Error())
+	audit.Record(source, target, action, ErrSuppressed)
+	return true
+}
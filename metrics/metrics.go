@@ -0,0 +1,90 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package metrics keeps some simple counters and serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing count which is safe for concurrent use
+type Counter struct {
+	count uint64
+}
+
+// Inc adds one to the Counter
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.count, 1)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.count)
+}
+
+// The system-wide counters
+var (
+	EventsProcessed Counter
+	MqttReceived    Counter
+	MqttSent        Counter
+)
+
+var (
+	integErrorsMu sync.Mutex
+	integErrors   = make(map[string]uint64)
+)
+
+// IntegrationError counts an error in the named Integration
+func IntegrationError(iName string) {
+	integErrorsMu.Lock()
+	integErrors[iName]++
+	integErrorsMu.Unlock()
+}
+
+// Handler serves all the metrics, it is intended to be registered for "/metrics"
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "aghast_events_processed_total", "counter", "Events processed by the event manager.", EventsProcessed.Value())
+	writeMetric(w, "aghast_mqtt_messages_received_total", "counter", "MQTT messages received from the Broker.", MqttReceived.Value())
+	writeMetric(w, "aghast_mqtt_messages_sent_total", "counter", "MQTT messages sent to the Broker.", MqttSent.Value())
+	writeMetric(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.", uint64(runtime.NumGoroutine()))
+
+	integErrorsMu.Lock()
+	names := make([]string, 0, len(integErrors))
+	for n := range integErrors {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "# HELP aghast_integration_errors_total Errors starting or reloading each Integration.")
+	fmt.Fprintln(w, "# TYPE aghast_integration_errors_total counter")
+	for _, n := range names {
+		fmt.Fprintf(w, "aghast_integration_errors_total{integration=%q} %d\n", n, integErrors[n])
+	}
+	integErrorsMu.Unlock()
+}
+
+func writeMetric(w http.ResponseWriter, name, mType, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, mType, name, value)
+}
@@ -0,0 +1,64 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package mqtt
+
+import "sync"
+
+const (
+	availabilitySubtopic = "/availability"
+	// Online is published when a polled device becomes reachable
+	Online = "online"
+	// Offline is published when a polled device becomes unreachable
+	Offline = "offline"
+)
+
+// Availability tracks whether the devices polled by an Integration are reachable and publishes
+// "online" or "offline" (retained) to <prefix><label>/availability whenever that changes.
+type Availability struct {
+	mutex  sync.Mutex
+	prefix string
+	online map[string]bool
+}
+
+// NewAvailability returns an Availability for devices published under prefix, eg. "/tuya/"
+func NewAvailability(prefix string) *Availability {
+	return &Availability{prefix: prefix, online: make(map[string]bool)}
+}
+
+// Set records whether the labelled device is reachable, publishing on the first call and on any change
+func (a *Availability) Set(m *MQTT, label string, online bool) {
+	a.mutex.Lock()
+	was, known := a.online[label]
+	a.online[label] = online
+	a.mutex.Unlock()
+	if known && was == online {
+		return
+	}
+	payload := Offline
+	if online {
+		payload = Online
+	}
+	m.PublishChan <- AghastMsgT{
+		Subtopic: a.prefix + label + availabilitySubtopic,
+		Qos:      0,
+		Retained: true,
+		Payload:  payload,
+	}
+}
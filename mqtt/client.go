@@ -0,0 +1,227 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	v5ConnectTimeout = 30 * time.Second
+	v5RequestTimeout = 10 * time.Second
+)
+
+// messageHandler is called for every message received on a subscribed topic
+type messageHandler func(msg GeneralMsgT)
+
+// client hides the differences between the MQTT protocol versions we support
+type client interface {
+	publish(topic string, qos byte, retained bool, payload interface{})
+	subscribe(topic string, qos byte, handler messageHandler)
+	unsubscribe(topic string)
+	disconnect()
+}
+
+// v3Client talks MQTT v3.1.1 via the original Paho client
+type v3Client struct {
+	client mqtt.Client
+}
+
+func newV3Client(brokerURL string, username, password, clientID string) (*v3Client, error) {
+	options := mqtt.NewClientOptions()
+	options.AddBroker(brokerURL)
+	if username != "" {
+		options.SetUsername(username)
+		options.SetPassword(password)
+	}
+	options.SetClientID(clientID)
+	options.OnConnect = func(client mqtt.Client) {
+		log.Println("INFO: AGHAST Connected to MQTT Broker")
+	}
+	options.OnConnectionLost = func(client mqtt.Client, err error) {
+		log.Printf("WARNING: MQTT Connection lost: %v", err)
+	}
+	c := &v3Client{client: mqtt.NewClient(options)}
+	if token := c.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	return c, nil
+}
+
+func (c *v3Client) publish(topic string, qos byte, retained bool, payload interface{}) {
+	c.client.Publish(topic, qos, retained, payload)
+}
+
+func (c *v3Client) subscribe(topic string, qos byte, handler messageHandler) {
+	c.client.Subscribe(topic, qos, func(client mqtt.Client, msg mqtt.Message) {
+		handler(GeneralMsgT{msg.Topic(), msg.Qos(), msg.Retained(), msg.Payload()})
+	})
+}
+
+func (c *v3Client) unsubscribe(topic string) {
+	c.client.Unsubscribe(topic)
+}
+
+func (c *v3Client) disconnect() {
+	c.client.Disconnect(100)
+}
+
+// v5Client talks MQTT v5 via the newer Paho client, which does not remember our
+// subscriptions across reconnections so we keep track of them here.
+// Messages are routed by us rather than by Paho's StandardRouter, which cannot match shared subscriptions.
+type v5Client struct {
+	cm       *autopaho.ConnectionManager
+	mutex    sync.Mutex
+	qos      map[string]byte
+	handlers map[string]messageHandler // by topic filter
+}
+
+func newV5Client(brokerURL string, username, password, clientID string) (*v5Client, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &v5Client{qos: make(map[string]byte), handlers: make(map[string]messageHandler)}
+	cfg := autopaho.ClientConfig{
+		BrokerUrls: []*url.URL{u},
+		KeepAlive:  30,
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			log.Println("INFO: AGHAST Connected to MQTT Broker (v5)")
+			c.resubscribe(cm)
+		},
+		OnConnectError: func(err error) {
+			log.Printf("WARNING: MQTT Connection attempt failed: %v", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: clientID,
+			Router:   paho.NewSingleHandlerRouter(c.route),
+			OnClientError: func(err error) {
+				log.Printf("WARNING: MQTT Connection lost: %v", err)
+			},
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				log.Printf("WARNING: MQTT Broker disconnected us, reason code: %d", d.ReasonCode)
+			},
+		},
+	}
+	if username != "" {
+		cfg.SetUsernamePassword(username, []byte(password))
+	}
+	c.cm, err = autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), v5ConnectTimeout)
+	defer cancel()
+	if err = c.cm.AwaitConnection(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// route passes a received message to the handler of every subscription which matches it
+func (c *v5Client) route(p *paho.Publish) {
+	var matched []messageHandler
+	c.mutex.Lock()
+	for filter, handler := range c.handlers {
+		if TopicMatches(p.Topic, filter) {
+			matched = append(matched, handler)
+		}
+	}
+	c.mutex.Unlock()
+	for _, handler := range matched {
+		handler(GeneralMsgT{p.Topic, p.QoS, p.Retain, p.Payload})
+	}
+}
+
+// resubscribe restores all our subscriptions after a (re)connection
+func (c *v5Client) resubscribe(cm *autopaho.ConnectionManager) {
+	c.mutex.Lock()
+	subs := make(map[string]paho.SubscribeOptions, len(c.qos))
+	for topic, qos := range c.qos {
+		subs[topic] = paho.SubscribeOptions{QoS: qos}
+	}
+	c.mutex.Unlock()
+	if len(subs) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), v5RequestTimeout)
+	defer cancel()
+	if _, err := cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: subs}); err != nil {
+		log.Printf("WARNING: MQTT could not restore subscriptions - %v\n", err)
+	}
+}
+
+func (c *v5Client) publish(topic string, qos byte, retained bool, payload interface{}) {
+	var b []byte
+	switch p := payload.(type) {
+	case []byte:
+		b = p
+	case string:
+		b = []byte(p)
+	default:
+		b = []byte(fmt.Sprintf("%v", p))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), v5RequestTimeout)
+	defer cancel()
+	if _, err := c.cm.Publish(ctx, &paho.Publish{Topic: topic, QoS: qos, Retain: retained, Payload: b}); err != nil {
+		log.Printf("WARNING: MQTT could not publish to %s - %v\n", topic, err)
+	}
+}
+
+func (c *v5Client) subscribe(topic string, qos byte, handler messageHandler) {
+	c.mutex.Lock()
+	c.qos[topic] = qos
+	c.handlers[topic] = handler // replacing any previous handler, eg. when the QoS is raised
+	c.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), v5RequestTimeout)
+	defer cancel()
+	sub := &paho.Subscribe{Subscriptions: map[string]paho.SubscribeOptions{topic: {QoS: qos}}}
+	if _, err := c.cm.Subscribe(ctx, sub); err != nil {
+		// the subscription will be retried when the connection is restored
+		log.Printf("WARNING: MQTT could not subscribe to %s - %v\n", topic, err)
+	}
+}
+
+func (c *v5Client) unsubscribe(topic string) {
+	c.mutex.Lock()
+	delete(c.qos, topic)
+	delete(c.handlers, topic)
+	c.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), v5RequestTimeout)
+	defer cancel()
+	if _, err := c.cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{topic}}); err != nil {
+		log.Printf("WARNING: MQTT could not unsubscribe from %s - %v\n", topic, err)
+	}
+}
+
+func (c *v5Client) disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c.cm.Disconnect(ctx)
+}
@@ -22,36 +22,56 @@
 package mqtt
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/SMerrony/aghast/metrics"
 )
 
 const (
-	mqttOutboundQueueLen = 100
-	mqttInboundQueueLen  = 100
+	defaultOutboundQueueLen = 100
+	defaultInboundQueueLen  = 100
+	// DefaultSubscribeQos is used for subscriptions which do not specify a QoS
+	DefaultSubscribeQos = 1
+	// a queue is nearly full when it holds this fraction of its capacity
+	queueWarnFraction = 0.9
+	// warnings about each nearly-full queue are logged at most this often
+	queueWarnInterval = time.Minute
 	// StatusSubtopic is used for sending important system-wide messages
 	StatusSubtopic = "/status"
+	// sharePrefix introduces an MQTT v5 shared subscription, eg. $share/<group>/<topic filter>
+	sharePrefix = "$share/"
 )
 
 // MQTT encapsulates a connection to an MQTT Broker
 type MQTT struct {
 	PublishChan    chan AghastMsgT
 	ThirdPartyChan chan GeneralMsgT
-	mutex          sync.RWMutex
-	client         mqtt.Client
-	options        *mqtt.ClientOptions
-	connectHandler mqtt.OnConnectHandler
-	connLostHander mqtt.ConnectionLostHandler
-	// pubHandler     mqtt.MessageHandler
-	subs      map[string][]chan GeneralMsgT
-	broker    string
-	port      int
-	username  string
-	password  string
-	baseTopic string
+	// TimestampPayloads causes AGHAST messages to be wrapped like this: {"ts": "<RFC3339 time>", "value": <payload>}
+	TimestampPayloads bool
+	// ProtocolVersion selects the MQTT protocol, 5 for v5, anything else for v3.1.1
+	ProtocolVersion int
+	// OutboundQueueLen and InboundQueueLen size the publishing and subscription channels, the defaults are used if zero
+	OutboundQueueLen int
+	InboundQueueLen  int
+	mutex            sync.RWMutex
+	client           client
+	subs             map[string][]chan GeneralMsgT
+	subQos           map[string]byte // the QoS each topic is subscribed with
+	done             chan struct{}   // closed on Disconnect to stop the publishers
+	warnMutex        sync.Mutex
+	lastWarned       map[string]time.Time // by queue
+	broker           string
+	port             int
+	username         string
+	password         string
+	baseTopic        string
 }
 
 // AghastMsgT is the type of messages sent via the AGHAST MQTT channels
@@ -70,45 +90,95 @@ type GeneralMsgT struct {
 	Payload  interface{}
 }
 
-// Disconnect from the MQTT Broker after 100ms
-func (m *MQTT) Disconnect() {
-	m.client.Disconnect(100)
+// PayloadBytes returns a received payload as a byte slice, ok is false if the payload is of an unexpected type
+func PayloadBytes(payload interface{}) (b []byte, ok bool) {
+	switch p := payload.(type) {
+	case []byte: // N.B. also covers []uint8
+		return p, true
+	case string:
+		return []byte(p), true
+	default:
+		return nil, false
+	}
 }
 
-func (m *MQTT) Start(broker string, port int, username string, password string, clientID string, baseTopic string) chan AghastMsgT {
-	m.mutex.Lock()
-	m.subs = make(map[string][]chan GeneralMsgT)
-	m.broker = broker
-	m.port = port
-	m.username = username
-	m.password = password
-	m.baseTopic = baseTopic
-	m.options = mqtt.NewClientOptions()
-	m.options.AddBroker(fmt.Sprintf("tcp://%s:%d", broker, port))
-	if username != "" {
-		m.options.SetUsername(username)
-		m.options.SetPassword(password)
+// PayloadNumber extracts a number from a received payload, or from the given key of a JSON payload
+func PayloadNumber(payload interface{}, key string) (float64, error) {
+	raw, ok := PayloadBytes(payload)
+	if !ok {
+		return 0, errors.New("unexpected payload type")
 	}
-	m.options.SetClientID(clientID)
-
-	m.connectHandler = func(client mqtt.Client) {
-		log.Println("INFO: AGHAST Connected to MQTT Broker")
+	if key == "" {
+		return strconv.ParseFloat(strings.TrimSpace(string(raw)), 64)
+	}
+	var jsonMap map[string]interface{}
+	if err := json.Unmarshal(raw, &jsonMap); err != nil {
+		return 0, errors.New("could not understand JSON " + string(raw))
+	}
+	v, found := jsonMap[key]
+	if !found {
+		return 0, errors.New("could not find Key " + key)
 	}
-	m.options.OnConnect = m.connectHandler
+	f, isNum := v.(float64)
+	if !isNum {
+		return 0, errors.New("non-numeric value for Key " + key)
+	}
+	return f, nil
+}
 
-	m.connLostHander = func(client mqtt.Client, err error) {
-		log.Printf("WARNING: MQTT Connection lost: %v", err)
+// SubscribeQos checks an optional configured QoS, returning DefaultSubscribeQos if none was given
+func SubscribeQos(qos *int) (byte, error) {
+	if qos == nil {
+		return DefaultSubscribeQos, nil
 	}
-	m.options.OnConnectionLost = m.connLostHander
+	if *qos < 0 || *qos > 2 {
+		return 0, fmt.Errorf("invalid MQTT QoS %d, must be 0, 1, or 2", *qos)
+	}
+	return byte(*qos), nil
+}
 
-	m.client = mqtt.NewClient(m.options)
-	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+// SharedTopic returns the MQTT v5 shared subscription for filter in the given group,
+// each message published to a shared subscription is delivered to only one member of the group
+func SharedTopic(group, filter string) string {
+	return sharePrefix + group + "/" + filter
+}
+
+// TopicMatches reports whether topic is matched by the subscription filter, which may contain + and # wildcards
+// and may be a shared subscription
+func TopicMatches(topic, filter string) bool {
+	if strings.HasPrefix(filter, sharePrefix) {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		filter = parts[2]
 	}
+	topicLevels := strings.Split(topic, "/")
+	filterLevels := strings.Split(filter, "/")
+	for i, f := range filterLevels {
+		if f == "#" && i == len(filterLevels)-1 {
+			return true
+		}
+		if i >= len(topicLevels) || (f != "+" && f != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(topicLevels) == len(filterLevels)
+}
 
-	m.PublishChan = make(chan AghastMsgT, mqttOutboundQueueLen)
-	m.ThirdPartyChan = make(chan GeneralMsgT, mqttOutboundQueueLen)
+// Disconnect from the MQTT Broker after 100ms
+func (m *MQTT) Disconnect() {
+	close(m.done)
+	m.client.disconnect()
+}
 
+func (m *MQTT) Start(broker string, port int, username string, password string, clientID string, baseTopic string) chan AghastMsgT {
+	if err := m.connect(broker, port, username, password, clientID); err != nil {
+		panic(err)
+	}
+	m.mutex.Lock()
+	m.baseTopic = baseTopic
+	m.PublishChan = make(chan AghastMsgT, m.OutboundQueueLen)
 	m.mutex.Unlock()
 
 	go m.aghastPublish()
@@ -126,28 +196,131 @@ func (m *MQTT) Start(broker string, port int, username string, password string,
 
 }
 
+// Connect returns a connection to another Broker, eg. for bridging, which may only be used for
+// subscriptions and third-party messages, ie. it has no PublishChan
+func Connect(broker string, port int, username, password, clientID string, protocolVersion int) (*MQTT, error) {
+	m := &MQTT{ProtocolVersion: protocolVersion}
+	if err := m.connect(broker, port, username, password, clientID); err != nil {
+		return nil, err
+	}
+	go m.thirdPartyPublish()
+	return m, nil
+}
+
+// connect creates the client for the configured protocol version and the queues common to all connections
+func (m *MQTT) connect(broker string, port int, username, password, clientID string) (err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.subs = make(map[string][]chan GeneralMsgT)
+	m.subQos = make(map[string]byte)
+	m.broker = broker
+	m.port = port
+	m.username = username
+	m.password = password
+	brokerURL := fmt.Sprintf("tcp://%s:%d", broker, port)
+	if m.ProtocolVersion == 5 {
+		m.client, err = newV5Client(brokerURL, username, password, clientID)
+	} else {
+		m.client, err = newV3Client(brokerURL, username, password, clientID)
+	}
+	if err != nil {
+		return err
+	}
+	if m.OutboundQueueLen <= 0 {
+		m.OutboundQueueLen = defaultOutboundQueueLen
+	}
+	if m.InboundQueueLen <= 0 {
+		m.InboundQueueLen = defaultInboundQueueLen
+	}
+	m.lastWarned = make(map[string]time.Time)
+	m.ThirdPartyChan = make(chan GeneralMsgT, m.OutboundQueueLen)
+	m.done = make(chan struct{})
+	return nil
+}
+
 // aghastPublish sends messages to any MQTT listeners via the configured Broker
 func (m *MQTT) aghastPublish() {
 	for {
-		msg := <-m.PublishChan
-		m.client.Publish(m.baseTopic+msg.Subtopic, msg.Qos, msg.Retained, msg.Payload)
+		var msg AghastMsgT
+		select {
+		case <-m.done:
+			return
+		case msg = <-m.PublishChan:
+		}
+		m.checkQueue("AGHAST outbound", len(m.PublishChan), cap(m.PublishChan))
+		payload := msg.Payload
+		if m.TimestampPayloads {
+			payload = timestamped(payload)
+		}
+		m.client.publish(m.baseTopic+msg.Subtopic, msg.Qos, msg.Retained, payload)
+		metrics.MqttSent.Inc()
 	}
 }
 
+// checkQueue logs a warning, at most once per queueWarnInterval for each queue, when it is nearly full
+// so that its size may be increased before messages back up
+func (m *MQTT) checkQueue(name string, length, capacity int) {
+	if capacity == 0 || float64(length) < queueWarnFraction*float64(capacity) {
+		return
+	}
+	m.warnMutex.Lock()
+	defer m.warnMutex.Unlock()
+	if time.Since(m.lastWarned[name]) < queueWarnInterval {
+		return
+	}
+	m.lastWarned[name] = time.Now()
+	log.Printf("WARNING: MQTT %s queue is nearly full (%d of %d messages)\n", name, length, capacity)
+}
+
+// timestamped wraps a payload in a JSON envelope with the current time,
+// payloads which are already valid JSON are embedded as-is, anything else becomes a JSON string.
+func timestamped(payload interface{}) []byte {
+	type envelopeT struct {
+		Ts    string          `json:"ts"`
+		Value json.RawMessage `json:"value"`
+	}
+	var raw []byte
+	switch p := payload.(type) {
+	case []byte:
+		raw = p
+	case string:
+		raw = []byte(p)
+	default:
+		raw = []byte(fmt.Sprintf("%v", p))
+	}
+	if !json.Valid(raw) {
+		raw, _ = json.Marshal(string(raw))
+	}
+	wrapped, err := json.Marshal(envelopeT{Ts: time.Now().Format(time.RFC3339), Value: raw})
+	if err != nil {
+		log.Printf("WARNING: MQTT could not add timestamp to payload - %v\n", err)
+		return raw
+	}
+	return wrapped
+}
+
 // thirdPartyPublish is used to send non-Aghast messages
 func (m *MQTT) thirdPartyPublish() {
 	for {
-		msg := <-m.ThirdPartyChan
-		m.client.Publish(msg.Topic, msg.Qos, msg.Retained, msg.Payload)
+		var msg GeneralMsgT
+		select {
+		case <-m.done:
+			return
+		case msg = <-m.ThirdPartyChan:
+		}
+		m.checkQueue("third-party outbound", len(m.ThirdPartyChan), cap(m.ThirdPartyChan))
+		m.client.publish(msg.Topic, msg.Qos, msg.Retained, msg.Payload)
+		metrics.MqttSent.Inc()
 	}
 }
 
-func (m *MQTT) fanOut(topic string) {
-	m.client.Subscribe(topic, 1, func(client mqtt.Client, msg mqtt.Message) {
-		cMsg := GeneralMsgT{msg.Topic(), msg.Qos(), msg.Retained(), msg.Payload()}
+func (m *MQTT) fanOut(topic string, qos byte) {
+	m.client.subscribe(topic, qos, func(cMsg GeneralMsgT) {
+		metrics.MqttReceived.Inc()
 		m.mutex.RLock()
-		// log.Printf("DEBUG: mqtt.fanout got a message on %s\n", msg.Topic())
+		// log.Printf("DEBUG: mqtt.fanout got a message on %s\n", cMsg.Topic)
 		for _, subChans := range m.subs[topic] {
+			m.checkQueue("inbound "+topic, len(subChans), cap(subChans))
 			subChans <- cMsg
 			// log.Println("DEBUG: ... mqtt.fanout forwarding message")
 		}
@@ -156,32 +329,46 @@ func (m *MQTT) fanOut(topic string) {
 	})
 }
 
-func (m *MQTT) subscribeAndMap(ch chan GeneralMsgT, topic string) {
-	m.mutex.RLock()
-	_, already := m.subs[topic]
-	m.mutex.RUnlock()
-	if !already {
-		m.client.Subscribe(topic, 1, func(client mqtt.Client, msg mqtt.Message) {
-			cMsg := GeneralMsgT{msg.Topic(), msg.Qos(), msg.Retained(), msg.Payload()}
-			ch <- cMsg
-		})
-		go m.fanOut(topic)
+// subscribeAndMap adds ch to the fan-out list for topic, subscribing to the Broker if this is the
+// first subscriber or if it needs a higher QoS than the existing ones
+func (m *MQTT) subscribeAndMap(ch chan GeneralMsgT, topic string, qos byte) {
+	if strings.HasPrefix(topic, sharePrefix) && m.ProtocolVersion != 5 {
+		log.Printf("WARNING: MQTT - shared subscription %s may not be supported unless MqttVersion is 5\n", topic)
 	}
 	m.mutex.Lock()
+	current, already := m.subQos[topic]
 	m.subs[topic] = append(m.subs[topic], ch)
+	subscribe := !already || qos > current
+	if subscribe {
+		m.subQos[topic] = qos
+	}
 	m.mutex.Unlock()
+	if subscribe {
+		m.fanOut(topic, qos)
+	}
 }
 
 // SubscribeToTopic returns a channel which will receive any MQTT messages published to the topic
 func (m *MQTT) SubscribeToTopic(topic string) chan GeneralMsgT {
-	c := make(chan GeneralMsgT, mqttInboundQueueLen)
-	m.subscribeAndMap(c, topic)
+	return m.SubscribeToTopicQos(topic, DefaultSubscribeQos)
+}
+
+// SubscribeToTopicQos is SubscribeToTopic with the given QoS, if the topic is already subscribed
+// the higher of the QoS levels is used
+func (m *MQTT) SubscribeToTopicQos(topic string, qos byte) chan GeneralMsgT {
+	c := make(chan GeneralMsgT, m.InboundQueueLen)
+	m.subscribeAndMap(c, topic, qos)
 	return c
 }
 
 // SubscribeToTopicUsingChan uses the provided chan to receive any MQTT messages published to the topic
 func (m *MQTT) SubscribeToTopicUsingChan(topic string, c chan GeneralMsgT) {
-	m.subscribeAndMap(c, topic)
+	m.subscribeAndMap(c, topic, DefaultSubscribeQos)
+}
+
+// SubscribeToTopicUsingChanQos is SubscribeToTopicUsingChan with the given QoS
+func (m *MQTT) SubscribeToTopicUsingChanQos(topic string, c chan GeneralMsgT, qos byte) {
+	m.subscribeAndMap(c, topic, qos)
 }
 
 func removeChan(chans []chan GeneralMsgT, i int) []chan GeneralMsgT {
@@ -203,13 +390,15 @@ func (m *MQTT) UnsubscribeFromTopic(topic string, ch chan GeneralMsgT) {
 		if subbedChan == ch {
 			m.mutex.Lock()
 			if len(subs) == 1 {
-				// this is the only subscriber, so unsubscribe
-				m.client.Unsubscribe(topic)
-				m.subs[topic] = nil
-			} else {
-				// there are other subscribers, so just remove from the fan-out list
-				m.subs[topic] = removeChan(subs, ix)
+				// this is the only subscriber, so unsubscribe (outside the lock as it may wait for the Broker)
+				delete(m.subs, topic)
+				delete(m.subQos, topic)
+				m.mutex.Unlock()
+				m.client.unsubscribe(topic)
+				return
 			}
+			// there are other subscribers, so just remove from the fan-out list
+			m.subs[topic] = removeChan(subs, ix)
 			m.mutex.Unlock()
 			return
 		}
@@ -0,0 +1,91 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package mqtt_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/mqtt/mqtttest"
+)
+
+func TestSharedSubscription(t *testing.T) {
+	b := mqtttest.NewBroker(t)
+	shared := mqtt.SharedTopic("workers", "test/jobs/+")
+	// v5 subscriptions are acknowledged before SubscribeToTopic returns
+	worker1 := mqtttest.ConnectClient(t, b, "worker1", 5).SubscribeToTopic(shared)
+	worker2 := mqtttest.ConnectClient(t, b, "worker2", 5).SubscribeToTopic(shared)
+	monitor := mqtttest.ConnectClient(t, b, "monitor", 5).SubscribeToTopic("test/jobs/#")
+
+	const jobs = 10
+	for i := 0; i < jobs; i++ {
+		b.Publish("test/jobs/"+string(rune('a'+i)), []byte("job"), false)
+	}
+	seen := make(map[string]int)
+	monitored := 0
+	timeout := time.After(mqtttest.Timeout)
+	for len(seen) < jobs || monitored < jobs {
+		select {
+		case msg := <-worker1:
+			seen[msg.Topic]++
+		case msg := <-worker2:
+			seen[msg.Topic]++
+		case <-monitor:
+			monitored++
+		case <-timeout:
+			t.Fatalf("received %d shared and %d monitored messages, expected %d of each", len(seen), monitored, jobs)
+		}
+	}
+	select {
+	case msg := <-worker1:
+		seen[msg.Topic]++
+	case msg := <-worker2:
+		seen[msg.Topic]++
+	case <-time.After(100 * time.Millisecond):
+	}
+	for topic, n := range seen {
+		if n != 1 {
+			t.Errorf("%s was delivered to the shared subscription %d times", topic, n)
+		}
+	}
+}
+
+func TestPayloadNumber(t *testing.T) {
+	tests := []struct {
+		payload interface{}
+		key     string
+		want    float64
+		wantErr bool
+	}{
+		{[]byte("21.5"), "", 21.5, false},
+		{" 7\n", "", 7, false},
+		{[]byte(`{"temperature": 19.25}`), "temperature", 19.25, false},
+		{[]byte(`{"temperature": "warm"}`), "temperature", 0, true},
+		{[]byte(`{"humidity": 50}`), "temperature", 0, true},
+		{[]byte("n/a"), "", 0, true},
+		{42, "", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := mqtt.PayloadNumber(tt.payload, tt.key)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("PayloadNumber(%v, %q) = %v, %v", tt.payload, tt.key, got, err)
+		}
+	}
+}
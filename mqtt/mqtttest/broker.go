@@ -0,0 +1,547 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package mqtttest provides an embedded MQTT v3.1.1 and v5 Broker, and helpers for connecting to it,
+// so that Integrations may be tested end-to-end without a real Broker.
+// The Broker supports just what AGHAST uses: QoS 0 and 1 (QoS 2 is accepted but delivered at QoS 1),
+// wildcards, retained messages, and shared subscriptions.  It has no authentication, sessions, or will messages,
+// and any v5 properties sent to it are ignored.
+package mqtttest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SMerrony/aghast/mqtt"
+)
+
+// Timeout is how long the helpers wait for something to happen before failing the test
+var Timeout = 5 * time.Second
+
+// MQTT control packet types
+const (
+	connect     = 1
+	connack     = 2
+	publish     = 3
+	puback      = 4
+	pubrec      = 5
+	pubrel      = 6
+	pubcomp     = 7
+	subscribe   = 8
+	suback      = 9
+	unsubscribe = 10
+	unsuback    = 11
+	pingreq     = 12
+	pingresp    = 13
+	disconnect  = 14
+
+	protocolV5  = 5
+	sharePrefix = "$share/"
+)
+
+// Message is a message published via the Broker
+type Message struct {
+	Topic    string
+	Payload  []byte
+	Retained bool
+}
+
+// Broker is an embedded MQTT Broker listening on a random local port
+type Broker struct {
+	t        testing.TB
+	listener net.Listener
+	mutex    sync.Mutex
+	clients  map[*clientConn]bool
+	watchers map[string][]chan Message // in-process subscribers, by topic filter
+	retained map[string]Message
+	wg       sync.WaitGroup
+}
+
+type clientConn struct {
+	conn     net.Conn
+	writeMu  sync.Mutex
+	subs     map[string]byte // topic filter to QoS, guarded by the Broker's mutex
+	packetID uint16          // guarded by writeMu
+	v5       bool            // set by CONNECT, before any other packet is handled
+}
+
+// delivery is a message waiting to be sent to a client once the Broker's mutex has been released
+type delivery struct {
+	c   *clientConn
+	msg Message
+	qos byte
+}
+
+// NewBroker starts a Broker which is closed when the test finishes
+func NewBroker(t testing.TB) *Broker {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("mqtttest could not listen - %v", err)
+	}
+	b := &Broker{
+		t:        t,
+		listener: l,
+		clients:  make(map[*clientConn]bool),
+		watchers: make(map[string][]chan Message),
+		retained: make(map[string]Message),
+	}
+	b.wg.Add(1)
+	go b.accept()
+	t.Cleanup(b.Close)
+	return b
+}
+
+// Port returns the port the Broker is listening on
+func (b *Broker) Port() int {
+	return b.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close disconnects every client and stops the Broker
+func (b *Broker) Close() {
+	b.listener.Close()
+	b.mutex.Lock()
+	for c := range b.clients {
+		c.conn.Close()
+	}
+	b.mutex.Unlock()
+	b.wg.Wait()
+}
+
+// Connect returns a started AGHAST MQTT connection to the Broker, with the base topic "aghast",
+// which is disconnected when the test finishes
+func Connect(t testing.TB, b *Broker) *mqtt.MQTT {
+	t.Helper()
+	return ConnectClient(t, b, t.Name(), 0)
+}
+
+// ConnectClient is Connect with the given client ID and MQTT protocol version, 5 for v5, anything else for v3.1.1
+func ConnectClient(t testing.TB, b *Broker, clientID string, protocolVersion int) *mqtt.MQTT {
+	t.Helper()
+	mq := &mqtt.MQTT{ProtocolVersion: protocolVersion}
+	mq.Start("127.0.0.1", b.Port(), "", "", clientID, "aghast")
+	t.Cleanup(mq.Disconnect)
+	return mq
+}
+
+// ConfigDir returns a temporary configuration directory holding the given files, by name relative to the
+// directory, plus empty secrets.toml and constants.toml files unless they are given
+func ConfigDir(t testing.TB, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	all := map[string]string{"secrets.toml": "", "constants.toml": ""}
+	for name, content := range files {
+		all[name] = content
+	}
+	for name, content := range all {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// Publish sends a message to the Broker's subscribers, as if a device had published it
+func (b *Broker) Publish(topic string, payload []byte, retained bool) {
+	b.route(Message{Topic: topic, Payload: payload, Retained: retained}, 0)
+}
+
+// Watch returns a channel which receives every message published to topics matching filter,
+// unlike a client subscription it is in place as soon as Watch returns.
+// Messages which would overflow the channel are dropped, failing the test.
+func (b *Broker) Watch(filter string) <-chan Message {
+	ch := make(chan Message, 100)
+	b.mutex.Lock()
+	b.watchers[filter] = append(b.watchers[filter], ch)
+	b.mutex.Unlock()
+	return ch
+}
+
+// Receive returns the next message from a Watch channel, failing the test if none arrives in time
+func Receive(t testing.TB, ch <-chan Message) Message {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(Timeout):
+		t.Fatal("mqtttest timed out waiting for a message")
+	}
+	return Message{}
+}
+
+// WaitForSubscriber waits until a client has subscribed to exactly the filter, failing the test if none does in time.
+// AGHAST does not wait for subscriptions to be acknowledged, so tests should call this before publishing.
+func (b *Broker) WaitForSubscriber(t testing.TB, filter string) {
+	t.Helper()
+	deadline := time.Now().Add(Timeout)
+	for time.Now().Before(deadline) {
+		b.mutex.Lock()
+		for c := range b.clients {
+			if _, found := c.subs[filter]; found {
+				b.mutex.Unlock()
+				return
+			}
+		}
+		b.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("mqtttest timed out waiting for a subscription to %s", filter)
+}
+
+func (b *Broker) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &clientConn{conn: conn, subs: make(map[string]byte)}
+		b.mutex.Lock()
+		b.clients[c] = true
+		b.mutex.Unlock()
+		b.wg.Add(1)
+		go b.serve(c)
+	}
+}
+
+// serve handles the packets from one client until it disconnects
+func (b *Broker) serve(c *clientConn) {
+	defer b.wg.Done()
+	defer func() {
+		b.mutex.Lock()
+		delete(b.clients, c)
+		b.mutex.Unlock()
+		c.conn.Close()
+	}()
+	r := bufio.NewReader(c.conn)
+	for {
+		header, body, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case connect:
+			if _, rest, ok := readString(body); ok && len(rest) > 0 {
+				c.v5 = rest[0] == protocolV5
+			}
+			if c.v5 {
+				c.write(connack<<4, []byte{0, 0, 0})
+			} else {
+				c.write(connack<<4, []byte{0, 0})
+			}
+		case publish:
+			b.received(c, header, body)
+		case pubrel:
+			c.write(pubcomp<<4, body[:2])
+		case subscribe:
+			b.subscribe(c, body)
+		case unsubscribe:
+			b.unsubscribe(c, body)
+		case pingreq:
+			c.write(pingresp<<4, nil)
+		case disconnect:
+			return
+		}
+		// PUBACKs etc. for messages we deliver are not needed
+	}
+}
+
+// received handles a PUBLISH from a client
+func (b *Broker) received(c *clientConn, header byte, body []byte) {
+	qos := (header >> 1) & 3
+	topic, rest, ok := readString(body)
+	if !ok {
+		return
+	}
+	if qos > 0 {
+		if len(rest) < 2 {
+			return
+		}
+		id := rest[:2]
+		rest = rest[2:]
+		if qos == 1 {
+			c.write(puback<<4, id)
+		} else {
+			c.write(pubrec<<4, id)
+		}
+	}
+	if c.v5 {
+		if rest, ok = skipProperties(rest); !ok {
+			return
+		}
+	}
+	payload := append([]byte(nil), rest...)
+	b.route(Message{Topic: topic, Payload: payload, Retained: header&1 == 1}, qos)
+}
+
+// route stores any retained message and delivers it to every matching subscriber,
+// nothing is sent while the Broker's mutex is held so that a stalled receiver cannot stall the Broker
+func (b *Broker) route(msg Message, qos byte) {
+	var (
+		deliveries []delivery
+		watchers   []chan Message
+	)
+	b.mutex.Lock()
+	if msg.Retained {
+		if len(msg.Payload) == 0 {
+			delete(b.retained, msg.Topic)
+		} else {
+			b.retained[msg.Topic] = msg
+		}
+	}
+	// N.B. live messages are delivered without the retain flag, as a real Broker would
+	live := Message{Topic: msg.Topic, Payload: msg.Payload}
+	shared := make(map[string]delivery) // one member of each matching shared subscription, by filter
+	for c := range b.clients {
+		delivered := false
+		for filter, subQos := range c.subs {
+			if !mqtt.TopicMatches(msg.Topic, filter) {
+				continue
+			}
+			if strings.HasPrefix(filter, sharePrefix) {
+				shared[filter] = delivery{c, live, min(qos, subQos)} // the clients are visited in random order
+			} else if !delivered {
+				deliveries = append(deliveries, delivery{c, live, min(qos, subQos)})
+				delivered = true
+			}
+		}
+	}
+	for _, d := range shared {
+		deliveries = append(deliveries, d)
+	}
+	for filter, chans := range b.watchers {
+		if mqtt.TopicMatches(msg.Topic, filter) {
+			watchers = append(watchers, chans...)
+		}
+	}
+	b.mutex.Unlock()
+	for _, d := range deliveries {
+		d.c.deliver(d.msg, d.qos)
+	}
+	for _, ch := range watchers {
+		select {
+		case ch <- msg:
+		default:
+			b.t.Errorf("mqtttest dropped a message to %s as a Watch channel is full", msg.Topic)
+		}
+	}
+}
+
+func (b *Broker) subscribe(c *clientConn, body []byte) {
+	if len(body) < 2 {
+		return
+	}
+	ack := append([]byte(nil), body[:2]...)
+	rest, ok := body[2:], true
+	if c.v5 {
+		if rest, ok = skipProperties(rest); !ok {
+			return
+		}
+		ack = append(ack, 0)
+	}
+	var filters []string
+	b.mutex.Lock()
+	for len(rest) > 0 {
+		filter, after, ok := readString(rest)
+		if !ok || len(after) < 1 {
+			break
+		}
+		qos := min(after[0]&3, 1)
+		c.subs[filter] = qos
+		filters = append(filters, filter)
+		ack = append(ack, qos)
+		rest = after[1:]
+	}
+	var deliveries []delivery
+	for _, filter := range filters {
+		if strings.HasPrefix(filter, sharePrefix) {
+			continue // retained messages are not sent to shared subscriptions
+		}
+		for _, msg := range b.retained {
+			if mqtt.TopicMatches(msg.Topic, filter) {
+				deliveries = append(deliveries, delivery{c, msg, c.subs[filter]})
+			}
+		}
+	}
+	b.mutex.Unlock()
+	c.write(suback<<4, ack)
+	for _, d := range deliveries {
+		c.deliver(d.msg, d.qos)
+	}
+}
+
+func (b *Broker) unsubscribe(c *clientConn, body []byte) {
+	if len(body) < 2 {
+		return
+	}
+	ack := append([]byte(nil), body[:2]...)
+	rest, ok := body[2:], true
+	if c.v5 {
+		if rest, ok = skipProperties(rest); !ok {
+			return
+		}
+		ack = append(ack, 0)
+	}
+	b.mutex.Lock()
+	for len(rest) > 0 {
+		filter, after, ok := readString(rest)
+		if !ok {
+			break
+		}
+		delete(c.subs, filter)
+		if c.v5 {
+			ack = append(ack, 0)
+		}
+		rest = after
+	}
+	b.mutex.Unlock()
+	c.write(unsuback<<4, ack)
+}
+
+// deliver sends a PUBLISH to the client
+func (c *clientConn) deliver(msg Message, qos byte) {
+	header := byte(publish<<4) | qos<<1
+	if msg.Retained {
+		header |= 1
+	}
+	body := appendString(nil, msg.Topic)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if qos > 0 {
+		c.packetID++
+		if c.packetID == 0 {
+			c.packetID = 1
+		}
+		body = append(body, byte(c.packetID>>8), byte(c.packetID))
+	}
+	if c.v5 {
+		body = append(body, 0) // no properties
+	}
+	c.writeLocked(header, append(body, msg.Payload...))
+}
+
+// write sends a packet, errors are ignored as the reader will notice the broken connection
+func (c *clientConn) write(header byte, body []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.writeLocked(header, body)
+}
+
+// writeLocked is write with writeMu held, a client which does not accept the packet in time is disconnected
+func (c *clientConn) writeLocked(header byte, body []byte) {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(Timeout))
+	if _, err := c.conn.Write(append(packet, body...)); err != nil {
+		c.conn.Close()
+	}
+}
+
+// readPacket returns the first byte of the fixed header, and the remainder of a packet
+func readPacket(r *bufio.Reader) (header byte, body []byte, err error) {
+	if header, err = r.ReadByte(); err != nil {
+		return 0, nil, err
+	}
+	length, err := readVarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	body = make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+// readVarint reads an MQTT variable byte integer
+func readVarint(r io.ByteReader) (n int, err error) {
+	multiplier := 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			return n, nil
+		}
+		if i == 3 {
+			return 0, errors.New("malformed variable byte integer")
+		}
+		multiplier *= 128
+	}
+}
+
+// skipProperties returns the bytes which follow a v5 property list
+func skipProperties(b []byte) (rest []byte, ok bool) {
+	r := bytes.NewReader(b)
+	n, err := readVarint(r)
+	if err != nil || n > r.Len() {
+		return nil, false
+	}
+	return b[len(b)-r.Len()+n:], true
+}
+
+// readString reads a length-prefixed UTF-8 string, returning the bytes which follow it
+func readString(b []byte) (s string, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return "", nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, false
+	}
+	return string(b[2 : 2+n]), b[2+n:], true
+}
+
+func appendString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+func min(a, b byte) byte {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,100 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package mqtttest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SMerrony/aghast/mqtt"
+)
+
+func receiveMQ(t *testing.T, ch chan mqtt.GeneralMsgT) mqtt.GeneralMsgT {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(Timeout):
+		t.Fatal("timed out waiting for a message")
+	}
+	return mqtt.GeneralMsgT{}
+}
+
+func TestBroker(t *testing.T) {
+	b := NewBroker(t)
+	mq := Connect(t, b)
+
+	ch := mq.SubscribeToTopic("test/+")
+	b.WaitForSubscriber(t, "test/+")
+	b.Publish("test/one", []byte("hello"), false)
+	b.Publish("other/one", []byte("ignored"), false)
+	b.Publish("test/two", []byte("world"), false)
+	if msg := receiveMQ(t, ch); msg.Topic != "test/one" || string(msg.Payload.([]byte)) != "hello" {
+		t.Errorf("received %s %s, expected test/one hello", msg.Topic, msg.Payload)
+	}
+	if msg := receiveMQ(t, ch); msg.Topic != "test/two" || msg.Retained {
+		t.Errorf("received %s retained %v, expected test/two not retained", msg.Topic, msg.Retained)
+	}
+
+	b.Publish("retained/topic", []byte("kept"), true)
+	retChan := mq.SubscribeToTopic("retained/#")
+	if msg := receiveMQ(t, retChan); msg.Topic != "retained/topic" || !msg.Retained {
+		t.Errorf("received %s retained %v, expected retained/topic retained", msg.Topic, msg.Retained)
+	}
+
+	out := b.Watch("aghast/test/#")
+	mq.PublishChan <- mqtt.AghastMsgT{Subtopic: "/test/out", Qos: 1, Payload: "sent"}
+	if msg := Receive(t, out); msg.Topic != "aghast/test/out" || string(msg.Payload) != "sent" {
+		t.Errorf("watched %s %s, expected aghast/test/out sent", msg.Topic, msg.Payload)
+	}
+}
+
+// errorCounter records errors instead of failing the test
+type errorCounter struct {
+	testing.TB
+	mutex  sync.Mutex
+	errors int
+}
+
+func (e *errorCounter) Errorf(format string, args ...interface{}) {
+	e.mutex.Lock()
+	e.errors++
+	e.mutex.Unlock()
+}
+
+func TestStalledWatcher(t *testing.T) {
+	tb := &errorCounter{TB: t}
+	b := NewBroker(tb)
+	b.Watch("test/#") // never drained
+	live := b.Watch("test/last")
+	for i := 0; i < 150; i++ {
+		b.Publish("test/flood", []byte("x"), false)
+	}
+	b.Publish("test/last", []byte("done"), false)
+	if msg := Receive(t, live); string(msg.Payload) != "done" {
+		t.Errorf("watched %s, expected done", msg.Payload)
+	}
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	if tb.errors != 51 {
+		t.Errorf("%d dropped messages were reported, expected 51", tb.errors)
+	}
+}
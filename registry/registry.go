@@ -0,0 +1,105 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package registry records which devices each running Integration handles via the event bus,
+// so that Automations, Scenes and the admin page can check their targets.
+package registry
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Devices describes the devices an Integration handles via the event bus
+type Devices struct {
+	Integration string              // as used in event names, eg. "VirtualSwitch"
+	Labels      map[string][]string // device labels by device type, eg. events.ActionControlDeviceType
+}
+
+var (
+	mutex   sync.RWMutex
+	devices = make(map[string]Devices) // by Integration
+)
+
+// Register records (or replaces) the devices handled by an Integration
+func Register(d Devices) {
+	mutex.Lock()
+	devices[d.Integration] = d
+	mutex.Unlock()
+}
+
+// Remove forgets the devices of an Integration, eg. when it is stopped
+func Remove(integration string) {
+	mutex.Lock()
+	delete(devices, integration)
+	mutex.Unlock()
+}
+
+// All returns every registered Integration's devices, sorted by Integration
+func All() []Devices {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	all := make([]Devices, 0, len(devices))
+	for _, d := range devices {
+		all = append(all, d)
+	}
+	sort.Slice(all, func(a, b int) bool { return all[a].Integration < all[b].Integration })
+	return all
+}
+
+// Check returns a descriptive error if the Integration is not running or does not provide the labelled device
+func Check(integration, deviceType, label string) error {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	d, found := devices[integration]
+	if !found {
+		for name := range devices {
+			if strings.EqualFold(name, integration) {
+				return fmt.Errorf("unknown Integration '%s', did you mean '%s'?", integration, name)
+			}
+		}
+		var names []string
+		for name := range devices {
+			names = append(names, name)
+		}
+		return fmt.Errorf("unknown Integration '%s' (or it has not started), known Integrations are: %s", integration, sortedList(names))
+	}
+	labels, found := d.Labels[deviceType]
+	if !found {
+		var types []string
+		for t := range d.Labels {
+			types = append(types, t)
+		}
+		return fmt.Errorf("Integration '%s' has no %s devices, it provides: %s", integration, deviceType, sortedList(types))
+	}
+	for _, l := range labels {
+		if l == label {
+			return nil
+		}
+	}
+	return fmt.Errorf("Integration '%s' has no %s device '%s', its devices are: %s", integration, deviceType, label, sortedList(labels))
+}
+
+func sortedList(names []string) string {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ", ")
+}
@@ -0,0 +1,52 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package registry
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	Register(Devices{Integration: "VirtualSwitch", Labels: map[string][]string{"Control": {"Holiday", "Guests"}}})
+	tests := []struct {
+		integration, deviceType, label string
+		wantErr                        string // substring of the expected error, empty if none
+	}{
+		{"VirtualSwitch", "Control", "Guests", ""},
+		{"Virtualswitch", "Control", "Guests", "did you mean 'VirtualSwitch'"},
+		{"Tuya", "Control", "Lamp", "unknown Integration 'Tuya'"},
+		{"VirtualSwitch", "Query", "Guests", "it provides: Control"},
+		{"VirtualSwitch", "Control", "Guest", "its devices are: Guests, Holiday"},
+	}
+	for _, tt := range tests {
+		err := Check(tt.integration, tt.deviceType, tt.label)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s/%s/%s: unexpected error %v", tt.integration, tt.deviceType, tt.label, err)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s/%s/%s: got error %v, expected it to contain %q", tt.integration, tt.deviceType, tt.label, err, tt.wantErr)
+		}
+	}
+	Remove("VirtualSwitch")
+	if len(All()) != 0 {
+		t.Error("Integration was not removed")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package safego provides a wrapper for Goroutines so that an unexpected panic is
+// logged (and optionally the Goroutine restarted) rather than bringing down the whole server.
+package safego
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+const maxRestarts = 5
+
+// restartPause is a variable so that tests need not wait
+var restartPause = 5 * time.Second
+
+// Go launches fn in a new Goroutine.  If fn panics the panic is recovered and logged and,
+// if restart is true, fn is run again after a short pause.
+// To be safely restartable fn must not leave subscriptions, stop channels, or locks behind when it panics.
+func Go(name string, restart bool, fn func()) {
+	go run(name, restart, fn)
+}
+
+func run(name string, restart bool, fn func()) {
+	for restarts := 0; ; restarts++ {
+		if !runOnce(name, fn) || !restart {
+			return
+		}
+		if restarts == maxRestarts {
+			log.Printf("ERROR: %s has panicked too many times, it will not be restarted\n", name)
+			return
+		}
+		time.Sleep(restartPause)
+		log.Printf("WARNING: Restarting %s after panic\n", name)
+	}
+}
+
+// runOnce calls fn, returning true if it panicked
+func runOnce(name string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: %s panicked - %v\n%s", name, r, debug.Stack())
+			panicked = true
+		}
+	}()
+	fn()
+	return false
+}
@@ -0,0 +1,121 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package safego
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRestart(t *testing.T) {
+	restartPause = time.Millisecond
+	var calls int32
+	run("test", true, func() {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			panic("first call")
+		}
+	})
+	if calls != 2 {
+		t.Errorf("called %d times, expected a panic then a successful restart", calls)
+	}
+
+	calls = 0
+	run("test", false, func() {
+		atomic.AddInt32(&calls, 1)
+		panic("not restarted")
+	})
+	if calls != 1 {
+		t.Errorf("called %d times without restart, expected 1", calls)
+	}
+}
+
+func TestMaxRestarts(t *testing.T) {
+	restartPause = time.Millisecond
+	var calls int32
+	run("test", true, func() {
+		atomic.AddInt32(&calls, 1)
+		panic("always")
+	})
+	if calls != maxRestarts+1 {
+		t.Errorf("called %d times, expected %d", calls, maxRestarts+1)
+	}
+}
+
+func TestStopperStop(t *testing.T) {
+	var s Stopper
+	for _, name := range []string{"one", "two"} {
+		s.Go(name, true, func(stopChan chan bool) { <-stopChan })
+	}
+	s.Go("finished", false, func(stopChan chan bool) {})
+	if !s.Stop() {
+		t.Error("Stop reported that a Goroutine did not stop")
+	}
+	if !s.Stop() {
+		t.Error("Stop of an empty Stopper reported a failure")
+	}
+}
+
+func TestStopperTimeout(t *testing.T) {
+	stopTimeout = 50 * time.Millisecond
+	defer func() { stopTimeout = StopTimeout }()
+	var s Stopper
+	release := make(chan struct{})
+	defer close(release)
+	s.Go("stuck", false, func(stopChan chan bool) { <-release })
+	s.Go("prompt", false, func(stopChan chan bool) { <-stopChan })
+	started := time.Now()
+	if s.Stop() {
+		t.Error("Stop did not report the stuck Goroutine")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Stop took %v, expected about %v", elapsed, stopTimeout)
+	}
+}
+
+func TestStopOne(t *testing.T) {
+	stopTimeout = 50 * time.Millisecond
+	defer func() { stopTimeout = StopTimeout }()
+	var s Stopper
+	stopped := make(chan string, 2)
+	for _, name := range []string{"one", "two"} {
+		name := name
+		s.Go(name, false, func(stopChan chan bool) {
+			<-stopChan
+			stopped <- name
+		})
+	}
+	if !s.StopOne("one") {
+		t.Error("StopOne reported that one did not stop")
+	}
+	if name := <-stopped; name != "one" {
+		t.Errorf("StopOne stopped %s", name)
+	}
+	select {
+	case name := <-stopped:
+		t.Errorf("%s was stopped by StopOne(\"one\")", name)
+	default:
+	}
+	if !s.StopOne("unknown") {
+		t.Error("StopOne of an unknown name reported a failure")
+	}
+	if !s.Stop() || <-stopped != "two" {
+		t.Error("Stop did not stop the remaining Goroutine")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package safego
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// StopTimeout is how long Stopper.Stop waits for its Goroutines to acknowledge
+const StopTimeout = 10 * time.Second
+
+// stopTimeout is StopTimeout, as a variable so that tests need not wait
+var stopTimeout = StopTimeout
+
+// Stopper launches Goroutines which can later be told to stop, and waits for them to do so.
+// The zero value is ready to use.
+type Stopper struct {
+	mutex   sync.Mutex
+	workers []workerT
+}
+
+type workerT struct {
+	name     string
+	stopChan chan bool
+	done     chan struct{}
+}
+
+// Go launches fn via safego.Go, passing it the stop channel it should return on.
+// The stop channel is buffered, so stopping never blocks on a Goroutine which has already finished.
+func (s *Stopper) Go(name string, restart bool, fn func(stopChan chan bool)) {
+	w := workerT{name: name, stopChan: make(chan bool, 1), done: make(chan struct{})}
+	s.mutex.Lock()
+	s.workers = append(s.workers, w)
+	s.mutex.Unlock()
+	go func() {
+		defer close(w.done)
+		run(name, restart, func() { fn(w.stopChan) })
+	}()
+}
+
+// Stop signals every Goroutine launched by Go and waits up to StopTimeout for them to finish,
+// it returns false if any did not.  The Stopper may be reused afterwards.
+func (s *Stopper) Stop() bool {
+	s.mutex.Lock()
+	workers := s.workers
+	s.workers = nil
+	s.mutex.Unlock()
+	return stopAll(workers)
+}
+
+// StopOne stops only the named Goroutine(s), as Stop
+func (s *Stopper) StopOne(name string) bool {
+	var matched []workerT
+	s.mutex.Lock()
+	kept := s.workers[:0]
+	for _, w := range s.workers {
+		if w.name == name {
+			matched = append(matched, w)
+		} else {
+			kept = append(kept, w)
+		}
+	}
+	s.workers = kept
+	s.mutex.Unlock()
+	return stopAll(matched)
+}
+
+func stopAll(workers []workerT) (allStopped bool) {
+	for _, w := range workers {
+		select {
+		case w.stopChan <- true:
+		default: // already signalled
+		}
+	}
+	allStopped = true
+	deadline := time.NewTimer(stopTimeout)
+	defer deadline.Stop()
+	timedOut := false
+	for _, w := range workers {
+		if !timedOut {
+			select {
+			case <-w.done:
+				continue
+			case <-deadline.C:
+				timedOut = true
+			}
+		}
+		select {
+		case <-w.done:
+		default:
+			log.Printf("WARNING: %s did not stop within %v\n", w.name, stopTimeout)
+			allStopped = false
+		}
+	}
+	return allStopped
+}
@@ -20,26 +20,48 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	gotime "time"
 
 	"github.com/SMerrony/aghast/config"
+	"github.com/SMerrony/aghast/events"
+	"github.com/SMerrony/aghast/integrations/aggregate"
+	"github.com/SMerrony/aghast/integrations/alias"
 	"github.com/SMerrony/aghast/integrations/automation"
+	"github.com/SMerrony/aghast/integrations/bridge"
 	"github.com/SMerrony/aghast/integrations/datalogger"
+	"github.com/SMerrony/aghast/integrations/hadiscovery"
 	"github.com/SMerrony/aghast/integrations/hostchecker"
 	"github.com/SMerrony/aghast/integrations/influx"
+	"github.com/SMerrony/aghast/integrations/localsensors"
 	"github.com/SMerrony/aghast/integrations/mqtt2smtp"
 	"github.com/SMerrony/aghast/integrations/mqttcache"
+	"github.com/SMerrony/aghast/integrations/mqttevents"
 	"github.com/SMerrony/aghast/integrations/mqttsender"
+	"github.com/SMerrony/aghast/integrations/notify"
 	"github.com/SMerrony/aghast/integrations/postgres"
+	"github.com/SMerrony/aghast/integrations/rateofchange"
+	"github.com/SMerrony/aghast/integrations/scenes"
 	"github.com/SMerrony/aghast/integrations/scraper"
+	"github.com/SMerrony/aghast/integrations/templatesensor"
 	"github.com/SMerrony/aghast/integrations/time"
+	"github.com/SMerrony/aghast/integrations/transform"
 	"github.com/SMerrony/aghast/integrations/tuya"
+	"github.com/SMerrony/aghast/integrations/virtualswitch"
+	"github.com/SMerrony/aghast/maintenance"
+	"github.com/SMerrony/aghast/metrics"
 	"github.com/SMerrony/aghast/mqtt"
+	"github.com/SMerrony/aghast/registry"
 )
 
 // The Integration interface defines the minimal set of methods that an
@@ -48,67 +70,490 @@ type Integration interface {
 	// LoadConfig func should simply load any config (TOML) files for this Integration
 	LoadConfig(string) error
 
-	// Start func begins running the Integration GoRoutines and should return quickly
-	Start(*mqtt.MQTT)
+	// Start func begins running the Integration GoRoutines and should return quickly.
+	// If the Integration cannot start it should return an error before launching any Goroutines,
+	// it will then be retried later.
+	Start(*mqtt.MQTT) error
 
 	// Stop terminates the Integration and all Goroutines it contains
 	Stop()
 }
 
-var integs = make(map[string]Integration)
+// A DeviceProvider is an Integration whose devices may be targeted via the event bus,
+// they are recorded in the registry while it is running
+type DeviceProvider interface {
+	ProvidesDeviceTypes() registry.Devices
+}
+
+// An Instanced Integration may be enabled more than once, eg. "scraper:printers" and "scraper:weather",
+// each instance loading its own configuration file, eg. scraper-printers.toml
+type Instanced interface {
+	// SetInstance is called with the instance name before LoadConfig
+	SetInstance(string)
+}
+
+const (
+	initialRetryDelay = 10 * gotime.Second
+	maxRetryDelay     = 10 * gotime.Minute
+	// groupStartWait limits how long a slow Integration can hold up those with a later startPriority
+	groupStartWait = 15 * gotime.Second
+	// reloadSubtopic receives the name of an Integration to reload, or "all", when MqttReload is enabled
+	reloadSubtopic = "/server/reload"
+	// maintenanceSubtopic receives "on" or "off" to change maintenance mode
+	maintenanceSubtopic = "/server/maintenance"
+	// maintenanceStateSubtopic receives a retained message with the current maintenance mode
+	maintenanceStateSubtopic = "/maintenance"
+	// heartbeatSubtopic receives a retained status message every HeartbeatSecs
+	heartbeatSubtopic = "/heartbeat"
+)
+
+// startPriority gives the order in which Integrations are started, lowest first, the default is 1.
+// Time starts first so that no ticks are missed, and the Integrations which consume events and
+// queries from others start last.
+var startPriority = map[string]int{
+	"time":       0,
+	"automation": 2,
+	"scenes":     2,
+}
+
+// instanceT is a created Integration, which may be asked to start and to stop concurrently,
+// eg. when it is reloaded while still starting.  Once stopped it is never started.
+type instanceT struct {
+	Integration
+	mutex   sync.Mutex
+	started bool
+	stopped bool
+}
+
+var integs = make(map[string]*instanceT)
+var integsMu sync.RWMutex
+
+// controlMu serialises stopping and reloading Integrations, and guards mainConfig.Integrations
+var controlMu sync.Mutex
 var mainConfig config.MainConfigT
 var mq *mqtt.MQTT
 
-func newIntegration(iName string) {
-	switch iName {
+// errNotEnabled is returned when asked to reload an Integration which is unknown or has been stopped
+var errNotEnabled = errors.New("not an enabled Integration")
+
+// newIntegration creates the Integration for an Integrations list entry, which may name an instance
+func newIntegration(iName string) error {
+	var integ Integration
+	kind, instance := config.SplitInstance(iName)
+	switch kind {
+	case "aggregate":
+		integ = new(aggregate.Aggregate)
+	case "alias":
+		integ = new(alias.Alias)
 	case "automation":
-		integs[iName] = new(automation.Automation)
+		integ = new(automation.Automation)
+	case "bridge":
+		integ = new(bridge.Bridge)
 	case "datalogger":
-		integs[iName] = new(datalogger.DataLogger)
+		integ = new(datalogger.DataLogger)
+	case "hadiscovery":
+		integ = new(hadiscovery.HaDiscovery)
 	case "hostchecker":
-		integs[iName] = new(hostchecker.HostChecker)
+		integ = new(hostchecker.HostChecker)
 	case "influx":
-		integs[iName] = new(influx.Influx)
+		integ = new(influx.Influx)
+	case "localsensors":
+		integ = new(localsensors.LocalSensors)
 	case "mqtt2smtp":
-		integs[iName] = new(mqtt2smtp.Mqtt2smtp)
+		integ = new(mqtt2smtp.Mqtt2smtp)
 	case "mqttcache":
-		integs[iName] = new(mqttcache.MqttCache)
+		integ = new(mqttcache.MqttCache)
+	case "mqttevents":
+		integ = new(mqttevents.MqttEvents)
 	case "mqttsender":
-		integs[iName] = new(mqttsender.MqttSender)
+		integ = new(mqttsender.MqttSender)
+	case "notify":
+		integ = new(notify.Notify)
 	case "postgres":
-		integs[iName] = new(postgres.Postgres)
+		integ = new(postgres.Postgres)
+	case "rateofchange":
+		integ = new(rateofchange.RateOfChange)
+	case "scenes":
+		integ = new(scenes.Scenes)
 	case "scraper":
-		integs[iName] = new(scraper.Scraper)
+		integ = new(scraper.Scraper)
+	case "template":
+		integ = new(templatesensor.TemplateSensor)
 	case "time":
-		integs[iName] = new(time.Time)
+		integ = new(time.Time)
+	case "transform":
+		integ = new(transform.Transform)
 	case "tuya":
-		integs[iName] = new(tuya.Tuya)
+		integ = new(tuya.Tuya)
+	case "virtualswitch":
+		integ = new(virtualswitch.VirtualSwitch)
 	default:
-		log.Fatalf("ERROR: Integration '%s' is not known\n", iName)
+		return fmt.Errorf("Integration '%s' is not known", iName)
+	}
+	if instance != "" {
+		inst, ok := integ.(Instanced)
+		if !ok {
+			return fmt.Errorf("Integration '%s' does not support multiple instances", kind)
+		}
+		inst.SetInstance(instance)
 	}
+	integsMu.Lock()
+	integs[iName] = &instanceT{Integration: integ}
+	integsMu.Unlock()
+	return nil
 }
 
-// StartIntegrations asks each enabled Integration to configure itself, then starts them.
+// instance returns the current instance of the named Integration, or nil if it is not running
+func instance(iName string) *instanceT {
+	integsMu.RLock()
+	defer integsMu.RUnlock()
+	return integs[iName]
+}
+
+// start starts the Integration and registers its devices, unless it has already been started or stopped
+func (in *instanceT) start() (stopped bool, err error) {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	if in.stopped || in.started {
+		return in.stopped, nil
+	}
+	if err = in.Start(mq); err != nil {
+		return false, err
+	}
+	in.started = true
+	if dp, ok := in.Integration.(DeviceProvider); ok {
+		registry.Register(dp.ProvidesDeviceTypes())
+	}
+	return false, nil
+}
+
+// stop forgets the Integration's devices and stops it, if it was started
+func (in *instanceT) stop() {
+	in.mutex.Lock()
+	defer in.mutex.Unlock()
+	in.stopped = true
+	if dp, ok := in.Integration.(DeviceProvider); ok {
+		registry.Remove(dp.ProvidesDeviceTypes().Integration)
+	}
+	if in.started {
+		in.Stop()
+	}
+}
+
+// startIntegration starts an instance of the named Integration, if it fails to start it is retried in the background
+// with increasing delays until it succeeds or is replaced by a reload or stop.
+func startIntegration(iName string, in *instanceT) {
+	stopped, err := in.start()
+	switch {
+	case stopped:
+		log.Printf("INFO: %s Integration was reloaded or stopped, not starting the old one\n", iName)
+	case err != nil:
+		go retryStart(iName, in, err)
+	}
+}
+
+// delayedStart waits before starting an instance of the named Integration, eg. to give a service it depends on
+// time to come up, it is not started if it was reloaded or stopped in the meantime
+func delayedStart(iName string, in *instanceT, delay gotime.Duration) {
+	log.Printf("INFO: %s Integration will start in %v\n", iName, delay)
+	gotime.Sleep(delay)
+	startIntegration(iName, in)
+}
+
+func retryStart(iName string, in *instanceT, err error) {
+	delay := initialRetryDelay
+	for {
+		log.Printf("WARNING: %s Integration failed to start - %s, will retry in %v\n", iName, err.Error(), delay)
+		metrics.IntegrationError(iName)
+		gotime.Sleep(delay)
+		stopped, err := in.start()
+		if stopped {
+			log.Printf("INFO: %s Integration was reloaded or stopped, no longer retrying the old one\n", iName)
+			return
+		}
+		if err == nil {
+			return
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// stopByName stops the named Integration and removes it from the enabled list, controlMu must be held
+func stopByName(iName string) {
+	if in := instance(iName); in != nil {
+		in.stop()
+		integsMu.Lock()
+		delete(integs, iName)
+		integsMu.Unlock()
+	}
+	for ix, in := range mainConfig.Integrations {
+		if in == iName {
+			copy(mainConfig.Integrations[ix:], mainConfig.Integrations[ix+1:])
+			mainConfig.Integrations[len(mainConfig.Integrations)-1] = ""
+			mainConfig.Integrations = mainConfig.Integrations[:len(mainConfig.Integrations)-1]
+			break
+		}
+	}
+}
+
+// reloadIntegration stops, re-creates, re-loads and restarts the named Integration.
+// If its configuration cannot be loaded it is left stopped.  Integrations which are not enabled, including
+// those stopped via the admin page, are not reloaded and errNotEnabled is returned.
+func reloadIntegration(iName string) error {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	if !isEnabled(iName) {
+		return errNotEnabled
+	}
+	if in := instance(iName); in != nil {
+		in.stop()
+	}
+	if err := newIntegration(iName); err != nil {
+		log.Printf("ERROR: %s\n", err.Error())
+		metrics.IntegrationError(iName)
+		return err
+	}
+	in := instance(iName)
+	if err := in.LoadConfig(mainConfig.ConfigDir); err != nil {
+		log.Printf("ERROR: %s Integration could not reload its configuration - %s\n", iName, err.Error())
+		metrics.IntegrationError(iName)
+		return err
+	}
+	go startIntegration(iName, in)
+	return nil
+}
+
+// reloadAll stops every enabled Integration, event consumers first, then re-creates and re-loads them all
+// and restarts them in startPriority order, as at start-up.  It returns those which could not be reloaded,
+// they are left stopped.
+func reloadAll() (failed []string) {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	ordered := startOrder(mainConfig.Integrations)
+	for ix := len(ordered) - 1; ix >= 0; ix-- {
+		if in := instance(ordered[ix]); in != nil {
+			in.stop()
+		}
+	}
+	var loaded []string
+	for _, i := range ordered {
+		err := newIntegration(i)
+		if err == nil {
+			err = instance(i).LoadConfig(mainConfig.ConfigDir)
+		}
+		if err != nil {
+			log.Printf("ERROR: %s Integration could not reload its configuration - %s\n", i, err.Error())
+			metrics.IntegrationError(i)
+			failed = append(failed, i)
+			continue
+		}
+		loaded = append(loaded, i)
+	}
+	go startInOrder(loaded, false)
+	return failed
+}
+
+// enabledIntegrations returns a copy of the enabled Integrations list
+func enabledIntegrations() []string {
+	return configSnapshot().Integrations
+}
+
+// configSnapshot returns a copy of the main configuration, with its own copy of the enabled Integrations list
+func configSnapshot() config.MainConfigT {
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	conf := mainConfig
+	conf.Integrations = append([]string(nil), mainConfig.Integrations...)
+	return conf
+}
+
+// monitorReloadRequests performs the same reloads as the admin page for names published to reloadSubtopic
+func monitorReloadRequests() {
+	topic := mainConfig.MqttBaseTopic + reloadSubtopic
+	ch := mq.SubscribeToTopic(topic)
+	log.Printf("INFO: Integrations may be reloaded via MQTT topic %s\n", topic)
+	for msg := range ch {
+		b, ok := mqtt.PayloadBytes(msg.Payload)
+		if !ok {
+			log.Println("WARNING: MQTT reload request has unexpected payload type, ignoring")
+			continue
+		}
+		iName := strings.TrimSpace(string(b))
+		if iName == "all" {
+			log.Println("INFO: Reloading all Integrations via MQTT request")
+			reloadAll()
+			continue
+		}
+		if err := reloadIntegration(iName); err == errNotEnabled {
+			log.Printf("WARNING: MQTT reload request for unknown or stopped Integration '%s', ignoring\n", iName)
+		} else if err == nil {
+			log.Printf("INFO: Reloaded %s Integration via MQTT request\n", iName)
+		}
+	}
+}
+
+// monitorMaintenanceRequests turns maintenance mode on or off as requested via maintenanceSubtopic
+func monitorMaintenanceRequests() {
+	topic := mainConfig.MqttBaseTopic + maintenanceSubtopic
+	ch := mq.SubscribeToTopic(topic)
+	publishMaintenanceState()
+	for msg := range ch {
+		b, ok := mqtt.PayloadBytes(msg.Payload)
+		if !ok {
+			log.Println("WARNING: MQTT maintenance request has unexpected payload type, ignoring")
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(string(b))) {
+		case "on", "true":
+			maintenance.Set(true)
+		case "off", "false":
+			maintenance.Set(false)
+		default:
+			log.Printf("WARNING: MQTT maintenance request must be 'on' or 'off', got '%s', ignoring\n", string(b))
+			continue
+		}
+		publishMaintenanceState()
+	}
+}
+
+// publishMaintenanceState publishes a retained "on" or "off" to maintenanceStateSubtopic
+func publishMaintenanceState() {
+	state := "off"
+	if maintenance.Enabled() {
+		state = "on"
+	}
+	mq.PublishChan <- mqtt.AghastMsgT{
+		Subtopic: maintenanceStateSubtopic,
+		Qos:      0,
+		Retained: true,
+		Payload:  state,
+	}
+}
+
+// isEnabled reports whether the named Integration is in the enabled list, controlMu must be held
+func isEnabled(iName string) bool {
+	for _, i := range mainConfig.Integrations {
+		if i == iName {
+			return true
+		}
+	}
+	return false
+}
+
+// StartIntegrations asks each enabled Integration to configure itself, then starts them in startPriority order.
 func StartIntegrations(conf config.MainConfigT, mqtt *mqtt.MQTT) {
 	mainConfig = conf
 	mq = mqtt
+	maintenance.Set(conf.MaintenanceMode)
 	for _, i := range conf.Integrations {
-		newIntegration(i)
+		if err := newIntegration(i); err != nil {
+			log.Fatalf("ERROR: %s\n", err.Error())
+		}
 		if err := integs[i].LoadConfig(conf.ConfigDir); err != nil {
 			log.Fatalf("ERROR: %s Integration could not load its configuration", i)
 		}
-		go integs[i].Start(mqtt)
 	}
+	go startInOrder(conf.Integrations, true)
 
 	go dailyTimeRestart()
 
+	if conf.HeartbeatSecs > 0 {
+		go heartbeat(gotime.Duration(conf.HeartbeatSecs) * gotime.Second)
+	}
+
+	if conf.MqttReload {
+		go monitorReloadRequests()
+	}
+
+	go monitorMaintenanceRequests()
+
 	// start a HTTP server for back-end control
 	http.HandleFunc("/", rootHandler)
+	http.HandleFunc("/stats.json", statsHandler)
+	http.HandleFunc("/metrics", metrics.Handler)
 	if err := http.ListenAndServe(":"+strconv.Itoa(conf.ControlPort), nil); err != nil {
 		log.Println("WARNING: Could not start HTTP admin control back-end")
 	}
 }
 
+// startOrder returns the Integration names sorted by startPriority, otherwise keeping their configured order
+func startOrder(iNames []string) []string {
+	ordered := append([]string(nil), iNames...)
+	sort.SliceStable(ordered, func(a, b int) bool {
+		return priority(ordered[a]) < priority(ordered[b])
+	})
+	return ordered
+}
+
+// startInOrder starts the named Integrations in startPriority order, those with the same priority concurrently.
+// Each group is given up to groupStartWait to start before the next group is started anyway.
+// Any StartDelaySecs are only applied if withDelays is set, ie. at startup.
+func startInOrder(iNames []string, withDelays bool) {
+	ordered := startOrder(iNames)
+	for len(ordered) > 0 {
+		p := priority(ordered[0])
+		var wg sync.WaitGroup
+		for len(ordered) > 0 && priority(ordered[0]) == p {
+			i, in := ordered[0], instance(ordered[0])
+			ordered = ordered[1:]
+			if in == nil {
+				continue // stopped meanwhile
+			}
+			if secs := mainConfig.StartDelaySecs[i]; withDelays && secs > 0 {
+				go delayedStart(i, in, gotime.Duration(secs)*gotime.Second)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				startIntegration(i, in)
+				wg.Done()
+			}()
+		}
+		started := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(started)
+		}()
+		select {
+		case <-started:
+		case <-gotime.After(groupStartWait):
+			log.Printf("WARNING: Integrations with start priority %d are still starting after %v, not waiting any longer\n", p, groupStartWait)
+		}
+	}
+}
+
+func priority(iName string) int {
+	kind, _ := config.SplitInstance(iName)
+	if p, found := startPriority[kind]; found {
+		return p
+	}
+	return 1
+}
+
+// CheckIntegrations loads the configuration of every enabled Integration without starting any of them.
+// It returns an error naming each Integration whose configuration could not be loaded.
+func CheckIntegrations(conf config.MainConfigT) error {
+	var failed []string
+	for _, i := range conf.Integrations {
+		err := newIntegration(i)
+		if err == nil {
+			err = integs[i].LoadConfig(conf.ConfigDir)
+		}
+		if err != nil {
+			log.Printf("ERROR: %s Integration could not load its configuration - %s\n", i, err.Error())
+			failed = append(failed, i)
+			continue
+		}
+		log.Printf("INFO: %s Integration configuration loaded\n", i)
+	}
+	if len(failed) > 0 {
+		return errors.New("configuration errors in: " + strings.Join(failed, ", "))
+	}
+	return nil
+}
+
 const homeTemplateMain = `<!DOCTYPE html>
 <html>
  <head>
@@ -128,22 +573,47 @@ const homeTemplateMain = `<!DOCTYPE html>
   <h1>AGHAST - {{.SystemName}}</h1>
   <p>Configuration directory: <samp>{{.ConfigDir}}</samp></p>
   <p>MQTT Broker: <samp>{{.MqttBroker}}</samp></p>
+  {{if .Maintenance}}
+  <p style="color: red">Maintenance mode is ON - Control actions are being suppressed.</p>
+  {{end}}
+  {{if .Failed}}
+  <p style="color: red">These Integrations could not reload their configuration and are stopped:
+   {{range .Failed}}<samp>{{.}}</samp> {{end}}</p>
+  {{end}}
   <h2>Configured Integrations</h2>
    <p>You can reload an Integration's configuration here (it will be stopped, reloaded, and restarted).</p>
    <p>You can also completely stop an Integration that is causing problems; there is no way to restart it other than
 	  stopping the AGHAST server and restarting it.  Take care!</p>
    <form method="POST">
 	<table>
-		<tr><th>Integration</th><th></th><th></th></tr>
-		{{range .Integrations}}
+		<tr><th>Integration</th><th>Instance</th><th></th><th></th></tr>
+		{{range .Instances}}
 		<tr>
-		 <td>{{.}}</td>
-		 <td><button name="reload" value="{{.}}">Reload</button></td>
-		 <td><button name="stop" value="{{.}}">Stop</button></td>
+		 <td>{{.Integration}}</td>
+		 <td>{{.Instance}}</td>
+		 <td><button name="reload" value="{{.ID}}">Reload</button></td>
+		 <td><button name="stop" value="{{.ID}}">Stop</button></td>
 		</tr>
 		{{end}}
 	</table>
+	<p><button name="reloadAll" value="all">Reload All</button> - reload every Integration, in order</p>
    </form>
+  <h2>Event Bus Devices</h2>
+   <p>These devices may be used in Automation Conditions and Scenes.</p>
+   <table>
+	<tr><th>Integration</th><th>Type</th><th>Devices</th></tr>
+	{{range .Devices}}{{$integ := .Integration}}{{range $type, $labels := .Labels}}
+	<tr><td>{{$integ}}</td><td>{{$type}}</td><td>{{range $labels}}<samp>{{.}}</samp> {{end}}</td></tr>
+	{{end}}{{end}}
+   </table>
+  {{if .RecentEvents}}
+  <h2>Recent Events</h2>
+   <table>
+	<tr><th>Event</th><th>Value</th></tr>
+	{{range .RecentEvents}}<tr><td><samp>{{.Name}}</samp></td><td><samp>{{.Value}}</samp></td></tr>
+	{{end}}
+   </table>
+  {{end}}
 `
 
 const homeTemplateStats = `
@@ -156,6 +626,20 @@ const homeTemplateStats = `
  </body>
 </html>`
 
+type rootPageT struct {
+	config.MainConfigT
+	Instances    []instanceRowT
+	Failed       []string // Integrations which could not be reloaded
+	Devices      []registry.Devices
+	Maintenance  bool
+	RecentEvents []events.EventT // newest first
+}
+
+// instanceRowT describes an enabled Integrations list entry on the admin page
+type instanceRowT struct {
+	ID, Integration, Instance string
+}
+
 type sysStatsT struct {
 	TotalMemoryMB uint64
 	NumGoroutines int
@@ -164,41 +648,116 @@ type sysStatsT struct {
 func rootHandler(w http.ResponseWriter, r *http.Request) {
 	// log.Printf("DEBUG: HTTP rootHandler got stop for: %s\n", r.FormValue("stop"))
 	if r.FormValue("stop") != "" {
-		i := r.FormValue("stop")
-		integs[i].Stop()
-		delete(integs, i)
-		for ix, in := range mainConfig.Integrations {
-			if in == i {
-				copy(mainConfig.Integrations[ix:], mainConfig.Integrations[ix+1:])
-				mainConfig.Integrations[len(mainConfig.Integrations)-1] = ""
-				mainConfig.Integrations = mainConfig.Integrations[:len(mainConfig.Integrations)-1]
-			}
-		}
+		controlMu.Lock()
+		stopByName(r.FormValue("stop"))
+		controlMu.Unlock()
 	}
 	// log.Printf("DEBUG: HTTP rootHandler got reload for : %s\n", r.FormValue("reload"))
+	page := rootPageT{MainConfigT: configSnapshot()}
 	if r.FormValue("reload") != "" {
 		i := r.FormValue("reload")
-		integs[i].Stop()
-		newIntegration(i)
-		if err := integs[i].LoadConfig(mainConfig.ConfigDir); err != nil {
-			log.Fatalf("ERROR: %s Integration could not reload its configuration", i)
+		if err := reloadIntegration(i); err != nil {
+			if err == errNotEnabled {
+				log.Printf("WARNING: Admin reload request for unknown or stopped Integration '%s', ignoring\n", i)
+			}
+			page.Failed = append(page.Failed, i)
 		}
-		go integs[i].Start(mq)
+	}
+	if r.FormValue("reloadAll") != "" {
+		log.Println("INFO: Reloading all Integrations")
+		page.Failed = append(page.Failed, reloadAll()...)
+	}
+	page.Integrations = enabledIntegrations()
+	for _, i := range page.Integrations {
+		kind, instance := config.SplitInstance(i)
+		page.Instances = append(page.Instances, instanceRowT{ID: i, Integration: kind, Instance: instance})
+	}
+	page.Devices = registry.All()
+	page.Maintenance = maintenance.Enabled()
+	recent := events.RecentEvents(mainConfig.EventHistory)
+	for ix := len(recent) - 1; ix >= 0; ix-- {
+		page.RecentEvents = append(page.RecentEvents, recent[ix])
 	}
 	t, err := template.New("root").Parse(homeTemplateMain)
 	if err != nil {
 		log.Fatalf("ERROR: Could not parse root admin template - this should not happen!")
 	}
-	err = t.Execute(w, mainConfig)
+	err = t.Execute(w, page)
+
+	t2, err := template.New("root2").Parse(homeTemplateStats)
+	err = t2.Execute(w, readSysStats())
+	log.Println("DEBUG: HTTP Back-end generated a page")
+}
 
-	var sysStats sysStatsT
+func readSysStats() (sysStats sysStatsT) {
 	var memStats runtime.MemStats
 	runtime.ReadMemStats(&memStats)
 	sysStats.TotalMemoryMB = memStats.Sys >> 20
 	sysStats.NumGoroutines = runtime.NumGoroutine()
-	t2, err := template.New("root2").Parse(homeTemplateStats)
-	err = t2.Execute(w, sysStats)
-	log.Println("DEBUG: HTTP Back-end generated a page")
+	return sysStats
+}
+
+// statsJSONT is the read-only view of the admin page served as JSON
+type statsJSONT struct {
+	sysStatsT
+	Integrations []instanceRowT
+	Maintenance  bool
+}
+
+// statsHandler serves the statistics and enabled Integrations as JSON for scripts and monitoring
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := statsJSONT{sysStatsT: readSysStats(), Integrations: []instanceRowT{}, Maintenance: maintenance.Enabled()}
+	for _, i := range enabledIntegrations() {
+		kind, instance := config.SplitInstance(i)
+		stats.Integrations = append(stats.Integrations, instanceRowT{ID: i, Integration: kind, Instance: instance})
+	}
+	payload, err := json.Marshal(stats)
+	if err != nil {
+		log.Printf("WARNING: Could not marshal admin statistics to JSON - %s\n", err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+type heartbeatT struct {
+	Time       string
+	UptimeSecs int64
+	Goroutines int
+}
+
+// heartbeat publishes a retained heartbeatT every interval so that a stalled or dead server can be detected
+// externally by its absence, it also logs a warning if it was itself held up for more than an interval
+func heartbeat(interval gotime.Duration) {
+	started := gotime.Now()
+	ticker := gotime.NewTicker(interval)
+	last := started
+	for now := range ticker.C {
+		if late := now.Sub(last) - interval; late > interval {
+			log.Printf("WARNING: Heartbeat was delayed by %v, the server may have stalled\n", late.Round(gotime.Second))
+		}
+		last = now
+		payload, err := json.Marshal(heartbeatT{
+			Time:       now.Format(gotime.RFC3339),
+			UptimeSecs: int64(now.Sub(started) / gotime.Second),
+			Goroutines: runtime.NumGoroutine(),
+		})
+		if err != nil {
+			log.Fatalln("ERROR: Heartbeat fatal error marshalling data to JSON")
+		}
+		mq.PublishChan <- mqtt.AghastMsgT{
+			Subtopic: heartbeatSubtopic,
+			Qos:      0,
+			Retained: true,
+			Payload:  payload,
+		}
+	}
 }
 
 func dailyTimeRestart() {
@@ -212,13 +771,15 @@ func dailyTimeRestart() {
 	// restart every 24 hours
 	daily := gotime.NewTicker(gotime.Hour * 24)
 	for {
-		log.Println("INFO: Daily Time Integration reload")
-		integs["time"].Stop()
-		newIntegration("time")
-		if err := integs["time"].LoadConfig(mainConfig.ConfigDir); err != nil {
-			log.Fatalln("ERROR: Time Integration could not reload its configuration")
+		// the Time Integration may not be configured, or may have been stopped via the admin page
+		switch err := reloadIntegration("time"); err {
+		case nil:
+			log.Println("INFO: Daily Time Integration reload")
+		case errNotEnabled:
+			log.Println("INFO: Time Integration is not running, skipping its daily reload")
+		default:
+			log.Println("WARNING: Time Integration is stopped until its configuration is fixed and it is reloaded")
 		}
-		go integs["time"].Start(mq)
 		<-daily.C
 	}
 
@@ -0,0 +1,92 @@
+// Copyright ©2022 Steve Merrony
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package server
+
+import (
+	"testing"
+
+	"github.com/SMerrony/aghast/mqtt"
+)
+
+// countingInteg counts the calls made to it
+type countingInteg struct {
+	starts, stops int
+}
+
+func (c *countingInteg) LoadConfig(string) error   { return nil }
+func (c *countingInteg) Start(mq *mqtt.MQTT) error { c.starts++; return nil }
+func (c *countingInteg) Stop()                     { c.stops++ }
+
+func TestInstanceLifecycle(t *testing.T) {
+	started := &countingInteg{}
+	in := &instanceT{Integration: started}
+	in.start()
+	if stopped, _ := in.start(); stopped {
+		t.Error("a running instance reported that it was stopped")
+	}
+	in.stop()
+	if stopped, _ := in.start(); !stopped {
+		t.Error("a stopped instance did not report that it was stopped")
+	}
+	if started.starts != 1 || started.stops != 1 {
+		t.Errorf("started %d and stopped %d times, expected once each", started.starts, started.stops)
+	}
+
+	// eg. a reload while the instance was waiting for its StartDelaySecs
+	replaced := &countingInteg{}
+	in = &instanceT{Integration: replaced}
+	in.stop()
+	in.start()
+	if replaced.starts != 0 || replaced.stops != 0 {
+		t.Errorf("an instance stopped before starting was started %d and stopped %d times", replaced.starts, replaced.stops)
+	}
+}
+
+func TestReloadNotEnabled(t *testing.T) {
+	mainConfig.Integrations = []string{"time"}
+	defer func() { mainConfig.Integrations = nil }()
+	// eg. a forged admin request, or one for an Integration stopped via the admin page
+	for _, iName := range []string{"nosuch", "scenes"} {
+		if err := reloadIntegration(iName); err != errNotEnabled {
+			t.Errorf("reloading %s returned %v, expected errNotEnabled", iName, err)
+		}
+		if instance(iName) != nil {
+			t.Errorf("%s was created", iName)
+		}
+	}
+}
+
+func TestNewIntegrationErrors(t *testing.T) {
+	for _, iName := range []string{"nosuch", "nosuch:upstairs", "time:upstairs", "tuya:accountA"} {
+		if err := newIntegration(iName); err == nil {
+			t.Errorf("newIntegration(%s) did not return an error", iName)
+		}
+	}
+}
+
+func TestNewInstancedIntegration(t *testing.T) {
+	for _, iName := range []string{"bridge:garage", "hostchecker:garage", "influx:energy", "postgres:energy", "scraper:printers"} {
+		if err := newIntegration(iName); err != nil {
+			t.Errorf("newIntegration(%s) returned %v", iName, err)
+		}
+		integsMu.Lock()
+		delete(integs, iName)
+		integsMu.Unlock()
+	}
+}